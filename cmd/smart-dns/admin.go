@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"smart-dns/internal/cache"
+	"smart-dns/internal/dnsserver"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// admin serves operator endpoints on the admin listener (--admin), which
+// should not be exposed beyond the host or management network, and the
+// zone endpoints automation uses on the health listener (--health).
+type admin struct {
+	res   *dnsserver.Resolver
+	cache cachePeeker // nil when the cache can't be inspected
+	stats cacheStats  // nil when the cache keeps no statistics
+	drain *drainer
+	// reloader and zonesDir back /admin/reload; reloader.stores holds the
+	// zones of every view.
+	reloader *zoneReloader
+	zonesDir string
+	// token is the bearer token endpoints that change zones or show zone
+	// and cache contents or statistics require; they are refused when it
+	// is empty.
+	token string
+}
+
+// cachePeeker is implemented by caches that support inspection without
+// side effects (cache.RRCaches).
+type cachePeeker interface {
+	PeekPositive(name string, qtype uint16) (*dns.Msg, time.Duration, bool)
+	PeekNegative(name string, qtype uint16, rcode int) (time.Duration, bool)
+}
+
+// cacheStats is implemented by caches that count their hits and misses
+// (cache.RRCaches).
+type cacheStats interface {
+	Stats() cache.Stats
+}
+
+func (a *admin) routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /drain", a.handleDrain)
+	mux.HandleFunc("POST /drain", a.authorized(a.handleDrain))
+	mux.HandleFunc("DELETE /drain", a.authorized(a.handleDrain))
+	mux.HandleFunc("GET /export", a.authorized(a.handleExport))
+	mux.HandleFunc("GET /cache", a.authorized(a.handleCache))
+	mux.HandleFunc("GET /stats", a.authorized(a.handleStats))
+}
+
+// healthRoutes registers the endpoints served on the health listener.
+func (a *admin) healthRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /admin/reload", a.authorized(a.handleReload))
+	mux.HandleFunc("GET /admin/zones", a.authorized(a.handleZones))
+	mux.HandleFunc("GET /admin/zones/{zone}", a.authorized(a.handleZone))
+}
+
+// authorized wraps h to require "Authorization: Bearer <token>".
+func (a *admin) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token == "" {
+			http.Error(w, "admin token not configured", http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleReload reloads the zone directory, or only the zone given as
+// ?zone=, like the file watcher does, and reports the zones' serials.
+func (a *admin) handleReload(w http.ResponseWriter, r *http.Request) {
+	var sum reloadSummary
+	var err error
+	if name := r.URL.Query().Get("zone"); name != "" {
+		sum, err = a.reloader.reloadZone(a.zonesDir, name)
+	} else {
+		sum, err = a.reloader.reloadAll(a.zonesDir)
+	}
+	switch {
+	case errors.Is(err, errZoneNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, sum)
+}
+
+// handleDrain reports (GET), enters (POST) or leaves (DELETE) drain mode.
+func (a *admin) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		a.drain.Start("admin api")
+	case http.MethodDelete:
+		a.drain.Cancel()
+	}
+	writeJSON(w, map[string]bool{"draining": a.res.Draining()})
+}
+
+// handleExport dumps every zone of every view as currently served, in the
+// zone file schema, as a point-in-time backup.
+func (a *admin) handleExport(w http.ResponseWriter, r *http.Request) {
+	var all []*zone.ZoneIndex
+	for _, s := range a.reloader.stores {
+		for _, zi := range s.Snapshot() {
+			all = append(all, zi)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].View != all[j].View {
+			return all[i].View < all[j].View
+		}
+		return all[i].ZoneFQDN < all[j].ZoneFQDN
+	})
+	zones := make([]*zone.ZoneFile, 0, len(all))
+	for _, zi := range all {
+		zones = append(zones, zi.ToZoneFile())
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="smartdns-export.json"`)
+	writeJSON(w, map[string]any{
+		"exported_at": time.Now().UTC().Format(time.RFC3339),
+		"zones":       zones,
+	})
+}
+
+type loadedZone struct {
+	Zone   string `json:"zone"`
+	View   string `json:"view,omitempty"`
+	Serial uint32 `json:"serial"`
+	File   string `json:"file,omitempty"`
+}
+
+// handleZones lists the zones loaded in every view.
+func (a *admin) handleZones(w http.ResponseWriter, r *http.Request) {
+	out := []loadedZone{}
+	for view, s := range a.reloader.stores {
+		for _, zi := range s.Snapshot() {
+			out = append(out, loadedZone{Zone: zi.ZoneFQDN, View: view, Serial: zi.Serial, File: zi.File})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].View != out[j].View {
+			return out[i].View < out[j].View
+		}
+		return out[i].Zone < out[j].Zone
+	})
+	writeJSON(w, out)
+}
+
+// handleZone returns one zone (of ?view=, default the default view) as
+// served, in the zone file schema; saved as a .dns file it loads back as
+// the same zone.
+func (a *admin) handleZone(w http.ResponseWriter, r *http.Request) {
+	s := a.reloader.stores[r.URL.Query().Get("view")]
+	if s == nil {
+		http.Error(w, "unknown view", http.StatusNotFound)
+		return
+	}
+	zi := s.Snapshot()[dns.CanonicalName(r.PathValue("zone"))]
+	if zi == nil {
+		http.Error(w, "zone not loaded", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, zi.ToZoneFile())
+}
+
+type cachedNegative struct {
+	Rcode        string  `json:"rcode"`
+	TTLRemaining float64 `json:"ttl_remaining"`
+}
+
+type cachedPositive struct {
+	TTLRemaining float64  `json:"ttl_remaining"`
+	Rcode        string   `json:"rcode"`
+	Answer       []string `json:"answer"`
+	Authority    []string `json:"authority,omitempty"`
+}
+
+// handleStats reports the cache counters since startup and its size.
+func (a *admin) handleStats(w http.ResponseWriter, r *http.Request) {
+	if a.stats == nil {
+		http.Error(w, "cache keeps no statistics", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, a.stats.Stats())
+}
+
+// handleCache reports what the cache holds for ?name=&type= (type defaults
+// to A) without touching LRU order or expiring anything.
+func (a *admin) handleCache(w http.ResponseWriter, r *http.Request) {
+	if a.cache == nil {
+		http.Error(w, "cache does not support inspection", http.StatusNotImplemented)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	name = dns.Fqdn(name)
+	qtype := dns.TypeA
+	if t := r.URL.Query().Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			http.Error(w, "unknown type", http.StatusBadRequest)
+			return
+		}
+	}
+	out := struct {
+		Name     string           `json:"name"`
+		Type     string           `json:"type"`
+		Positive *cachedPositive  `json:"positive"`
+		Negative []cachedNegative `json:"negative"`
+	}{Name: name, Type: dns.TypeToString[qtype], Negative: []cachedNegative{}}
+	if m, left, ok := a.cache.PeekPositive(name, qtype); ok {
+		p := &cachedPositive{TTLRemaining: left.Seconds(), Rcode: dns.RcodeToString[m.Rcode], Answer: []string{}}
+		for _, rr := range m.Answer {
+			p.Answer = append(p.Answer, rr.String())
+		}
+		for _, rr := range m.Ns {
+			p.Authority = append(p.Authority, rr.String())
+		}
+		out.Positive = p
+	}
+	for _, rcode := range []int{dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeServerFailure} {
+		if left, ok := a.cache.PeekNegative(name, qtype, rcode); ok {
+			out.Negative = append(out.Negative, cachedNegative{Rcode: dns.RcodeToString[rcode], TTLRemaining: left.Seconds()})
+		}
+	}
+	writeJSON(w, out)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
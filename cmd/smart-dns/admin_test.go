@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"smart-dns/internal/dnsserver"
+	"smart-dns/internal/zone"
+)
+
+// testZone is a JSON zone file for example.com.; format in the view and
+// serial.
+const testZone = `{"zone": "example.com.", "view": %q, "serial": %d,
+  "soa": {"mname": "ns1.example.com.", "rname": "hostmaster.example.com."},
+  "ns": ["ns1.example.com."]}`
+
+// indexZone indexes the JSON zone file src.
+func indexZone(t *testing.T, src string) *zone.ZoneIndex {
+	t.Helper()
+	var zf zone.ZoneFile
+	if err := json.Unmarshal([]byte(src), &zf); err != nil {
+		t.Fatal(err)
+	}
+	zi, err := zf.ToIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zi
+}
+
+const testToken = "s3cret"
+
+// newTestAdmin returns the routes of a, those of the admin and the health
+// listener both; they require testToken.
+func newTestAdmin(a *admin) *http.ServeMux {
+	a.token = testToken
+	mux := http.NewServeMux()
+	a.routes(mux)
+	a.healthRoutes(mux)
+	return mux
+}
+
+// adminRequest sends method path to mux, with token as the bearer token
+// unless it is empty.
+func adminRequest(mux *http.ServeMux, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuth(t *testing.T) {
+	z, _ := newTestReloader(t)
+	mux := newTestAdmin(&admin{reloader: z})
+	for _, path := range []string{"/export", "/cache?name=www.example.com", "/stats", "/admin/zones", "/admin/zones/example.com"} {
+		if rec := adminRequest(mux, "GET", path, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a token: status %d, want 401", path, rec.Code)
+		}
+		if rec := adminRequest(mux, "GET", path, "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s with a wrong token: status %d, want 401", path, rec.Code)
+		}
+		if rec := adminRequest(mux, "GET", path, testToken); rec.Code == http.StatusUnauthorized || rec.Code == http.StatusForbidden {
+			t.Errorf("GET %s with the token: status %d", path, rec.Code)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "example.com.dns")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(testZone, "", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	z, store := newTestReloader(t)
+	a := &admin{reloader: z, zonesDir: dir}
+	mux := newTestAdmin(a)
+	if rec := adminRequest(mux, "POST", "/admin/reload", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want 401", rec.Code)
+	}
+	a.token = ""
+	if rec := adminRequest(mux, "POST", "/admin/reload", testToken); rec.Code != http.StatusForbidden {
+		t.Errorf("without a configured token: status %d, want 403", rec.Code)
+	}
+	a.token = testToken
+	if store.Snapshot()["example.com."] != nil {
+		t.Fatal("zone loaded by refused reloads")
+	}
+
+	rec := adminRequest(mux, "POST", "/admin/reload?zone=example.com", testToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var sum reloadSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &sum); err != nil {
+		t.Fatal(err)
+	}
+	if len(sum.Zones) != 1 || sum.Zones[0].Zone != "example.com." || sum.Zones[0].Serial != 1 || sum.Zones[0].Change != "added" {
+		t.Errorf("summary %+v, want example.com. added at serial 1", sum)
+	}
+	if rec := adminRequest(mux, "POST", "/admin/reload?zone=example.org", testToken); rec.Code != http.StatusNotFound {
+		t.Errorf("zone without a file: status %d, want 404", rec.Code)
+	}
+}
+
+func TestZones(t *testing.T) {
+	z, store := newTestReloader(t)
+	internal := zone.NewStore()
+	z.stores["internal"] = internal
+	store.SwapZone(indexZone(t, fmt.Sprintf(testZone, "", 1)))
+	internal.SwapZone(indexZone(t, fmt.Sprintf(testZone, "internal", 2)))
+	mux := newTestAdmin(&admin{reloader: z})
+
+	rec := adminRequest(mux, "GET", "/admin/zones", testToken)
+	var list []loadedZone
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	want := []loadedZone{{Zone: "example.com.", Serial: 1}, {Zone: "example.com.", View: "internal", Serial: 2}}
+	if len(list) != 2 || list[0] != want[0] || list[1] != want[1] {
+		t.Errorf("zones %+v, want %+v", list, want)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		serial uint32
+	}{
+		{"/admin/zones/example.com", 1},
+		{"/admin/zones/example.com.?view=internal", 2},
+	} {
+		rec := adminRequest(mux, "GET", tt.path, testToken)
+		var zf zone.ZoneFile
+		if err := json.Unmarshal(rec.Body.Bytes(), &zf); err != nil {
+			t.Fatalf("%s: status %d: %v", tt.path, rec.Code, err)
+		}
+		if zf.Serial != tt.serial {
+			t.Errorf("%s: serial %d, want %d", tt.path, zf.Serial, tt.serial)
+		}
+	}
+	if rec := adminRequest(mux, "GET", "/admin/zones/example.org", testToken); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown zone: status %d, want 404", rec.Code)
+	}
+}
+
+func TestDrainAuth(t *testing.T) {
+	res := dnsserver.NewResolver(slog.New(slog.NewTextHandler(io.Discard, nil)), zone.NewStore(), nil)
+	d := &drainer{logger: res.Logger, res: res}
+	mux := newTestAdmin(&admin{res: res, drain: d})
+	if rec := adminRequest(mux, "GET", "/drain", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /drain without a token: status %d, want 200", rec.Code)
+	}
+	for _, method := range []string{"POST", "DELETE"} {
+		if rec := adminRequest(mux, method, "/drain", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s /drain without a token: status %d, want 401", method, rec.Code)
+		}
+	}
+	if res.Draining() {
+		t.Fatal("draining after unauthorized POST /drain")
+	}
+	if rec := adminRequest(mux, "POST", "/drain", testToken); rec.Code != http.StatusOK || !res.Draining() {
+		t.Errorf("POST /drain with the token: status %d, draining %v", rec.Code, res.Draining())
+	}
+	if rec := adminRequest(mux, "DELETE", "/drain", ""); rec.Code != http.StatusUnauthorized || !res.Draining() {
+		t.Errorf("DELETE /drain without a token: status %d, draining %v", rec.Code, res.Draining())
+	}
+	if rec := adminRequest(mux, "DELETE", "/drain", testToken); rec.Code != http.StatusOK || res.Draining() {
+		t.Errorf("DELETE /drain with the token: status %d, draining %v", rec.Code, res.Draining())
+	}
+}
+
+func TestExportViews(t *testing.T) {
+	z, store := newTestReloader(t)
+	internal := zone.NewStore()
+	z.stores["internal"] = internal
+	store.SwapZone(indexZone(t, fmt.Sprintf(testZone, "", 1)))
+	internal.SwapZone(indexZone(t, fmt.Sprintf(testZone, "internal", 2)))
+	mux := newTestAdmin(&admin{reloader: z})
+	rec := adminRequest(mux, "GET", "/export", testToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var out struct {
+		Zones []zone.ZoneFile `json:"zones"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Zones) != 2 {
+		t.Fatalf("exported %d zones, want example.com. of both views", len(out.Zones))
+	}
+	if out.Zones[0].View != "" || out.Zones[0].Serial != 1 || out.Zones[1].View != "internal" || out.Zones[1].Serial != 2 {
+		t.Errorf("exported %+v, want the default view's zone then the internal one's", out.Zones)
+	}
+}
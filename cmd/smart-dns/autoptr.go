@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"smart-dns/internal/zone"
+)
+
+// addPTRs fills the reverse zones among zones with PTRs generated from the
+// forward ones (see zone.AddPTRs), logging shared addresses.
+func addPTRs(l *slog.Logger, zones []*zone.ZoneIndex, def bool) {
+	for _, rev := range zones {
+		if rev.IsReverse() {
+			addPTRsTo(l, rev, zones, def)
+		}
+	}
+}
+
+func addPTRsTo(l *slog.Logger, rev *zone.ZoneIndex, zones []*zone.ZoneIndex, def bool) {
+	for _, c := range zone.AddPTRs(rev, zones, def) {
+		l.Warn("address shared by several hosts, PTRs kept for all", "name", c.Name, "hosts", strings.Join(c.Targets, ","))
+	}
+}
+
+// refreshPTRs re-reads the reverse zones of store from their files and
+// regenerates their PTRs, so they follow changes to forward zones.
+func (z *zoneReloader) refreshPTRs(store *zone.Store) {
+	z.ptrMu.Lock()
+	defer z.ptrMu.Unlock()
+	snap := store.Snapshot()
+	zones := make([]*zone.ZoneIndex, 0, len(snap))
+	var revs []*zone.ZoneIndex
+	for _, zi := range snap {
+		if zi.IsReverse() && len(zi.Files) > 0 {
+			fresh, err := zone.LoadZoneFiles(zi.Files)
+			if err != nil {
+				z.warnFailure("zone index", zi.File, err)
+				continue
+			}
+			zi = fresh
+			revs = append(revs, zi)
+		}
+		zones = append(zones, zi)
+	}
+	for _, rev := range revs {
+		addPTRsTo(z.logger, rev, zones, z.autoPTR)
+		store.SwapZone(rev)
+		z.cache.InvalidateZone(rev.ZoneFQDN)
+	}
+}
+
+// indexFile reads and indexes the zone file at path. Errors name path.
+func indexFile(path string) (*zone.ZoneIndex, error) {
+	return zone.LoadZoneFiles([]string{path})
+}
+
+func zoneList(m map[string]*zone.ZoneIndex) []*zone.ZoneIndex {
+	out := make([]*zone.ZoneIndex, 0, len(m))
+	for _, zi := range m {
+		out = append(out, zi)
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"smart-dns/internal/zone"
+)
+
+// runCheck implements "smart-dns check [dir]": it loads every zone file in
+// dir (default --zones-dir's default) without starting a server, prints one
+// line per problem and a summary, and returns the process exit code: 0
+// when all files are clean, 1 otherwise.
+func runCheck(args []string, out io.Writer) int {
+	dir := getenv("SMARTDNS_ZONES_DIR", "./dns")
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && zone.IsZoneFile(d.Name()) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(out, "%s: %v\n", dir, err)
+		return 1
+	}
+	sort.Strings(files)
+	problems := 0
+	var keys []string
+	groups := make(map[string][]string) // zone key -> its files
+	for _, f := range files {
+		zi, err := indexFile(f)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			problems++
+			continue
+		}
+		if groups[zi.Key()] == nil {
+			keys = append(keys, zi.Key())
+		}
+		groups[zi.Key()] = append(groups[zi.Key()], f)
+	}
+	for _, k := range keys {
+		zi, err := zone.LoadZoneFiles(groups[k])
+		if err != nil {
+			fmt.Fprintln(out, err)
+			problems++
+			continue
+		}
+		found := append(zi.Conflicts, checkZone(zi)...)
+		for _, p := range found {
+			fmt.Fprintf(out, "%s: %s\n", strings.Join(zi.Files, ", "), p)
+		}
+		problems += len(found)
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(out, "%s: no zone files\n", dir)
+		problems++
+	}
+	fmt.Fprintf(out, "checked %d zone files in %s: %d problems\n", len(files), dir, problems)
+	if problems > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkZone reports problems in a zone that loads but likely doesn't do
+// what was meant: duplicate records, and whatever ZoneIndex.Lint finds.
+func checkZone(zi *zone.ZoneIndex) []string {
+	var out []string
+	if zi.Duplicates > 0 {
+		out = append(out, fmt.Sprintf("%d duplicate records", zi.Duplicates))
+	}
+	return append(out, zi.Lint()...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"smart-dns/internal/dnsserver"
+)
+
+// drainer moves the node in and out of drain mode: health checks fail so
+// load balancers stop sending traffic, queries keep being answered, and the
+// process optionally shuts down once the grace period elapses.
+type drainer struct {
+	logger *slog.Logger
+	res    *dnsserver.Resolver
+	grace  time.Duration
+	stop   context.CancelFunc
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func (d *drainer) Start(reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.res.Draining() {
+		return
+	}
+	d.res.SetDraining(true)
+	d.logger.Info("draining", "reason", reason, "grace", d.grace)
+	if d.grace > 0 {
+		d.timer = time.AfterFunc(d.grace, d.stop)
+	}
+}
+
+// Cancel leaves drain mode and aborts a pending grace-period shutdown.
+func (d *drainer) Cancel() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.res.Draining() {
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.res.SetDraining(false)
+	d.logger.Info("drain cancelled")
+}
@@ -2,28 +2,45 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"smart-dns/internal/acl"
+	"smart-dns/internal/blocklist"
 	"smart-dns/internal/cache"
 	"smart-dns/internal/dnsserver"
 	logx "smart-dns/internal/log"
+	"smart-dns/internal/metrics"
+	"smart-dns/internal/ratelimit"
+	"smart-dns/internal/rpz"
+	"smart-dns/internal/tsig"
 	"smart-dns/internal/watch"
 	"smart-dns/internal/zone"
 
 	"github.com/miekg/dns"
 )
 
+// version is the build version, set with -ldflags "-X main.version=...".
+var version = "dev"
+
 func getenv(k, def string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
@@ -32,102 +49,737 @@ func getenv(k, def string) string {
 }
 
 func main() {
-	var listenUDP = flag.String("listen-udp", getenv("SMARTDNS_LISTEN_UDP", ":53"), "UDP listen addr")
-	var listenTCP = flag.String("listen-tcp", getenv("SMARTDNS_LISTEN_TCP", ":53"), "TCP listen addr")
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:], os.Stdout))
+	}
+	var listenUDP = flag.String("listen-udp", getenv("SMARTDNS_LISTEN_UDP", ":53"), "comma-separated UDP listen addrs, e.g. 192.0.2.53:53,127.0.0.1:53")
+	var listenTCP = flag.String("listen-tcp", getenv("SMARTDNS_LISTEN_TCP", ":53"), "comma-separated TCP listen addrs")
+	var listenTLS = flag.String("listen-tls", getenv("SMARTDNS_LISTEN_TLS", ""), "DNS-over-TLS listen addr, e.g. :853 (needs --tls-cert/--tls-key)")
+	var tlsCert = flag.String("tls-cert", getenv("SMARTDNS_TLS_CERT", ""), "TLS certificate file (PEM)")
+	var tlsKey = flag.String("tls-key", getenv("SMARTDNS_TLS_KEY", ""), "TLS private key file (PEM)")
+	var tcpBacklog = flag.Int("tcp-backlog", 0, "TCP/DoT listen backlog (0 = system default; capped by the kernel)")
+	var tcpMaxConns = flag.Int("tcp-max-conns", 0, "max open connections per TCP/DoT listener; extra ones are dropped (0 = unlimited)")
+	var tcpMaxQueries = flag.Int("tcp-max-queries", 0, "queries per TCP/DoT connection before it is closed (0 = 128, -1 = unlimited)")
+	var tcpIdleTimeout = flag.Duration("tcp-idle-timeout", 8*time.Second, "close TCP/DoT connections idle this long between queries; advertised to clients sending EDNS TCP keepalive")
 	var zonesDir = flag.String("zones-dir", getenv("SMARTDNS_ZONES_DIR", "./dns"), "zones dir")
 	var cacheSize = flag.Int("cache-size", atoi(getenv("SMARTDNS_CACHE_SIZE", "100000"), 100000), "RR cache size")
+	var negCacheSize = flag.Int("neg-cache-size", atoi(getenv("SMARTDNS_NEG_CACHE_SIZE", "0"), 0), "negative (NXDOMAIN/NODATA) cache size (0 = a tenth of --cache-size)")
+	var cacheSweep = flag.Duration("cache-sweep-interval", time.Minute, "remove expired cache entries this often (0 disables; they are otherwise dropped only when looked up or evicted)")
+	var cacheFile = flag.String("cache-file", getenv("SMARTDNS_CACHE_FILE", ""), "save the positive cache here on shutdown and restore it at startup (empty disables)")
 	var logLevel = flag.String("log-level", getenv("SMARTDNS_LOG_LEVEL", "info"), "log level")
+	var queryLog = flag.String("query-log", getenv("SMARTDNS_QUERY_LOG", ""), "append one JSON line per query to this file (queries are also logged at debug level)")
 	var metricsAddr = flag.String("metrics", getenv("SMARTDNS_METRICS", ":9090"), "metrics addr")
 	var healthAddr = flag.String("health", getenv("SMARTDNS_HEALTH", ":8080"), "health addr")
+	var adminAddr = flag.String("admin", getenv("SMARTDNS_ADMIN", "127.0.0.1:8081"), "admin API addr (empty disables)")
+	var adminToken = flag.String("admin-token", getenv("SMARTDNS_ADMIN_TOKEN", ""), "bearer token required by the admin endpoints (empty disables them)")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", 3*time.Second, "on shutdown, how long in-flight queries get to finish after the listeners close")
+	var drainGrace = flag.Duration("drain-grace", 0, "after entering drain mode, shut down once this elapses (0 waits for a stop signal)")
+	var drainTTL = flag.Uint("drain-ttl", 0, "cap response TTLs at this many seconds while draining (0 disables)")
+	var strictZones = flag.Bool("strict-zones", false, "refuse zones with dangling in-zone targets, apex NS without glue or CNAME loops (see \"smart-dns check\")")
+	var autoPTR = flag.Bool("auto-ptr", false, "generate PTRs in loaded reverse zones from forward A/AAAA records (zones override with \"generate_ptr\")")
+	var rotate = flag.Bool("rotate", false, "serve multi-address A/AAAA answers round-robin (off keeps zone file order)")
+	var deterministic = flag.Bool("deterministic", false, "sort the records of every RRset in answers and never rotate or weight them, for stable output (excludes --rotate)")
+	var minimalResponses = flag.Bool("minimal-responses", true, "omit the zone NS set from the authority section of positive answers")
+	var additionalProcessing = flag.Bool("additional-processing", true, "add A/AAAA for MX/NS targets to the additional section")
+	var allowQuery = flag.String("allow-query", getenv("SMARTDNS_ALLOW_QUERY", ""), "comma-separated CIDRs/IPs allowed to query at all; others get REFUSED (empty allows all)")
+	var views = flag.String("views", getenv("SMARTDNS_VIEWS", ""), "split-horizon views as name=CIDR,CIDR;name2=CIDR, matched in order; zone files pick a view with \"view\"")
+	var allowRecursion = flag.String("allow-recursion", getenv("SMARTDNS_ALLOW_RECURSION", ""), "comma-separated CIDRs/IPs the resolver serves; others get REFUSED for names outside our zones (empty allows all)")
+	var allowTransfer = flag.String("allow-transfer", getenv("SMARTDNS_ALLOW_TRANSFER", ""), "comma-separated CIDRs/IPs allowed to AXFR (empty refuses all)")
+	var tsigKeys = flag.String("tsig-keys", getenv("SMARTDNS_TSIG_KEYS", ""), "JSON file of TSIG keys; once set, zone transfers and updates must be TSIG-signed")
+	var allowUpdate = flag.String("allow-update", getenv("SMARTDNS_ALLOW_UPDATE", ""), "comma-separated CIDRs/IPs allowed to send dynamic updates (empty refuses all)")
+	var persistUpdates = flag.Bool("persist-updates", false, "write dynamically updated zones back to their .dns/YAML file")
+	var maxTransfers = flag.Int("max-transfers", 10, "max concurrent outgoing zone transfers (0 = unlimited)")
+	var transferRate = flag.Int("transfer-rate", 0, "max transfers one peer may start per minute (0 = unlimited)")
+	var maxBytesByType = flag.String("max-udp-bytes-by-type", "", "per-qtype UDP response size caps, e.g. ANY=512,TXT=1232 (over the cap: TC)")
+	var maxRecordsByType = flag.String("max-records-by-type", "", "per-qtype UDP answer record caps, e.g. TXT=8 (over the cap: TC)")
+	var rrlRate = flag.Int("rrl-responses-per-second", 0, "response rate limit per client /24 (IPv6 /56), qname and rcode; over it UDP answers are TC=1 (0 disables)")
+	var rrlWindow = flag.Duration("rrl-window", 5*time.Second, "RRL burst window: a bucket holds rate*window responses")
+	var echoMode = flag.Bool("echo-mode", false, "TESTING ONLY: answer every query with a fixed A record, skipping zones and cache")
 	var enableResolver = flag.Bool("resolver", false, "enable iterative resolver via root servers")
+	var forwardZones listFlag
+	flag.Var(&forwardZones, "forward-zone", "forward names under a domain to its own resolvers, as corp.internal=10.0.0.53:53[,host:port]; repeatable, longest domain wins")
+	var forward = flag.String("forward", getenv("SMARTDNS_FORWARD", ""), "comma-separated upstream resolvers (host:port) to forward names outside our zones to, instead of resolving from the roots")
+	var logTCQueries = flag.Bool("log-tc-queries", false, "log queries with the TC bit set (debug level)")
+	var logMalformed = flag.Bool("log-malformed", false, "hex-dump queries answered with FORMERR (debug level, first 512 bytes)")
+	var blocklists listFlag
+	flag.Var(&blocklists, "blocklist", "hosts-format or domain-list file of names to block (and everything below them); repeatable, reloaded on change")
+	var anyPolicy = flag.String("any-policy", dnsserver.AnyMinimal, "answer to ANY queries: minimal (SOA only), hinfo (RFC 8482 HINFO) or full (every RRset at the name; amplification risk)")
+	var rpzZone = flag.String("rpz-zone", getenv("SMARTDNS_RPZ_ZONE", ""), "response policy zone (RPZ, master format) overriding answers for the names it lists; reloaded on change")
+	var blockMode = flag.String("blocklist-mode", dnsserver.BlockNXDomain, "answer for blocked names: nxdomain, or zero (A 0.0.0.0, AAAA ::)")
+	var cookieSecret = flag.String("cookie-secret", getenv("SMARTDNS_COOKIE_SECRET", ""), "DNS cookie secret, 32 hex digits; share it across anycast nodes (empty: random per start)")
+	var requireCookie = flag.Bool("require-cookie", false, "only recurse for UDP clients that echo a valid server cookie (others get BADCOOKIE or TC=1)")
+	var chaosVersion = flag.String("chaos-version", version, "TXT answer to CHAOS version.bind./id.server. queries (empty refuses them)")
+	var nsid = flag.String("nsid", getenv("SMARTDNS_NSID", hostname()), "node identifier sent to clients requesting EDNS NSID, e.g. per anycast instance (empty disables)")
+	var resolverFamily = flag.String("resolver-family", dnsserver.FamilyBoth, "address family the resolver queries servers over: both, v4 or v6 (both prefers what this host can route)")
+	var resolverParallelism = flag.Int("resolver-parallelism", 2, "servers of a zone the resolver queries concurrently; the first answer wins (1 queries them one by one)")
+	var resolverUDPTimeout = flag.Duration("resolver-udp-timeout", 3*time.Second, "timeout of each UDP query to an upstream server (resolver and forwarders)")
+	var resolverTCPTimeout = flag.Duration("resolver-tcp-timeout", 5*time.Second, "timeout of each TCP query to an upstream server (resolver and forwarders)")
+	var resolverRetries = flag.Int("resolver-retries", 1, "extra passes over a zone's servers, after a short backoff, when none of them answered")
+	var resolverDeadline = flag.Duration("resolver-deadline", 10*time.Second, "give up on an iterative resolution after this long (0 = no limit)")
+	var caseRandom = flag.Bool("0x20", false, "randomize the letter case of iterative resolver query names and drop responses that don't echo it")
+	var validateDNSSEC = flag.Bool("validate-dnssec", false, "validate iterative answers from the root trust anchors; AD for validated answers, SERVFAIL for bogus ones")
+	var localRootZone = flag.String("local-root-zone", "", "root zone file (master format) served locally to the resolver (RFC 8806)")
+	var serveStaleTTL = flag.Duration("serve-stale-ttl", 0, "answer from cache entries expired up to this long ago when resolution fails (RFC 8767; 0 disables)")
+	var prefetch = flag.Bool("prefetch", false, "refresh popular resolver answers in the background shortly before they expire")
+	var prefetchHits = flag.Uint("prefetch-min-hits", 10, "cache hits before an answer qualifies for prefetch")
+	var maxNegativeTTL = flag.Duration("max-negative-ttl", 3*time.Hour, "cap on how long resolver NXDOMAIN/NODATA answers are cached (0 = as the SOA says)")
+	var servfailTTL = flag.Duration("servfail-ttl", 5*time.Second, "how long resolver failures are cached (0 disables)")
+	var specialUse = flag.Bool("special-use-zones", true, "answer localhost, .invalid, .local, .onion and RFC 1918 reverse names locally unless a zone covers them")
+	var dns64Prefix = flag.String("dns64-prefix", getenv("SMARTDNS_DNS64_PREFIX", ""), "NAT64 prefix (e.g. 64:ff9b::/96) to synthesize AAAA answers in for names with only A records (empty disables)")
+	var localOnly = flag.String("local-only", getenv("SMARTDNS_LOCAL_ONLY", ""), "comma-separated suffixes never resolved upstream (e.g. corp,internal)")
 	flag.Parse()
 
 	logger := logx.New(*logLevel)
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	// Health: /healthz is liveness and always answers; /readyz fails until
+	// zones are loaded and the listeners are bound, and again while draining
+	// or shutting down, so orchestrators can tell "not ready" from "dead".
+	var ready atomic.Bool
+	var res *dnsserver.Resolver
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte("ok"))
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !ready.Load():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not ready"))
+		case res.Draining():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("draining"))
+		default:
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte("ready"))
+		}
+	})
+	go func() { _ = http.ListenAndServe(*healthAddr, nil) }()
+
 	zonesMap, err := zone.LoadZonesDir(*zonesDir)
 	if err != nil {
 		logger.Error("load zones", "err", err)
 		os.Exit(1)
 	}
 	store := zone.NewStore()
+	viewList, err := parseViews(*views)
+	if err != nil {
+		logger.Error("views", "err", err)
+		os.Exit(1)
+	}
+	var keys tsig.Keys
+	if *tsigKeys != "" {
+		if keys, err = tsig.Load(*tsigKeys); err != nil {
+			logger.Error("tsig-keys", "err", err)
+			os.Exit(1)
+		}
+	}
+	stores := map[string]*zone.Store{"": store}
+	for _, v := range viewList {
+		stores[v.Name] = v.Zones
+	}
+	addPTRs(logger, zoneList(zonesMap), *autoPTR)
+	fileViews := make(map[string]string, len(zonesMap))
+	var secondaries []*zone.TransferClient
 	for _, zi := range zonesMap {
-		store.SwapZone(zi)
+		s := stores[zi.View]
+		if s == nil {
+			logger.Error("load zones", "err", fmt.Errorf("%s: unknown view %q", zi.File, zi.View))
+			os.Exit(1)
+		}
+		key, err := transferKey(keys, zi)
+		if err != nil {
+			logger.Error("load zones", "err", fmt.Errorf("%s: %w", zi.File, err))
+			os.Exit(1)
+		}
+		fileViews[zoneFileKey(zi.File)] = zi.View
+		if zi.Primary != "" {
+			secondaries = append(secondaries, &zone.TransferClient{Zone: zi.ZoneFQDN, Primary: zi.Primary, View: zi.View, Store: s, Logger: logger, Key: key})
+			continue
+		}
+		if *strictZones {
+			if err := lintZone(logger, zi); err != nil {
+				logger.Error("load zones", "err", fmt.Errorf("%s: %w", zi.File, err))
+				os.Exit(1)
+			}
+		}
+		warnDuplicates(logger, zi)
+		s.SwapZone(zi)
 	}
 
-	rrcache, err := cache.NewRRCaches[*dns.Msg](*cacheSize)
+	var rrcache cache.Cache[*dns.Msg]
+	var persisted *cache.RRCaches[*dns.Msg]
+	lru, err := cache.NewRRCaches[*dns.Msg](*cacheSize, *negCacheSize)
 	if err != nil {
-		logger.Error("cache init", "err", err)
-		os.Exit(1)
+		// A bad cache size shouldn't take DNS down; run with a tiny cache.
+		logger.Warn("cache init failed, falling back to minimal cache", "cache_size", *cacheSize, "neg_cache_size", *negCacheSize, "fallback", cache.MinCapacity, "err", err)
+		if lru, err = cache.NewRRCaches[*dns.Msg](cache.MinCapacity, 0); err != nil {
+			logger.Error("cache init", "err", err)
+			os.Exit(1)
+		}
+	}
+	lru.SetStaleWindow(*serveStaleTTL)
+	go lru.Sweep(ctx, *cacheSweep)
+	rrcache = lru
+	metrics.RegisterCacheStats(lru.Stats)
+	if *cacheFile != "" {
+		persisted = lru
+		restoreCache(logger, lru, *cacheFile, zonesMap)
 	}
 
-	res := dnsserver.NewResolver(logger, store, rrcache)
-	if *enableResolver {
+	res = dnsserver.NewResolver(logger, store, rrcache)
+	res.Views = viewList
+	res.ChaosVersion = *chaosVersion
+	res.NSID = *nsid
+	if res.CookieSecret, err = loadCookieSecret(*cookieSecret); err != nil {
+		logger.Error("cookie-secret", "err", err)
+		os.Exit(1)
+	}
+	res.RequireCookie = *requireCookie
+	switch *anyPolicy {
+	case dnsserver.AnyMinimal, dnsserver.AnyHINFO, dnsserver.AnyFull:
+		res.AnyPolicy = *anyPolicy
+	default:
+		logger.Error("any-policy", "err", fmt.Errorf("unknown policy %q (want minimal, hinfo or full)", *anyPolicy))
+		os.Exit(1)
+	}
+	if *rpzZone != "" {
+		if res.RPZ, err = rpz.New(*rpzZone); err != nil {
+			logger.Error("load rpz zone", "err", err)
+			os.Exit(1)
+		}
+		logger.Info("rpz zone loaded", "zone", res.RPZ.Zone(), "triggers", res.RPZ.Len(), "skipped", res.RPZ.Skipped())
+	}
+	if len(blocklists) > 0 {
+		if *blockMode != dnsserver.BlockNXDomain && *blockMode != dnsserver.BlockZero {
+			logger.Error("blocklist-mode", "err", fmt.Errorf("unknown mode %q (want nxdomain or zero)", *blockMode))
+			os.Exit(1)
+		}
+		if res.Blocklist, err = blocklist.New(blocklists...); err != nil {
+			logger.Error("load blocklist", "err", err)
+			os.Exit(1)
+		}
+		res.BlockMode = *blockMode
+		logger.Info("blocklist loaded", "entries", res.Blocklist.Len())
+	}
+	res.Secondaries = secondaries
+	res.LogTCQueries = *logTCQueries
+	res.LogMalformed = *logMalformed
+	if *queryLog != "" {
+		if res.QueryLog, err = logx.NewQueryLog(*queryLog); err != nil {
+			logger.Error("query log", "err", err)
+			os.Exit(1)
+		}
+	}
+	res.DrainTTL = uint32(*drainTTL)
+	res.MinimalResponses = *minimalResponses
+	if *rotate && *deterministic {
+		logger.Error("deterministic", "err", errors.New("--deterministic and --rotate are mutually exclusive"))
+		os.Exit(1)
+	}
+	res.Rotate = *rotate
+	res.Deterministic = *deterministic
+	res.AdditionalProcessing = *additionalProcessing
+	res.TSIGKeys = keys
+	res.TCPKeepalive = *tcpIdleTimeout
+	if res.AllowTransfer, err = acl.Parse(*allowTransfer); err != nil {
+		logger.Error("allow-transfer", "err", err)
+		os.Exit(1)
+	}
+	if res.AllowUpdate, err = acl.Parse(*allowUpdate); err != nil {
+		logger.Error("allow-update", "err", err)
+		os.Exit(1)
+	}
+	res.PersistUpdates = *persistUpdates
+	if res.AllowRecursion, err = acl.Parse(*allowRecursion); err != nil {
+		logger.Error("allow-recursion", "err", err)
+		os.Exit(1)
+	}
+	if res.AllowQuery, err = acl.Parse(*allowQuery); err != nil {
+		logger.Error("allow-query", "err", err)
+		os.Exit(1)
+	}
+	res.MaxTransfers = *maxTransfers
+	res.TransferRate = *transferRate
+	res.RRL = ratelimit.New(*rrlRate, *rrlWindow)
+	if res.TypeLimits, err = parseTypeLimits(*maxBytesByType, *maxRecordsByType); err != nil {
+		logger.Error("type limits", "err", err)
+		os.Exit(1)
+	}
+	res.SpecialUse = *specialUse
+	if *dns64Prefix != "" {
+		if res.DNS64Prefix, err = dnsserver.ParseDNS64Prefix(*dns64Prefix); err != nil {
+			logger.Error("dns64-prefix", "err", err)
+			os.Exit(1)
+		}
+	}
+	for _, s := range splitList(*localOnly) {
+		res.LocalOnly = append(res.LocalOnly, strings.ToLower(dns.Fqdn(s)))
+	}
+	if *enableResolver || *forward != "" {
 		res.EnableResolver = true
 		res.RootServers = defaultRootServers()
+		if res.ForwardServers, err = parseServers(*forward); err != nil {
+			logger.Error("forward", "err", err)
+			os.Exit(1)
+		}
+		res.ServfailTTL = *servfailTTL
+		res.MaxNegativeTTL = *maxNegativeTTL
+		res.ValidateDNSSEC = *validateDNSSEC
+		res.Parallelism = *resolverParallelism
+		res.CaseRandomization = *caseRandom
+		res.UDPTimeout, res.TCPTimeout = *resolverUDPTimeout, *resolverTCPTimeout
+		res.Retries = *resolverRetries
+		res.Deadline = *resolverDeadline
+		switch *resolverFamily {
+		case dnsserver.FamilyBoth, dnsserver.FamilyV4, dnsserver.FamilyV6:
+			res.Family = *resolverFamily
+		default:
+			logger.Error("resolver-family", "err", fmt.Errorf("unknown family %q (want both, v4 or v6)", *resolverFamily))
+			os.Exit(1)
+		}
+		if *prefetch {
+			res.PrefetchHits = uint32(max(*prefetchHits, 1))
+		}
+		if *localRootZone != "" {
+			lr, err := dnsserver.LoadLocalRoot(*localRootZone)
+			if err != nil {
+				logger.Error("load local root zone", "err", err)
+				os.Exit(1)
+			}
+			res.LocalRoot = lr
+		}
+	}
+	for _, fz := range forwardZones {
+		domain, servers, _ := strings.Cut(fz, "=")
+		list, err := parseServers(servers)
+		if err != nil || strings.TrimSpace(domain) == "" || len(list) == 0 {
+			logger.Error("forward-zone", "err", fmt.Errorf("bad forward zone %q (want domain=host:port[,host:port])", fz))
+			os.Exit(1)
+		}
+		if res.ForwardZones == nil {
+			res.ForwardZones = make(map[string][]string)
+		}
+		res.ForwardZones[strings.ToLower(dns.Fqdn(strings.TrimSpace(domain)))] = list
+	}
+	var handler dns.Handler = res
+	if *echoMode {
+		logger.Warn("ECHO MODE: every query gets a canned A 192.0.2.1 answer; for load testing only, zones are not served")
+		handler = dnsserver.EchoHandler{}
+	}
+	srv := dnsserver.NewServer(logger, splitList(*listenUDP), splitList(*listenTCP), handler)
+	srv.ShutdownTimeout = *shutdownTimeout
+	// Fail readiness the moment shutdown starts, so load balancers stop
+	// sending queries while the in-flight ones finish.
+	srv.OnShutdown = func() {
+		ready.Store(false)
+		res.SetDraining(true)
+	}
+	srv.TCP = dnsserver.TCPTuning{Backlog: *tcpBacklog, MaxConns: *tcpMaxConns, MaxQueries: *tcpMaxQueries, IdleTimeout: *tcpIdleTimeout}
+	if len(keys) > 0 {
+		srv.TsigSecret = keys.Secrets()
+	}
+	if *listenTLS != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			logger.Error("load tls keypair", "err", err)
+			os.Exit(1)
+		}
+		srv.TLSAddr = *listenTLS
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
 	}
-	srv := dnsserver.NewServer(logger, *listenUDP, *listenTCP, res)
 	if err := srv.Start(ctx); err != nil {
 		logger.Error("server start", "err", err)
 		os.Exit(1)
 	}
+	if len(srv.AddrUDP()) == len(srv.UDPAddrs) && len(srv.AddrTCP()) == len(srv.TCPAddrs) {
+		ready.Store(true)
+	}
 
-	// HTTP: health and metrics
-	var reqCount atomic.Int64
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); _, _ = w.Write([]byte("ok")) })
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-		_, _ = fmt.Fprintf(w, "smartdns_requests_total %d\n", reqCount.Load())
-	})
-	go func() { _ = http.ListenAndServe(*healthAddr, nil) }()
+	drain := &drainer{logger: logger, res: res, grace: *drainGrace, stop: cancel}
+	drainSig := make(chan os.Signal, 1)
+	notifyDrain(drainSig)
+	go func() {
+		for range drainSig {
+			drain.Start("signal")
+		}
+	}()
+
+	// HTTP: metrics, served on the health listener too
+	http.Handle("/metrics", metrics.Handler())
+	// DNS over HTTPS (RFC 8484); put TLS in front of this listener
+	http.Handle("/dns-query", dnsserver.DoHHandler(srv))
 	if *metricsAddr != *healthAddr {
 		go func() { _ = http.ListenAndServe(*metricsAddr, nil) }()
 	}
+	reloader := &zoneReloader{logger: logger, stores: stores, fileViews: fileViews, tsigKeys: keys, cache: rrcache, autoPTR: *autoPTR, strict: *strictZones, failLog: newLogLimiter(time.Minute), secondaries: secondaries}
+	a := &admin{res: res, drain: drain, reloader: reloader, zonesDir: *zonesDir, token: *adminToken}
+	a.cache, _ = rrcache.(cachePeeker)
+	a.stats, _ = rrcache.(cacheStats)
+	// Zone reloads and dumps for automation, on the health listener
+	a.healthRoutes(http.DefaultServeMux)
+	if *adminAddr != "" {
+		adminMux := http.NewServeMux()
+		a.routes(adminMux)
+		go func() { _ = http.ListenAndServe(*adminAddr, adminMux) }()
+	}
 
-	// Watch zones dir
+	for _, tc := range secondaries {
+		tc.OnUpdate = func(name string) { rrcache.InvalidateZone(name) }
+		go tc.Run(ctx)
+	}
+
+	// Watch zones dir; SIGHUP reloads all of it
 	go func() {
-		_ = watch.WatchDir(ctx, *zonesDir, &zoneReloader{logger: logger, store: store, cache: rrcache})
+		_ = watch.WatchDir(ctx, *zonesDir, reloader)
 	}()
+	reloadSig := make(chan os.Signal, 1)
+	notifyReload(reloadSig)
+	go func() {
+		for range reloadSig {
+			_, _ = reloader.reloadAll(*zonesDir)
+		}
+	}()
+
+	if res.Blocklist != nil {
+		go func() {
+			err := watch.WatchFiles(ctx, res.Blocklist.Paths(), func() {
+				if err := res.Blocklist.Reload(); err != nil {
+					logger.Warn("blocklist reload failed, keeping previous list", "err", err)
+					return
+				}
+				logger.Info("blocklist reloaded", "entries", res.Blocklist.Len())
+			})
+			if err != nil {
+				logger.Warn("blocklist watch failed", "err", err)
+			}
+		}()
+	}
+	if res.RPZ != nil {
+		go func() {
+			err := watch.WatchFiles(ctx, []string{res.RPZ.Path()}, func() {
+				if err := res.RPZ.Reload(); err != nil {
+					logger.Warn("rpz zone reload failed, keeping previous policy", "err", err)
+					return
+				}
+				logger.Info("rpz zone reloaded", "zone", res.RPZ.Zone(), "triggers", res.RPZ.Len(), "skipped", res.RPZ.Skipped())
+			})
+			if err != nil {
+				logger.Warn("rpz zone watch failed", "err", err)
+			}
+		}()
+	}
 
-	logger.Info("smart-dns started", "udp", *listenUDP, "tcp", *listenTCP, "zones", strings.Join(mkKeys(zonesMap), ","))
+	logger.Info("smart-dns started", "udp", *listenUDP, "tcp", *listenTCP, "tls", *listenTLS, "zones", strings.Join(mkKeys(zonesMap), ","))
 	<-ctx.Done()
 	logger.Info("shutting down")
-	time.Sleep(200 * time.Millisecond)
+	srv.Wait()
+	if persisted != nil {
+		if n, err := persisted.SaveToFile(*cacheFile); err != nil {
+			logger.Warn("cache not saved", "path", *cacheFile, "err", err)
+		} else {
+			logger.Info("cache saved", "path", *cacheFile, "entries", n)
+		}
+	}
+}
+
+// loadCookieSecret decodes the --cookie-secret, or makes a random one.
+func loadCookieSecret(s string) ([]byte, error) {
+	if s == "" {
+		b := make([]byte, 16)
+		_, err := rand.Read(b)
+		return b, err
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 16 {
+		return nil, errors.New("want 32 hex digits")
+	}
+	return b, nil
+}
+
+// restoreCache loads the cache saved by the previous run. Answers from our
+// own zones are dropped again: the files may have changed in between.
+func restoreCache(l *slog.Logger, c *cache.RRCaches[*dns.Msg], path string, zones map[string]*zone.ZoneIndex) {
+	n, err := c.LoadFromFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		l.Warn("cache not restored", "path", path, "err", err)
+		return
+	}
+	for _, zi := range zones {
+		c.InvalidateZone(zi.ZoneFQDN)
+	}
+	l.Info("cache restored", "path", path, "entries", n)
 }
 
 type zoneReloader struct {
-	logger *slog.Logger
-	store  *zone.Store
-	cache  *cache.RRCaches[*dns.Msg]
+	logger  *slog.Logger
+	stores  map[string]*zone.Store // by view name; "" is the default
+	cache   cache.Cache[*dns.Msg]
+	autoPTR bool
+	strict  bool // --strict-zones
+	failLog *logLimiter
+	// tsigKeys resolves tsig_key names in reloaded zones.
+	tsigKeys tsig.Keys
+	// secondaries are the secondary zones running since startup.
+	secondaries []*zone.TransferClient
+
+	loadMu    sync.Mutex // serializes reloads from the watcher and SIGHUP
+	mu        sync.Mutex
+	fileViews map[string]string // zone file base name -> view, for removals
+	ptrMu     sync.Mutex        // serializes reverse zone rebuilds
 }
 
+// partialWriteRetry is how long a reload waits before reading a file that
+// failed to parse once more, in case it was caught mid-write.
+const partialWriteRetry = 250 * time.Millisecond
+
 func (z *zoneReloader) OnZoneUpdated(path string) {
-	zf, err := readZonePath(path)
+	zf, err := zone.ReadZoneFile(path)
 	if err != nil {
-		z.logger.Warn("zone parse", "path", path, "err", err)
-		return
+		time.Sleep(partialWriteRetry)
+		zf, err = zone.ReadZoneFile(path)
 	}
-	zi, err := zf.ToIndex()
 	if err != nil {
-		z.logger.Warn("zone index", "path", path, "err", err)
+		z.warnFailure("zone parse", path, err)
 		return
 	}
-	old, _ := z.store.GetZoneForName(zi.ZoneFQDN)
-	if old != nil && zi.Serial <= old.Serial {
+	z.loadMu.Lock()
+	defer z.loadMu.Unlock()
+	var zi *zone.ZoneIndex
+	if files := z.splitFiles(zf, path); len(files) > 1 {
+		zi, err = zone.LoadZoneFiles(files)
+	} else {
+		zi, err = zf.ToIndex()
+		if err == nil {
+			zi.File, zi.Files = path, []string{path}
+		}
+	}
+	if err != nil {
+		z.warnFailure("zone index", path, err)
 		return
 	}
-	z.store.SwapZone(zi)
+	if _, err := z.apply(zi); err != nil {
+		z.warnFailure("zone index", path, err)
+	}
+}
+
+// zoneChange is what apply did with a zone.
+type zoneChange int
+
+const (
+	zoneUnchanged zoneChange = iota
+	zoneAdded
+	zoneUpdated
+)
+
+func (c zoneChange) String() string {
+	switch c {
+	case zoneAdded:
+		return "added"
+	case zoneUpdated:
+		return "updated"
+	}
+	return "unchanged"
+}
+
+// apply swaps zi, read from zi.File, into its view's store if it is new
+// there, has a higher serial or comes from a different set of files (one of
+// a split zone's files added or removed), and invalidates the cache for it.
+func (z *zoneReloader) apply(zi *zone.ZoneIndex) (zoneChange, error) {
+	path := zi.File
+	if _, err := transferKey(z.tsigKeys, zi); err != nil {
+		return zoneUnchanged, err
+	}
+	if zi.Primary != "" {
+		if !z.runningSecondary(zi) {
+			z.logger.Warn("secondary zone settings changed; restart to apply", "zone", zi.ZoneFQDN, "path", path)
+		}
+		return zoneUnchanged, nil
+	}
+	store := z.stores[zi.View]
+	if store == nil {
+		return zoneUnchanged, fmt.Errorf("unknown view %q", zi.View)
+	}
+	z.failLog.reset(path)
+	z.mu.Lock()
+	prev, seen := z.fileViews[zoneFileKey(path)]
+	z.fileViews[zoneFileKey(path)] = zi.View
+	z.mu.Unlock()
+	if seen && prev != zi.View {
+		// the file moved to another view; drop it from the old one
+		z.stores[prev].RemoveZone(zi.ZoneFQDN)
+	}
+	old := store.Snapshot()[zi.ZoneFQDN]
+	if !replaces(zi, old) {
+		return zoneUnchanged, nil
+	}
+	if z.strict {
+		if err := lintZone(z.logger, zi); err != nil {
+			return zoneUnchanged, err
+		}
+	}
+	warnDuplicates(z.logger, zi)
+	if zi.IsReverse() {
+		addPTRsTo(z.logger, zi, zoneList(store.Snapshot()), z.autoPTR)
+	}
+	for !store.CompareAndSwapZone(old, zi) {
+		// A dynamic update got in first; weigh zi against it instead.
+		old = store.Snapshot()[zi.ZoneFQDN]
+		if !replaces(zi, old) {
+			return zoneUnchanged, nil
+		}
+	}
+	if old != nil && zi.Serial < old.Serial {
+		z.logger.Warn("zone serial went down with a file removed", "zone", zi.ZoneFQDN, "view", zi.View, "serial", zi.Serial, "old_serial", old.Serial)
+	}
 	z.cache.InvalidateZone(zi.ZoneFQDN)
-	z.logger.Info("zone reloaded", "zone", zi.ZoneFQDN, "serial", zi.Serial)
+	z.logger.Info("zone reloaded", "zone", zi.ZoneFQDN, "view", zi.View, "serial", zi.Serial)
+	if len(zi.AlsoNotify) > 0 {
+		go dnsserver.SendNotify(z.logger, zi.ZoneFQDN, zi.Serial, zi.AlsoNotify)
+	}
+	if zi.GeneratesPTR(z.autoPTR) || (old != nil && old.GeneratesPTR(z.autoPTR)) {
+		z.refreshPTRs(store)
+	}
+	if old == nil {
+		return zoneAdded, nil
+	}
+	return zoneUpdated, nil
+}
+
+// replaces reports whether zi should be served instead of old (nil when
+// not loaded): it has a higher serial or comes from a different set of
+// files.
+func replaces(zi, old *zone.ZoneIndex) bool {
+	return old == nil || zi.Serial > old.Serial || !slices.Equal(zi.Files, old.Files)
+}
+
+// runningSecondary reports whether zi is a secondary zone already running
+// with the same settings.
+func (z *zoneReloader) runningSecondary(zi *zone.ZoneIndex) bool {
+	for _, tc := range z.secondaries {
+		if tc.Zone == zi.ZoneFQDN && tc.View == zi.View && tc.Primary == zi.Primary {
+			return true
+		}
+	}
+	return false
+}
+
+// warnDuplicates reports records that ToIndex collapsed as duplicates, and
+// files of a split zone that disagree on its serial; the zone still loads,
+// but the files likely have a copy-paste mistake.
+func warnDuplicates(l *slog.Logger, zi *zone.ZoneIndex) {
+	if zi.Duplicates > 0 {
+		l.Warn("duplicate records dropped", "zone", zi.ZoneFQDN, "count", zi.Duplicates)
+	}
+	for _, c := range zi.Conflicts {
+		l.Warn("zone files disagree on serial", "zone", zi.ZoneFQDN, "conflict", c)
+	}
+}
+
+// lintZone logs each problem ZoneIndex.Lint finds in zi and fails if there
+// are any; it runs with --strict-zones, before a zone is served.
+func lintZone(l *slog.Logger, zi *zone.ZoneIndex) error {
+	problems := zi.Lint()
+	for _, p := range problems {
+		l.Warn("zone lint", "zone", zi.ZoneFQDN, "path", zi.File, "problem", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d lint problems (--strict-zones)", len(problems))
+	}
+	return nil
+}
+
+// warnFailure logs a zone load failure, suppressing repeats of the same error
+// for the same file while an editor keeps saving a broken zone.
+func (z *zoneReloader) warnFailure(msg, path string, err error) {
+	ok, suppressed := z.failLog.allow(path, msg+": "+err.Error())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		z.logger.Warn(msg, "path", path, "err", err, "suppressed", suppressed)
+		return
+	}
+	z.logger.Warn(msg, "path", path, "err", err)
 }
 
 func (z *zoneReloader) OnZoneRemoved(zoneName string) {
-	z.store.RemoveZone(zoneName + ".")
+	z.loadMu.Lock()
+	defer z.loadMu.Unlock()
+	if z.unsplit(zoneName) {
+		return
+	}
+	z.removeZone(zoneName)
+}
+
+func (z *zoneReloader) removeZone(zoneName string) {
+	z.mu.Lock()
+	view, known := z.fileViews[zoneName]
+	delete(z.fileViews, zoneName)
+	z.mu.Unlock()
+	old := z.stores[view].Snapshot()[strings.ToLower(zoneName)+"."]
+	if !known && old == nil {
+		return // already removed
+	}
+	if old != nil && zoneFileKey(old.File) != zoneName {
+		return // still served from the other files of a split zone
+	}
+	z.stores[view].RemoveZone(zoneName + ".")
+	if old != nil && old.GeneratesPTR(z.autoPTR) {
+		z.refreshPTRs(z.stores[view])
+	}
 	z.cache.InvalidateZone(zoneName + ".")
 	z.logger.Info("zone removed", "zone", zoneName)
 }
 
+// logLimiter lets the first occurrence of an error per key through, then at
+// most one repeat per window, counting what it swallowed in between.
+type logLimiter struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]*limitedErr
+}
+
+type limitedErr struct {
+	err        string
+	last       time.Time
+	suppressed int
+}
+
+func newLogLimiter(window time.Duration) *logLimiter {
+	return &logLimiter{window: window, seen: make(map[string]*limitedErr)}
+}
+
+// allow reports whether err for key should be logged now, and how many
+// identical occurrences were suppressed since it was last logged.
+func (l *logLimiter) allow(key, err string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	e := l.seen[key]
+	if e != nil && e.err == err && now.Sub(e.last) < l.window {
+		e.suppressed++
+		return false, 0
+	}
+	suppressed := 0
+	if e != nil && e.err == err {
+		suppressed = e.suppressed
+	}
+	l.seen[key] = &limitedErr{err: err, last: now}
+	return true, suppressed
+}
+
+// reset forgets key so its next failure is logged immediately.
+func (l *logLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.seen, key)
+}
+
 func mkKeys(m map[string]*zone.ZoneIndex) []string {
 	out := make([]string, 0, len(m))
 	for k := range m {
@@ -136,42 +788,141 @@ func mkKeys(m map[string]*zone.ZoneIndex) []string {
 	return out
 }
 
-func atoi(s string, def int) int {
-	if v, err := strconv.Atoi(s); err == nil {
-		return v
+// zoneFileKey is how the watcher names a zone file on removal: its base name
+// without extension, lowercased.
+func zoneFileKey(path string) string {
+	base := strings.ToLower(filepath.Base(path))
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// parseViews builds views from name=CIDR,CIDR;name2=CIDR, keeping their order.
+func parseViews(s string) ([]dnsserver.View, error) {
+	var out []dnsserver.View
+	seen := map[string]bool{}
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, cidrs, ok := strings.Cut(item, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" || seen[name] {
+			return nil, fmt.Errorf("bad view %q (want name=CIDR,CIDR)", item)
+		}
+		match, err := acl.Parse(cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", name, err)
+		}
+		seen[name] = true
+		out = append(out, dnsserver.View{Name: name, Match: match, Zones: zone.NewStore()})
 	}
-	return def
+	return out, nil
 }
 
-// small local helper to read JSON path without exporting loader internals here
-func readZonePath(path string) (*zone.ZoneFile, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
+// transferKey returns the TSIG key named by zi's tsig_key, if any.
+func transferKey(keys tsig.Keys, zi *zone.ZoneIndex) (*tsig.Key, error) {
+	if zi.TSIGKey == "" {
+		return nil, nil
+	}
+	k, ok := keys.Lookup(zi.TSIGKey)
+	if !ok {
+		return nil, fmt.Errorf("unknown tsig_key %q", zi.TSIGKey)
+	}
+	return &k, nil
+}
+
+// parseServers parses a comma-separated list of upstream servers, adding
+// port 53 to bare addresses.
+func parseServers(s string) ([]string, error) {
+	var out []string
+	for _, item := range splitList(s) {
+		if _, _, err := net.SplitHostPort(item); err != nil {
+			if net.ParseIP(item) == nil {
+				return nil, fmt.Errorf("bad server %q (want ip or host:port)", item)
+			}
+			item = net.JoinHostPort(item, "53")
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, " ") }
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// parseTypeLimits builds the per-qtype caps from TYPE=N lists.
+func parseTypeLimits(bytes, records string) (map[uint16]dnsserver.TypeLimit, error) {
+	limits := map[uint16]dnsserver.TypeLimit{}
+	set := func(list string, apply func(*dnsserver.TypeLimit, int)) error {
+		for _, item := range splitList(list) {
+			k, v, ok := strings.Cut(item, "=")
+			qt, known := dns.StringToType[strings.ToUpper(strings.TrimSpace(k))]
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if !ok || !known || err != nil || n < 0 {
+				return fmt.Errorf("bad limit %q (want TYPE=N)", item)
+			}
+			l := limits[qt]
+			apply(&l, n)
+			limits[qt] = l
+		}
+		return nil
+	}
+	if err := set(bytes, func(l *dnsserver.TypeLimit, n int) { l.MaxBytes = n }); err != nil {
 		return nil, err
 	}
-	var zf zone.ZoneFile
-	if err := json.Unmarshal(b, &zf); err != nil {
+	if err := set(records, func(l *dnsserver.TypeLimit, n int) { l.MaxRecords = n }); err != nil {
 		return nil, err
 	}
-	return &zf, nil
+	return limits, nil
+}
+
+func atoi(s string, def int) int {
+	if v, err := strconv.Atoi(s); err == nil {
+		return v
+	}
+	return def
+}
+
+// hostname is the default NSID; empty when the OS can't tell.
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
 }
 
 func defaultRootServers() []string {
-	// IANA root servers (A-M) IPv4 only for brevity; can be extended with IPv6.
+	// IANA root servers (A-M), IPv4 and IPv6; the resolver orders them by
+	// --resolver-family.
 	roots := []string{
-		"198.41.0.4:53",     // a.root-servers.net
-		"199.9.14.201:53",   // b.root-servers.net
-		"192.33.4.12:53",    // c.root-servers.net
-		"199.7.91.13:53",    // d.root-servers.net
-		"192.203.230.10:53", // e.root-servers.net
-		"192.5.5.241:53",    // f.root-servers.net
-		"192.112.36.4:53",   // g.root-servers.net
-		"198.97.190.53:53",  // h.root-servers.net
-		"192.36.148.17:53",  // i.root-servers.net
-		"192.58.128.30:53",  // j.root-servers.net
-		"193.0.14.129:53",   // k.root-servers.net
-		"199.7.83.42:53",    // l.root-servers.net
-		"202.12.27.33:53",   // m.root-servers.net
+		"198.41.0.4:53", "[2001:503:ba3e::2:30]:53", // a.root-servers.net
+		"199.9.14.201:53", "[2801:1b8:10::b]:53", // b.root-servers.net
+		"192.33.4.12:53", "[2001:500:2::c]:53", // c.root-servers.net
+		"199.7.91.13:53", "[2001:500:2d::d]:53", // d.root-servers.net
+		"192.203.230.10:53", "[2001:500:a8::e]:53", // e.root-servers.net
+		"192.5.5.241:53", "[2001:500:2f::f]:53", // f.root-servers.net
+		"192.112.36.4:53", "[2001:500:12::d0d]:53", // g.root-servers.net
+		"198.97.190.53:53", "[2001:500:1::53]:53", // h.root-servers.net
+		"192.36.148.17:53", "[2001:7fe::53]:53", // i.root-servers.net
+		"192.58.128.30:53", "[2001:503:c27::2:30]:53", // j.root-servers.net
+		"193.0.14.129:53", "[2001:7fd::1]:53", // k.root-servers.net
+		"199.7.83.42:53", "[2001:500:9f::42]:53", // l.root-servers.net
+		"202.12.27.33:53", "[2001:dc3::35]:53", // m.root-servers.net
 	}
 	return roots
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"smart-dns/internal/zone"
+)
+
+// reloadedZone reports one zone of a reload; Serial is the one now served.
+type reloadedZone struct {
+	Zone   string `json:"zone"`
+	View   string `json:"view,omitempty"`
+	Serial uint32 `json:"serial"`
+	Change string `json:"change"` // added, updated or unchanged
+	Error  string `json:"error,omitempty"`
+}
+
+type reloadSummary struct {
+	Zones   []reloadedZone `json:"zones"`
+	Removed []string       `json:"removed"`
+}
+
+// errZoneNotFound is a single-zone reload for a zone with no file.
+var errZoneNotFound = errors.New("no zone file for zone")
+
+// reloadAll re-reads the whole zone directory, as on SIGHUP: new zones and
+// ones with a higher serial are swapped in, zones whose file is gone are
+// removed. If any file fails to load, nothing changes.
+func (z *zoneReloader) reloadAll(dir string) (reloadSummary, error) {
+	sum := reloadSummary{Zones: []reloadedZone{}, Removed: []string{}}
+	zones, err := zone.LoadZonesDir(dir)
+	if err != nil {
+		z.logger.Warn("zone directory reload failed, keeping current zones", "err", err)
+		return sum, err
+	}
+	z.loadMu.Lock()
+	defer z.loadMu.Unlock()
+	var added, updated []string
+	files := make(map[string]bool, len(zones))
+	for _, zi := range zones {
+		files[zoneFileKey(zi.File)] = true
+		rz := z.applyReport(zi)
+		switch rz.Change {
+		case zoneAdded.String():
+			added = append(added, zi.ZoneFQDN)
+		case zoneUpdated.String():
+			updated = append(updated, zi.ZoneFQDN)
+		}
+		sum.Zones = append(sum.Zones, rz)
+	}
+	z.mu.Lock()
+	var gone []string
+	for key := range z.fileViews {
+		if !files[key] {
+			gone = append(gone, key)
+		}
+	}
+	z.mu.Unlock()
+	for _, key := range gone {
+		z.removeZone(key)
+		sum.Removed = append(sum.Removed, key+".")
+	}
+	z.logger.Info("zone directory reloaded", "zones", len(zones), "added", strings.Join(added, ","), "updated", strings.Join(updated, ","), "removed", strings.Join(sum.Removed, ","))
+	return sum, nil
+}
+
+// reloadZone re-reads the files of one zone (name with or without the
+// trailing dot): those currently serving it that still exist, or one named
+// after it in dir.
+func (z *zoneReloader) reloadZone(dir, name string) (reloadSummary, error) {
+	sum := reloadSummary{Zones: []reloadedZone{}, Removed: []string{}}
+	fqdn := strings.ToLower(zone.MustFQDN(name))
+	var groups [][]string // the files of the zone in each view
+	for _, s := range z.stores {
+		if zi := s.Snapshot()[fqdn]; zi != nil {
+			var files []string
+			for _, f := range zi.Files {
+				if _, err := os.Stat(f); err == nil {
+					files = append(files, f)
+				}
+			}
+			if len(files) > 0 {
+				groups = append(groups, files)
+			}
+		}
+	}
+	if len(groups) == 0 {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return sum, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && zone.IsZoneFile(e.Name()) && zoneFileKey(e.Name())+"." == fqdn {
+				groups = append(groups, []string{filepath.Join(dir, e.Name())})
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return sum, fmt.Errorf("%w %s", errZoneNotFound, fqdn)
+	}
+	z.loadMu.Lock()
+	defer z.loadMu.Unlock()
+	for _, files := range groups {
+		zi, err := zone.LoadZoneFiles(files)
+		if err != nil {
+			z.warnFailure("zone index", files[0], err)
+			return sum, err
+		}
+		sum.Zones = append(sum.Zones, z.applyReport(zi))
+	}
+	return sum, nil
+}
+
+// applyReport applies zi and reports the outcome.
+func (z *zoneReloader) applyReport(zi *zone.ZoneIndex) reloadedZone {
+	rz := reloadedZone{Zone: zi.ZoneFQDN, View: zi.View}
+	change, err := z.apply(zi)
+	rz.Change = change.String()
+	if err != nil {
+		z.warnFailure("zone index", zi.File, err)
+		rz.Error = err.Error()
+	}
+	rz.Serial = zi.Serial
+	if s := z.stores[zi.View]; s != nil {
+		if cur := s.Snapshot()[zi.ZoneFQDN]; cur != nil {
+			rz.Serial = cur.Serial
+		}
+	}
+	return rz
+}
+
+// splitFiles returns the files to index for a change to path, which holds
+// zf: path and the other files of the zone it declares, when that zone is
+// already served from a different file, sorted as LoadZonesDir merges them.
+func (z *zoneReloader) splitFiles(zf *zone.ZoneFile, path string) []string {
+	files := []string{path}
+	s := z.stores[strings.ToLower(zf.View)]
+	if s == nil {
+		return files
+	}
+	cur := s.Snapshot()[strings.ToLower(zone.MustFQDN(zf.Zone))]
+	if cur == nil {
+		return files
+	}
+	for _, f := range cur.Files {
+		if f == path {
+			continue
+		}
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// unsplit re-reads a split zone without its file named key (see
+// zoneFileKey), which was removed, and reports whether there was one. The
+// rest of the zone is served at once, whatever its serial.
+func (z *zoneReloader) unsplit(key string) bool {
+	for _, s := range z.stores {
+		for _, zi := range s.Snapshot() {
+			var rest []string
+			for _, f := range zi.Files {
+				if zoneFileKey(f) != key {
+					rest = append(rest, f)
+				}
+			}
+			if len(zi.Files) < 2 || len(rest) == len(zi.Files) {
+				continue
+			}
+			nz, err := zone.LoadZoneFiles(rest)
+			if err != nil {
+				z.warnFailure("zone index", rest[0], err)
+				return true
+			}
+			change, err := z.apply(nz)
+			if err != nil {
+				z.warnFailure("zone index", nz.File, err)
+			}
+			if change != zoneUnchanged && zoneFileKey(zi.File) == key {
+				z.mu.Lock()
+				delete(z.fileViews, key)
+				z.mu.Unlock()
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"smart-dns/internal/cache"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// writeSplitFile writes one file of example.com., split across several,
+// with an A record for each of hosts.
+func writeSplitFile(t *testing.T, path string, serial uint32, hosts ...string) {
+	t.Helper()
+	recs := ""
+	for i, h := range hosts {
+		if i > 0 {
+			recs += ","
+		}
+		recs += fmt.Sprintf(`{"name": %q, "type": "A", "values": ["192.0.2.%d"]}`, h, i+1)
+	}
+	src := fmt.Sprintf(`{"zone": "example.com.", "serial": %d, "ttl_default": 300,
+  "soa": {"mname": "ns1.example.com.", "rname": "hostmaster.example.com."},
+  "ns": ["ns1.example.com."],
+  "records": [%s]}`, serial, recs)
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestReloader(t *testing.T) (*zoneReloader, *zone.Store) {
+	t.Helper()
+	c, err := cache.NewRRCaches[*dns.Msg](100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := zone.NewStore()
+	return &zoneReloader{
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		stores:    map[string]*zone.Store{"": store},
+		cache:     c,
+		failLog:   newLogLimiter(time.Minute),
+		fileViews: map[string]string{},
+	}, store
+}
+
+func TestSplitZoneReload(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "example.com.dns")
+	b := filepath.Join(dir, "example.com.team.dns")
+	writeSplitFile(t, a, 7, "www")
+	writeSplitFile(t, b, 5, "api")
+	z, store := newTestReloader(t)
+	if _, err := z.reloadAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(step string, serial uint32, have, lack []string) {
+		t.Helper()
+		zi := store.Snapshot()["example.com."]
+		if zi == nil {
+			t.Fatalf("%s: example.com. not served", step)
+		}
+		if zi.Serial != serial {
+			t.Errorf("%s: serial %d, want %d", step, zi.Serial, serial)
+		}
+		for _, h := range have {
+			if zi.ByName[h+".example.com."] == nil {
+				t.Errorf("%s: %s missing", step, h)
+			}
+		}
+		for _, h := range lack {
+			if zi.ByName[h+".example.com."] != nil {
+				t.Errorf("%s: %s still served", step, h)
+			}
+		}
+	}
+	check("startup", 7, []string{"www", "api"}, nil)
+
+	// The first file, not the last, changes: its serial must still count.
+	writeSplitFile(t, a, 8, "www", "mail")
+	z.OnZoneUpdated(a)
+	check("first file edited", 8, []string{"www", "mail", "api"}, nil)
+
+	writeSplitFile(t, b, 9, "api", "api2")
+	z.OnZoneUpdated(b)
+	check("last file edited", 9, []string{"www", "mail", "api", "api2"}, nil)
+
+	// An edit without a serial bump waits for one.
+	writeSplitFile(t, a, 8, "www")
+	z.OnZoneUpdated(a)
+	check("no serial bump", 9, []string{"mail"}, nil)
+
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	z.OnZoneRemoved(zoneFileKey(a))
+	check("first file removed", 9, []string{"api", "api2"}, []string{"www", "mail"})
+}
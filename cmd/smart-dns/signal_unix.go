@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDrain delivers SIGUSR1, which puts the node into drain mode.
+func notifyDrain(c chan<- os.Signal) { signal.Notify(c, syscall.SIGUSR1) }
+
+// notifyReload delivers SIGHUP, which reloads the zone directory.
+func notifyReload(c chan<- os.Signal) { signal.Notify(c, syscall.SIGHUP) }
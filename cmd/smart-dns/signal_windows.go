@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyDrain is a no-op on Windows (no SIGUSR1); use the admin API instead.
+func notifyDrain(c chan<- os.Signal) {}
+
+// notifyReload is a no-op on Windows (no SIGHUP); the zone directory is
+// still watched for changes.
+func notifyReload(c chan<- os.Signal) {}
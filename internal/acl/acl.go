@@ -0,0 +1,49 @@
+// Package acl matches client addresses against CIDR allow-lists.
+package acl
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// List is a set of prefixes. What an empty List means (allow or deny
+// everyone) is up to the caller.
+type List []netip.Prefix
+
+// Parse parses a comma-separated list of CIDRs, accepting bare IPs as
+// single-host prefixes.
+func Parse(s string) (List, error) {
+	var out List
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			a, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			a = a.Unmap()
+			out = append(out, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// Contains reports whether addr falls inside any prefix of l.
+func (l List) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range l {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
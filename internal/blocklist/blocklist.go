@@ -0,0 +1,128 @@
+// Package blocklist matches query names against domain blocklists in
+// hosts format ("0.0.0.0 ads.example.com") or as plain domain lists.
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// List is a set of blocked domains loaded from files. It is safe for
+// concurrent use; Reload swaps in the files' current contents.
+type List struct {
+	paths []string
+	rules atomic.Pointer[rules]
+}
+
+// rules holds lowercase FQDNs. A name in domains is blocked along with
+// everything below it; one in wildcards ("*.example.com" in a file) only
+// below it.
+type rules struct {
+	domains   map[string]struct{}
+	wildcards map[string]struct{}
+}
+
+// hostsNames are the entries of a stock hosts file that map the machine
+// itself; blocklists in hosts format usually start with them.
+var hostsNames = map[string]bool{
+	"localhost.": true, "localhost.localdomain.": true, "local.": true, "broadcasthost.": true,
+	"ip6-localhost.": true, "ip6-loopback.": true, "ip6-localnet.": true, "ip6-mcastprefix.": true,
+	"ip6-allnodes.": true, "ip6-allrouters.": true, "ip6-allhosts.": true,
+}
+
+// New loads the files at paths.
+func New(paths ...string) (*List, error) {
+	l := &List{paths: paths}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Paths returns the files the list is loaded from.
+func (l *List) Paths() []string { return l.paths }
+
+// Reload re-reads the files. On error the previous contents stay in use.
+func (l *List) Reload() error {
+	rs := &rules{domains: make(map[string]struct{}), wildcards: make(map[string]struct{})}
+	for _, p := range l.paths {
+		if err := rs.load(p); err != nil {
+			return err
+		}
+	}
+	l.rules.Store(rs)
+	return nil
+}
+
+// Len returns the number of entries loaded.
+func (l *List) Len() int {
+	rs := l.rules.Load()
+	return len(rs.domains) + len(rs.wildcards)
+}
+
+// Blocked reports whether name is listed, or is below a listed domain.
+func (l *List) Blocked(name string) bool {
+	rs := l.rules.Load()
+	name = dns.CanonicalName(name)
+	if _, ok := rs.domains[name]; ok {
+		return true
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := rs.domains[name[off:]]; ok {
+			return true
+		}
+		if _, ok := rs.wildcards[name[off:]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *rules) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// hosts format: an address followed by one or more names
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			if err := rs.add(name); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		}
+	}
+	return sc.Err()
+}
+
+func (rs *rules) add(name string) error {
+	wild := strings.HasPrefix(name, "*.")
+	name = dns.CanonicalName(strings.TrimPrefix(name, "*."))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return fmt.Errorf("bad domain %q", name)
+	}
+	if hostsNames[name] {
+		return nil
+	}
+	if wild {
+		rs.wildcards[name] = struct{}{}
+	} else {
+		rs.domains[name] = struct{}{}
+	}
+	return nil
+}
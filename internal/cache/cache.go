@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"net"
+	"time"
+)
+
+// Cache is what the DNS handler needs from a response cache: positive
+// entries holding data, negative entries keyed by rcode, and zone-scoped
+// invalidation. RRCaches is the LRU implementation.
+type Cache[T any] interface {
+	GetPositive(name string, qtype uint16) (T, bool)
+	PutPositive(name string, qtype uint16, data T, ttl time.Duration)
+	// The ECS variants key entries by the client's EDNS0 subnet as well.
+	GetPositiveECS(name string, qtype uint16, subnet *net.IPNet) (T, bool)
+	PutPositiveECS(name string, qtype uint16, subnet *net.IPNet, data T, ttl time.Duration)
+	// GetStale returns an expired positive entry still inside the
+	// serve-stale window (RFC 8767).
+	GetStale(name string, qtype uint16) (T, bool)
+	// PrefetchDue reports a popular entry close to expiry.
+	PrefetchDue(name string, qtype uint16, minHits uint32) bool
+	GetNegative(name string, qtype uint16, rcode int) bool
+	PutNegative(name string, qtype uint16, rcode int, ttl time.Duration)
+	// The Data variants keep data with a negative entry, such as the
+	// denial to answer with.
+	GetNegativeData(name string, qtype uint16, rcode int) (T, bool)
+	PutNegativeData(name string, qtype uint16, rcode int, data T, ttl time.Duration)
+	InvalidateZone(zone string)
+	// ForView returns the cache for a split-horizon view; "" is the
+	// default view.
+	ForView(view string) Cache[T]
+}
+
+var _ Cache[struct{}] = (*RRCaches[struct{}])(nil)
+
+// NoOpCache stores nothing; every lookup misses.
+type NoOpCache[T any] struct{}
+
+func (NoOpCache[T]) GetPositive(string, uint16) (T, bool) {
+	var zero T
+	return zero, false
+}
+
+func (NoOpCache[T]) GetPositiveECS(string, uint16, *net.IPNet) (T, bool) {
+	var zero T
+	return zero, false
+}
+
+func (NoOpCache[T]) GetStale(string, uint16) (T, bool) {
+	var zero T
+	return zero, false
+}
+
+func (NoOpCache[T]) GetNegativeData(string, uint16, int) (T, bool) {
+	var zero T
+	return zero, false
+}
+
+func (NoOpCache[T]) PrefetchDue(string, uint16, uint32) bool { return false }
+
+func (NoOpCache[T]) PutPositive(string, uint16, T, time.Duration)                {}
+func (NoOpCache[T]) PutPositiveECS(string, uint16, *net.IPNet, T, time.Duration) {}
+func (NoOpCache[T]) GetNegative(string, uint16, int) bool                        { return false }
+func (NoOpCache[T]) PutNegative(string, uint16, int, time.Duration)              {}
+func (NoOpCache[T]) PutNegativeData(string, uint16, int, T, time.Duration)       {}
+func (NoOpCache[T]) InvalidateZone(string)                                       {}
+func (c NoOpCache[T]) ForView(string) Cache[T]                                   { return c }
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// savedCache is the on-disk form of the positive cache: its live entries,
+// least recently used first, with TTLs as they were at SavedAt.
+type savedCache struct {
+	SavedAt time.Time
+	Entries []savedEntry
+}
+
+type savedEntry struct {
+	View   string
+	Name   string
+	Type   uint16
+	Subnet string
+	Scope  uint8
+	TTL    time.Duration // remaining at SavedAt
+	Data   []byte        // packed value
+}
+
+// packer and unpacker are what values must implement to be saved and
+// restored; *dns.Msg does.
+type packer interface{ Pack() ([]byte, error) }
+type unpacker interface{ Unpack([]byte) error }
+
+// SaveToFile writes the live positive entries of every view to path, so a
+// restart can start warm. Negative entries aren't saved. The file is
+// replaced atomically. It returns the number of entries written.
+func (c *RRCaches[T]) SaveToFile(path string) (int, error) {
+	now := time.Now()
+	saved := savedCache{SavedAt: now}
+	c.posMu.Lock()
+	for _, k := range c.pos.Keys() {
+		v, ok := c.pos.Peek(k)
+		if !ok || !now.Before(v.ExpireAt) {
+			continue
+		}
+		p, ok := any(v.Data).(packer)
+		if !ok {
+			c.posMu.Unlock()
+			return 0, fmt.Errorf("cache: %T can't be saved", v.Data)
+		}
+		b, err := p.Pack()
+		if err != nil {
+			continue
+		}
+		saved.Entries = append(saved.Entries, savedEntry{View: k.View, Name: k.Name, Type: k.Type, Subnet: k.Subnet, Scope: v.Scope, TTL: v.ExpireAt.Sub(now), Data: b})
+	}
+	c.posMu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(&saved); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return len(saved.Entries), os.Rename(tmp.Name(), path)
+}
+
+// LoadFromFile restores entries written by SaveToFile, with the time since
+// they were saved taken off their TTLs; entries that have expired since are
+// skipped. T must be a pointer to a type with Unpack, like *dns.Msg. It
+// returns the number of entries restored.
+func (c *RRCaches[T]) LoadFromFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var saved savedCache
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	var zero T
+	rt := reflect.TypeOf(zero)
+	if rt == nil || rt.Kind() != reflect.Pointer {
+		return 0, errors.New("cache: values can't be restored")
+	}
+	elapsed := time.Since(saved.SavedAt)
+	now := time.Now()
+	n := 0
+	c.posMu.Lock()
+	defer c.posMu.Unlock()
+	for _, e := range saved.Entries {
+		left := e.TTL - elapsed
+		if left <= 0 {
+			continue
+		}
+		v := reflect.New(rt.Elem()).Interface()
+		u, ok := v.(unpacker)
+		if !ok {
+			return n, fmt.Errorf("cache: %T can't be restored", v)
+		}
+		if err := u.Unpack(e.Data); err != nil {
+			continue
+		}
+		k := rrKey{View: e.View, Name: e.Name, Type: e.Type, Subnet: e.Subnet}
+		c.pos.Add(k, rrValue[T]{ExpireAt: now.Add(left), Data: v.(T), Scope: e.Scope, TTL: e.TTL})
+		n++
+	}
+	return n, nil
+}
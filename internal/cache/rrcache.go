@@ -1,19 +1,25 @@
 package cache
 
 import (
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 )
 
 type rrKey struct {
+	View string
 	Name string
 	Type uint16
+	// Subnet is the normalized EDNS client subnet ("" without ECS).
+	Subnet string
 }
 
 type negKey struct {
+	View  string
 	Name  string
 	Type  uint16
 	Rcode int
@@ -22,84 +28,285 @@ type negKey struct {
 type rrValue[T any] struct {
 	ExpireAt time.Time
 	Data     T
+	Scope    uint8 // ECS prefix length the entry was stored for
+	TTL      time.Duration
+	Hits     uint32 // positive cache: served count, for prefetch
 }
 
+// RRCaches is a positive and a negative LRU. Views (ForView) share the LRUs
+// but tag their keys, so split-horizon answers never cross views.
 type RRCaches[T any] struct {
+	*lrus[T]
+	view string
+}
+
+type lrus[T any] struct {
 	posMu sync.Mutex
 	negMu sync.Mutex
 	pos   *lru.Cache[rrKey, rrValue[T]]
-	neg   *lru.Cache[negKey, rrValue[struct{}]]
+	neg   *lru.Cache[negKey, rrValue[T]]
+
+	// stale keeps expired positive entries around this long for GetStale
+	// (RFC 8767 serve-stale); 0 disables.
+	stale time.Duration
+
+	posHits, negHits, misses, evictions, expired atomic.Uint64
+}
+
+// Stats are the cache counters since startup, across all views, and the
+// current number of entries.
+type Stats struct {
+	// PositiveHits and NegativeHits count lookups answered from the cache;
+	// Misses counts positive lookups that found nothing live (a negative
+	// lookup only ever follows one of those).
+	PositiveHits uint64 `json:"positive_hits"`
+	NegativeHits uint64 `json:"negative_hits"`
+	Misses       uint64 `json:"misses"`
+	// Evictions counts entries pushed out by the LRU size limit, Expired
+	// entries dropped when found past their TTL.
+	Evictions       uint64 `json:"evictions"`
+	Expired         uint64 `json:"expired"`
+	PositiveEntries int    `json:"positive_entries"`
+	NegativeEntries int    `json:"negative_entries"`
+}
+
+// Stats returns the current counters.
+func (c *RRCaches[T]) Stats() Stats {
+	return Stats{
+		PositiveHits:    c.posHits.Load(),
+		NegativeHits:    c.negHits.Load(),
+		Misses:          c.misses.Load(),
+		Evictions:       c.evictions.Load(),
+		Expired:         c.expired.Load(),
+		PositiveEntries: c.pos.Len(),
+		NegativeEntries: c.neg.Len(),
+	}
 }
 
-func NewRRCaches[T any](capacity int) (*RRCaches[T], error) {
+// MinCapacity is the smallest capacity NewRRCaches accepts (the negative
+// cache gets a tenth of it).
+const MinCapacity = 10
+
+// NewRRCaches returns caches of capacity positive and negCapacity negative
+// entries; negCapacity 0 means a tenth of capacity.
+func NewRRCaches[T any](capacity, negCapacity int) (*RRCaches[T], error) {
 	pos, err := lru.New[rrKey, rrValue[T]](capacity)
 	if err != nil {
 		return nil, err
 	}
-	neg, err := lru.New[negKey, rrValue[struct{}]](capacity / 10)
+	if negCapacity == 0 {
+		negCapacity = capacity / 10
+	}
+	neg, err := lru.New[negKey, rrValue[T]](negCapacity)
 	if err != nil {
 		return nil, err
 	}
-	return &RRCaches[T]{pos: pos, neg: neg}, nil
+	return &RRCaches[T]{lrus: &lrus[T]{pos: pos, neg: neg}}, nil
+}
+
+// ForView returns the cache as seen from a split-horizon view ("" is the
+// default view, c itself).
+func (c *RRCaches[T]) ForView(view string) Cache[T] {
+	if view == c.view {
+		return c
+	}
+	return &RRCaches[T]{lrus: c.lrus, view: view}
+}
+
+// SetStaleWindow sets how long past expiry positive entries stay available
+// to GetStale.
+func (c *RRCaches[T]) SetStaleWindow(d time.Duration) {
+	c.posMu.Lock()
+	c.stale = d
+	c.posMu.Unlock()
 }
 
 func (c *RRCaches[T]) key(name string, qtype uint16) rrKey {
-	return rrKey{Name: strings.ToLower(name), Type: qtype}
+	return rrKey{View: c.view, Name: strings.ToLower(name), Type: qtype}
+}
+
+func (c *RRCaches[T]) negKey(name string, qtype uint16, rcode int) negKey {
+	return negKey{View: c.view, Name: strings.ToLower(name), Type: qtype, Rcode: rcode}
+}
+
+// ecsKey normalizes an ECS subnet to its masked prefix and length.
+func ecsKey(subnet *net.IPNet) (string, uint8) {
+	if subnet == nil {
+		return "", 0
+	}
+	ones, _ := subnet.Mask.Size()
+	return (&net.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask}).String(), uint8(ones)
 }
 
 func (c *RRCaches[T]) GetPositive(name string, qtype uint16) (T, bool) {
+	return c.GetPositiveECS(name, qtype, nil)
+}
+
+// GetPositiveECS is GetPositive for an answer scoped to a client subnet
+// (nil: no ECS, same as GetPositive).
+func (c *RRCaches[T]) GetPositiveECS(name string, qtype uint16, subnet *net.IPNet) (T, bool) {
 	var zero T
+	k := c.key(name, qtype)
+	var scope uint8
+	k.Subnet, scope = ecsKey(subnet)
 	c.posMu.Lock()
 	defer c.posMu.Unlock()
-	if v, ok := c.pos.Get(c.key(name, qtype)); ok {
-		if time.Now().Before(v.ExpireAt) {
+	if v, ok := c.pos.Get(k); ok {
+		now := time.Now()
+		if now.Before(v.ExpireAt) && v.Scope == scope {
+			v.Hits++
+			c.pos.Add(k, v)
+			c.posHits.Add(1)
 			return v.Data, true
 		}
-		c.pos.Remove(c.key(name, qtype))
+		if v.Scope != scope || !now.Before(v.ExpireAt.Add(c.stale)) {
+			c.pos.Remove(k)
+			if v.Scope == scope {
+				c.expired.Add(1)
+			}
+		}
 	}
+	c.misses.Add(1)
 	return zero, false
 }
 
+// GetStale returns a positive entry that has expired less than the stale
+// window ago, for answering when fresh data can't be had.
+func (c *RRCaches[T]) GetStale(name string, qtype uint16) (T, bool) {
+	var zero T
+	k := c.key(name, qtype)
+	c.posMu.Lock()
+	defer c.posMu.Unlock()
+	if v, ok := c.pos.Peek(k); ok && c.stale > 0 {
+		if now := time.Now(); !now.Before(v.ExpireAt) && now.Before(v.ExpireAt.Add(c.stale)) {
+			return v.Data, true
+		}
+	}
+	return zero, false
+}
+
+// PeekPositive returns a live positive entry and its remaining TTL without
+// promoting it in the LRU or evicting it when expired (for inspection).
+func (c *RRCaches[T]) PeekPositive(name string, qtype uint16) (T, time.Duration, bool) {
+	var zero T
+	c.posMu.Lock()
+	defer c.posMu.Unlock()
+	if v, ok := c.pos.Peek(c.key(name, qtype)); ok {
+		if left := time.Until(v.ExpireAt); left > 0 {
+			return v.Data, left, true
+		}
+	}
+	return zero, 0, false
+}
+
 func (c *RRCaches[T]) PutPositive(name string, qtype uint16, data T, ttl time.Duration) {
+	c.PutPositiveECS(name, qtype, nil, data, ttl)
+}
+
+// PutPositiveECS stores an answer for clients in subnet (nil: no ECS). A
+// TTL of 0 means do not cache: nothing is stored.
+func (c *RRCaches[T]) PutPositiveECS(name string, qtype uint16, subnet *net.IPNet, data T, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	k := c.key(name, qtype)
+	var scope uint8
+	k.Subnet, scope = ecsKey(subnet)
 	c.posMu.Lock()
 	defer c.posMu.Unlock()
-	c.pos.Add(c.key(name, qtype), rrValue[T]{ExpireAt: time.Now().Add(ttl), Data: data})
+	if c.pos.Add(k, rrValue[T]{ExpireAt: time.Now().Add(ttl), Data: data, Scope: scope, TTL: ttl}) {
+		c.evictions.Add(1)
+	}
+}
+
+// PrefetchDue reports whether the (non-ECS) positive entry is popular, at
+// least minHits hits, and in the last tenth of its TTL, so refreshing it now
+// spares clients the miss at expiry.
+func (c *RRCaches[T]) PrefetchDue(name string, qtype uint16, minHits uint32) bool {
+	c.posMu.Lock()
+	defer c.posMu.Unlock()
+	v, ok := c.pos.Peek(c.key(name, qtype))
+	if !ok || v.Hits < minHits {
+		return false
+	}
+	left := time.Until(v.ExpireAt)
+	return left > 0 && left < v.TTL/10
 }
 
 func (c *RRCaches[T]) GetNegative(name string, qtype uint16, rcode int) bool {
+	_, ok := c.GetNegativeData(name, qtype, rcode)
+	return ok
+}
+
+// GetNegativeData returns the data stored with a live negative entry (the
+// zero T for entries put without any).
+func (c *RRCaches[T]) GetNegativeData(name string, qtype uint16, rcode int) (T, bool) {
 	c.negMu.Lock()
 	defer c.negMu.Unlock()
-	k := negKey{Name: strings.ToLower(name), Type: qtype, Rcode: rcode}
+	k := c.negKey(name, qtype, rcode)
 	if v, ok := c.neg.Get(k); ok {
 		if time.Now().Before(v.ExpireAt) {
-			return true
+			c.negHits.Add(1)
+			return v.Data, true
 		}
 		c.neg.Remove(k)
+		c.expired.Add(1)
 	}
-	return false
+	var zero T
+	return zero, false
+}
+
+// PeekNegative is the negative-cache counterpart of PeekPositive.
+func (c *RRCaches[T]) PeekNegative(name string, qtype uint16, rcode int) (time.Duration, bool) {
+	c.negMu.Lock()
+	defer c.negMu.Unlock()
+	if v, ok := c.neg.Peek(c.negKey(name, qtype, rcode)); ok {
+		if left := time.Until(v.ExpireAt); left > 0 {
+			return left, true
+		}
+	}
+	return 0, false
 }
 
 func (c *RRCaches[T]) PutNegative(name string, qtype uint16, rcode int, ttl time.Duration) {
+	var zero T
+	c.PutNegativeData(name, qtype, rcode, zero, ttl)
+}
+
+// PutNegativeData is PutNegative keeping data, e.g. the denial with its SOA,
+// to answer later lookups from.
+func (c *RRCaches[T]) PutNegativeData(name string, qtype uint16, rcode int, data T, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
 	c.negMu.Lock()
 	defer c.negMu.Unlock()
-	c.neg.Add(negKey{Name: strings.ToLower(name), Type: qtype, Rcode: rcode}, rrValue[struct{}]{ExpireAt: time.Now().Add(ttl)})
+	if c.neg.Add(c.negKey(name, qtype, rcode), rrValue[T]{ExpireAt: time.Now().Add(ttl), Data: data, TTL: ttl}) {
+		c.evictions.Add(1)
+	}
 }
 
-// Invalidate all entries for a zone suffix.
+// Invalidate all entries for names in a zone (the apex and below), in every view.
 func (c *RRCaches[T]) InvalidateZone(zone string) {
 	zone = strings.ToLower(zone)
 	c.posMu.Lock()
 	for _, k := range c.pos.Keys() {
-		if strings.HasSuffix(k.Name, zone) {
+		if inZone(k.Name, zone) {
 			c.pos.Remove(k)
 		}
 	}
 	c.posMu.Unlock()
 	c.negMu.Lock()
 	for _, k := range c.neg.Keys() {
-		if strings.HasSuffix(k.Name, zone) {
+		if inZone(k.Name, zone) {
 			c.neg.Remove(k)
 		}
 	}
 	c.negMu.Unlock()
 }
+
+// inZone reports whether name is zone or below it, on a label boundary:
+// example.com. holds www.example.com. but not badexample.com.
+func inZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, capacity, negCapacity int) *RRCaches[string] {
+	t.Helper()
+	c, err := NewRRCaches[string](capacity, negCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestInvalidateZone(t *testing.T) {
+	const A, NXDOMAIN = 1, 3
+	tests := []struct {
+		zone    string
+		gone    []string
+		survive []string
+	}{
+		{
+			zone:    "example.com.",
+			gone:    []string{"example.com.", "www.example.com.", "a.b.example.com."},
+			survive: []string{"badexample.com.", "www.badexample.com.", "evil-example.com.", "com."},
+		},
+		{
+			zone:    "Example.COM.",
+			gone:    []string{"www.example.com."},
+			survive: []string{"badexample.com."},
+		},
+		{
+			zone: ".",
+			gone: []string{"example.com.", "badexample.com.", "com.", "."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.zone, func(t *testing.T) {
+			c := newTestCache(t, 100, 0)
+			inView := c.ForView("internal")
+			for _, name := range append(append([]string(nil), tt.gone...), tt.survive...) {
+				c.PutPositive(name, A, name, time.Minute)
+				c.PutNegative(name, A, NXDOMAIN, time.Minute)
+				inView.PutPositive(name, A, name, time.Minute)
+			}
+			c.InvalidateZone(tt.zone)
+			for _, name := range tt.gone {
+				if _, ok := c.GetPositive(name, A); ok {
+					t.Errorf("%s still cached", name)
+				}
+				if c.GetNegative(name, A, NXDOMAIN) {
+					t.Errorf("%s still negatively cached", name)
+				}
+				if _, ok := inView.GetPositive(name, A); ok {
+					t.Errorf("%s still cached in view internal", name)
+				}
+			}
+			for _, name := range tt.survive {
+				if _, ok := c.GetPositive(name, A); !ok {
+					t.Errorf("%s invalidated along with %s", name, tt.zone)
+				}
+				if !c.GetNegative(name, A, NXDOMAIN) {
+					t.Errorf("%s negative entry invalidated along with %s", name, tt.zone)
+				}
+			}
+		})
+	}
+}
+
+func TestNegativeCapacity(t *testing.T) {
+	const A, NXDOMAIN = 1, 3
+	tests := []struct {
+		name                  string
+		capacity, negCapacity int
+		wantNeg               int
+	}{
+		{"own size", 100, 50, 50},
+		{"larger than positive", 10, 200, 200},
+		{"default tenth", 100, 0, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, tt.capacity, tt.negCapacity)
+			for i := 0; i < 2*tt.wantNeg; i++ {
+				c.PutNegative(fmt.Sprintf("n%d.example.", i), A, NXDOMAIN, time.Minute)
+			}
+			st := c.Stats()
+			if st.NegativeEntries != tt.wantNeg {
+				t.Errorf("%d negative entries, want %d", st.NegativeEntries, tt.wantNeg)
+			}
+			if st.Evictions != uint64(tt.wantNeg) {
+				t.Errorf("%d evictions, want %d", st.Evictions, tt.wantNeg)
+			}
+			if st.PositiveEntries != 0 {
+				t.Errorf("negative entries landed in the positive cache: %d", st.PositiveEntries)
+			}
+		})
+	}
+	if _, err := NewRRCaches[string](100, -1); err == nil {
+		t.Error("negative capacity -1 accepted")
+	}
+}
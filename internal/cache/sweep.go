@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Sweep removes expired entries every interval until ctx is done, so they
+// stop taking up LRU capacity (and counting as entries) before a lookup
+// happens to find them. Positive entries are kept through the stale window.
+// It returns at once if interval isn't positive.
+func (c *RRCaches[T]) Sweep(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			c.sweep(time.Now())
+		}
+	}
+}
+
+// sweep removes the entries expired at now. The locks are taken per entry,
+// so lookups aren't held up behind a full pass over a large cache.
+func (c *RRCaches[T]) sweep(now time.Time) {
+	for _, k := range c.pos.Keys() {
+		c.posMu.Lock()
+		if v, ok := c.pos.Peek(k); ok && !now.Before(v.ExpireAt.Add(c.stale)) {
+			c.pos.Remove(k)
+			c.expired.Add(1)
+		}
+		c.posMu.Unlock()
+	}
+	for _, k := range c.neg.Keys() {
+		c.negMu.Lock()
+		if v, ok := c.neg.Peek(k); ok && !now.Before(v.ExpireAt) {
+			c.neg.Remove(k)
+			c.expired.Add(1)
+		}
+		c.negMu.Unlock()
+	}
+}
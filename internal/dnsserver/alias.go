@@ -0,0 +1,51 @@
+package dnsserver
+
+import (
+	"log/slog"
+
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// resolveAlias answers an A/AAAA query for owner from its ALIAS target: an
+// in-zone target from the zone data, anything else through the resolver.
+// The records are renamed to owner and their TTLs clamped to the ALIAS
+// TTL. ok is false when the target can't be resolved (the caller
+// answers SERVFAIL); ok with no records means NODATA.
+func (r *Resolver) resolveAlias(log *slog.Logger, zi *zone.ZoneIndex, owner string, alias *zone.RRSet, qtype uint16) (rrs []dns.RR, ttl uint32, ok bool) {
+	target := alias.ALIAS
+	var found []dns.RR
+	if dns.IsSubDomain(zi.ZoneFQDN, target) {
+		found, _, _ = r.findRRSet(zi, target, qtype)
+		if len(found) == 0 && !r.hasName(zi, target) && !r.hasWildcardCandidate(zi, target) {
+			return nil, 0, false
+		}
+	} else {
+		if _, fwd := r.forwardersFor(target); !r.EnableResolver && fwd == nil {
+			return nil, 0, false
+		}
+		m, _, _ := r.resolve(log, target, qtype)
+		if m == nil || m.Rcode != dns.RcodeSuccess {
+			return nil, 0, false
+		}
+		for _, rr := range m.Answer {
+			if rr.Header().Rrtype == qtype {
+				found = append(found, rr)
+			}
+		}
+	}
+	ttl = alias.TTL
+	for _, rr := range found {
+		c := dns.Copy(rr)
+		c.Header().Name = owner
+		if c.Header().Ttl > alias.TTL {
+			c.Header().Ttl = alias.TTL
+		}
+		if c.Header().Ttl < ttl {
+			ttl = c.Header().Ttl
+		}
+		rrs = append(rrs, c)
+	}
+	return rrs, ttl, true
+}
@@ -0,0 +1,72 @@
+package dnsserver
+
+import (
+	"sort"
+	"strings"
+
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// Answers to ANY queries (Resolver.AnyPolicy).
+const (
+	AnyMinimal = "minimal" // empty answer, zone SOA in authority
+	AnyHINFO   = "hinfo"   // a synthesized HINFO (RFC 8482)
+	AnyFull    = "full"    // every RRset owned by the name
+)
+
+// anyHINFOTTL is the TTL of RFC 8482 HINFO answers; the RFC asks for a long
+// one, so resolvers don't come back for it.
+const anyHINFOTTL = 3600
+
+// serveANY answers an ANY query for qname from our zones, per AnyPolicy.
+// Names outside them get REFUSED: ANY is never resolved.
+func (r *Resolver) serveANY(w dns.ResponseWriter, req *dns.Msg, zones *zone.Store, qname string) {
+	zi, _ := zones.GetZoneForName(qname)
+	if zi == nil {
+		r.refused(w, req, dns.RcodeRefused, dns.ExtendedErrorCodeNotAuthoritative, edeTextNotAuthoritative)
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	name := req.Question[0].Name
+	switch r.AnyPolicy {
+	case AnyHINFO:
+		resp.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyHINFOTTL},
+			Cpu: "RFC8482",
+		}}
+	case AnyFull:
+		lower := strings.ToLower(qname)
+		sets := zi.ByName[lower]
+		types := make([]string, 0, len(sets))
+		for t := range sets {
+			// DNSSEC records go only with the answers they sign.
+			if t != zone.TypeRRSIG && t != zone.TypeNSEC {
+				types = append(types, string(t))
+			}
+		}
+		sort.Strings(types)
+		if lower == zi.ZoneFQDN {
+			soa := r.makeSOA(zi)
+			soa.Header().Name = name
+			resp.Answer = append(resp.Answer, soa)
+		}
+		for _, t := range types {
+			resp.Answer = append(resp.Answer, toRR(name, sets[zone.RRType(t)])...)
+		}
+		if len(resp.Answer) == 0 {
+			// Only owned RRsets are listed; a wildcard covers the name
+			// for other queries, so it isn't denied either.
+			if !r.hasName(zi, lower) && !r.hasWildcardCandidate(zi, lower) {
+				resp.Rcode = dns.RcodeNameError
+			}
+			resp.Ns = append(resp.Ns, r.makeSOA(zi))
+		}
+	default:
+		resp.Ns = append(resp.Ns, r.makeSOA(zi))
+	}
+	r.writeMsg(w, req, resp)
+}
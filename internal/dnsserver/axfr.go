@@ -0,0 +1,190 @@
+package dnsserver
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"smart-dns/internal/metrics"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// xferChunk is the number of RRs sent per transfer message.
+const xferChunk = 100
+
+// transfers tracks outgoing zone transfers for limiting and coalescing.
+type transfers struct {
+	mu       sync.Mutex
+	active   int
+	starts   map[netip.Addr][]time.Time
+	building map[xferKey]*xferBuild
+}
+
+type xferKey struct {
+	zone   string // ZoneIndex.Key: views hold different copies of a zone
+	serial uint32
+}
+
+type xferBuild struct {
+	done chan struct{}
+	rrs  []dns.RR
+}
+
+// acquire reserves a transfer slot for peer, enforcing the global
+// concurrency cap and the per-peer starts-per-minute rate.
+func (t *transfers) acquire(peer netip.Addr, maxActive, perMinute int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if maxActive > 0 && t.active >= maxActive {
+		return false
+	}
+	if perMinute > 0 {
+		if t.starts == nil {
+			t.starts = make(map[netip.Addr][]time.Time)
+		}
+		now := time.Now()
+		recent := t.starts[peer][:0]
+		for _, s := range t.starts[peer] {
+			if now.Sub(s) < time.Minute {
+				recent = append(recent, s)
+			}
+		}
+		if len(recent) >= perMinute {
+			t.starts[peer] = recent
+			return false
+		}
+		t.starts[peer] = append(recent, now)
+	}
+	t.active++
+	return true
+}
+
+func (t *transfers) release() {
+	t.mu.Lock()
+	t.active--
+	t.mu.Unlock()
+}
+
+// records returns the transfer contents of zi, building them once per
+// zone+view+serial: concurrent requests for the same version share one
+// build.
+func (t *transfers) records(zi *zone.ZoneIndex, build func() []dns.RR) []dns.RR {
+	k := xferKey{zone: zi.Key(), serial: zi.Serial}
+	t.mu.Lock()
+	if b := t.building[k]; b != nil {
+		t.mu.Unlock()
+		<-b.done
+		return b.rrs
+	}
+	if t.building == nil {
+		t.building = make(map[xferKey]*xferBuild)
+	}
+	b := &xferBuild{done: make(chan struct{})}
+	t.building[k] = b
+	t.mu.Unlock()
+
+	b.rrs = build()
+	close(b.done)
+	t.mu.Lock()
+	delete(t.building, k)
+	t.mu.Unlock()
+	return b.rrs
+}
+
+// serveTransfer answers AXFR (and IXFR, with a full transfer) over TCP for
+// peers in AllowTransfer.
+func (r *Resolver) serveTransfer(log *slog.Logger, w dns.ResponseWriter, req *dns.Msg, zones *zone.Store, qname string) {
+	refuse := func(rcode int, result string, code uint16, text string) {
+		metrics.Transfers.WithLabelValues(result).Inc()
+		r.refused(w, req, rcode, code, text)
+	}
+	if _, tcp := w.RemoteAddr().(*net.TCPAddr); !tcp {
+		refuse(dns.RcodeRefused, "refused", dns.ExtendedErrorCodeNotSupported, edeTextTCPOnly)
+		return
+	}
+	zi, _ := zones.GetZoneForName(qname)
+	if zi == nil || zi.ZoneFQDN != strings.ToLower(qname) {
+		refuse(dns.RcodeNotAuth, "refused", dns.ExtendedErrorCodeNotAuthoritative, edeTextNotAuthoritative)
+		return
+	}
+	peer := clientAddr(w)
+	if !r.AllowTransfer.Contains(peer) {
+		refuse(dns.RcodeRefused, "refused", dns.ExtendedErrorCodeProhibited, edeTextNotAllowed)
+		return
+	}
+	if !r.transferSigned(w, req, zi) {
+		log.Warn("zone transfer without valid TSIG", "zone", zi.ZoneFQDN, "peer", peer)
+		refuse(dns.RcodeNotAuth, "refused", dns.ExtendedErrorCodeProhibited, edeTextTSIGRequired)
+		return
+	}
+	if !r.xfer.acquire(peer, r.MaxTransfers, r.TransferRate) {
+		log.Warn("zone transfer throttled", "zone", zi.ZoneFQDN, "peer", peer)
+		refuse(dns.RcodeRefused, "throttled", dns.ExtendedErrorCodeOther, edeTextRateLimited)
+		return
+	}
+	defer r.xfer.release()
+	metrics.TransfersActive.Inc()
+	defer metrics.TransfersActive.Dec()
+
+	rrs := r.xfer.records(zi, func() []dns.RR { return r.zoneRecords(zi) })
+	ch := make(chan *dns.Envelope, len(rrs)/xferChunk+1)
+	for i := 0; i < len(rrs); i += xferChunk {
+		end := i + xferChunk
+		if end > len(rrs) {
+			end = len(rrs)
+		}
+		ch <- &dns.Envelope{RR: rrs[i:end]}
+	}
+	close(ch)
+	if err := new(dns.Transfer).Out(w, req, ch); err != nil {
+		metrics.Transfers.WithLabelValues("error").Inc()
+		log.Warn("zone transfer", "zone", zi.ZoneFQDN, "peer", peer, "err", err)
+		return
+	}
+	metrics.Transfers.WithLabelValues("ok").Inc()
+	log.Info("zone transferred", "zone", zi.ZoneFQDN, "serial", zi.Serial, "peer", peer, "rrs", len(rrs))
+}
+
+// transferSigned reports whether req may transfer zi as far as TSIG goes.
+// Once keys are configured every transfer must carry a valid signature, by
+// the zone's tsig_key if it names one; dns.Transfer.Out then signs the
+// response with the same key.
+func (r *Resolver) transferSigned(w dns.ResponseWriter, req *dns.Msg, zi *zone.ZoneIndex) bool {
+	if len(r.TSIGKeys) == 0 && zi.TSIGKey == "" {
+		return true
+	}
+	t := req.IsTsig()
+	if t == nil || w.TsigStatus() != nil {
+		return false
+	}
+	return zi.TSIGKey == "" || dns.CanonicalName(t.Hdr.Name) == dns.CanonicalName(zi.TSIGKey)
+}
+
+// zoneRecords lists the zone in AXFR order: SOA, every RRset, SOA.
+func (r *Resolver) zoneRecords(zi *zone.ZoneIndex) []dns.RR {
+	soa := r.makeSOA(zi)
+	out := []dns.RR{soa}
+	names := make([]string, 0, len(zi.ByName))
+	for name := range zi.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := zi.ByName[name]
+		types := make([]string, 0, len(m))
+		for t := range m {
+			types = append(types, string(t))
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			out = append(out, toRR(name, m[zone.RRType(t)])...)
+		}
+	}
+	return append(out, soa)
+}
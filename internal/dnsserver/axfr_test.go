@@ -0,0 +1,44 @@
+package dnsserver
+
+import (
+	"testing"
+	"time"
+
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+func TestTransferBuildsPerView(t *testing.T) {
+	var x transfers
+	inside := &zone.ZoneIndex{ZoneFQDN: "example.com.", Serial: 1, View: "internal"}
+	outside := &zone.ZoneIndex{ZoneFQDN: "example.com.", Serial: 1}
+	insideRRs := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "db.example.com."}}}
+	outsideRRs := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.example.com."}}}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan []dns.RR)
+	go func() {
+		done <- x.records(inside, func() []dns.RR {
+			close(started)
+			<-release
+			return insideRRs
+		})
+	}()
+	<-started
+	// Same zone and serial, other view: must not share the build under way.
+	got := make(chan []dns.RR)
+	go func() { got <- x.records(outside, func() []dns.RR { return outsideRRs }) }()
+	select {
+	case rrs := <-got:
+		if len(rrs) != 1 || rrs[0] != outsideRRs[0] {
+			t.Errorf("default view transferred %v, want %v", rrs, outsideRRs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("default view waited on the internal view's transfer")
+	}
+	close(release)
+	if rrs := <-done; len(rrs) != 1 || rrs[0] != insideRRs[0] {
+		t.Errorf("internal view transferred %v, want %v", rrs, insideRRs)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package dnsserver
+
+import (
+	"net"
+	"syscall"
+)
+
+// setBacklog re-issues listen(2) on l's socket, which updates the queue
+// length of an already listening socket.
+func setBacklog(l net.Listener, n int) error {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	if err := rc.Control(func(fd uintptr) { lerr = syscall.Listen(int(fd), n) }); err != nil {
+		return err
+	}
+	return lerr
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package dnsserver
+
+import "net"
+
+// setBacklog is a no-op on Windows, where the backlog can't be changed once
+// the socket is listening.
+func setBacklog(net.Listener, int) error { return nil }
@@ -0,0 +1,38 @@
+package dnsserver
+
+import (
+	"net"
+
+	"smart-dns/internal/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// Responses to blocked names (Resolver.BlockMode).
+const (
+	BlockNXDomain = "nxdomain" // NXDOMAIN
+	BlockZero     = "zero"     // A 0.0.0.0 / AAAA ::, NODATA for other types
+)
+
+// blockTTL is the TTL of sinkhole answers.
+const blockTTL = 60
+
+// serveBlocked answers a query for a name on the blocklist.
+func (r *Resolver) serveBlocked(w dns.ResponseWriter, req *dns.Msg) {
+	metrics.Blocked.Inc()
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockTTL}
+	switch {
+	case r.BlockMode != BlockZero:
+		m.Rcode = dns.RcodeNameError
+	case q.Qtype == dns.TypeA:
+		m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+	case q.Qtype == dns.TypeAAAA:
+		m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+	}
+	setEDE(req, m, dns.ExtendedErrorCodeBlocked, edeTextBlocked)
+	r.writeMsg(w, req, m)
+}
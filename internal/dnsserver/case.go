@@ -0,0 +1,50 @@
+package dnsserver
+
+import (
+	"math/rand/v2"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// randomCase returns name with the case of each letter flipped at random
+// (the "0x20" defence): an off-path attacker has to guess the case along
+// with the query ID and port, since the server echoes it in the question.
+func randomCase(name string) string {
+	b := []byte(name)
+	bits := rand.Uint64()
+	for i, c := range b {
+		if c|0x20 < 'a' || c|0x20 > 'z' {
+			continue
+		}
+		if i%64 == 0 && i > 0 {
+			bits = rand.Uint64()
+		}
+		if bits&(1<<(i%64)) != 0 {
+			b[i] = c ^ 0x20
+		}
+	}
+	return string(b)
+}
+
+// echoesCase reports whether resp's question is m's, letter case included.
+func echoesCase(m, resp *dns.Msg) bool {
+	return len(resp.Question) == 1 && resp.Question[0].Name == m.Question[0].Name
+}
+
+// restoreCase puts name back, in its own case, wherever resp carries sent,
+// the case-randomized form it was queried as.
+func restoreCase(resp *dns.Msg, sent, name string) {
+	for i := range resp.Question {
+		if strings.EqualFold(resp.Question[i].Name, sent) {
+			resp.Question[i].Name = name
+		}
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); strings.EqualFold(h.Name, sent) {
+				h.Name = name
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package dnsserver
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// serveChaos answers CHAOS-class queries: TXT version.bind. and id.server.
+// with ChaosVersion, everything else (or everything, when ChaosVersion is
+// empty) with REFUSED.
+func (r *Resolver) serveChaos(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if r.ChaosVersion == "" || q.Qtype != dns.TypeTXT || (name != "version.bind." && name != "id.server.") {
+		r.refused(w, req, dns.RcodeRefused, dns.ExtendedErrorCodeNotSupported, edeTextNotSupported)
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{r.ChaosVersion},
+	}}
+	r.writeMsg(w, req, m)
+}
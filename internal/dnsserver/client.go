@@ -0,0 +1,46 @@
+package dnsserver
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// clientAddr returns the requester's IP (unmapped), or the zero Addr.
+func clientAddr(w dns.ResponseWriter) netip.Addr {
+	var ip net.IP
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+// clientSubnet returns the EDNS0 client subnet (RFC 7871) of req, masked to
+// its source prefix length, or nil when absent or malformed.
+func clientSubnet(req *dns.Msg) *net.IPNet {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		s, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		bits := 32
+		if s.Family == 2 {
+			bits = 128
+		}
+		if s.Address == nil || int(s.SourceNetmask) > bits {
+			return nil
+		}
+		mask := net.CIDRMask(int(s.SourceNetmask), bits)
+		return &net.IPNet{IP: s.Address.Mask(mask), Mask: mask}
+	}
+	return nil
+}
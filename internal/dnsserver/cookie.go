@@ -0,0 +1,121 @@
+package dnsserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS Cookies (RFC 7873). Server cookies use the layout of RFC 9018:
+// version 1, three reserved bytes, a 32-bit timestamp and an 8-byte hash,
+// here HMAC-SHA256 of the client cookie, version, timestamp and client IP
+// under CookieSecret. Nodes sharing the secret accept each other's cookies.
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16
+	cookieVersion   = 1
+	// A server cookie is valid for an hour (and up to 5 minutes early, for
+	// clock skew between nodes); after half an hour a fresh one is issued.
+	cookieMaxAge  = time.Hour
+	cookieMaxSkew = 5 * time.Minute
+	cookieRenew   = 30 * time.Minute
+)
+
+// cookieOf returns the client and server cookies of req's COOKIE option;
+// ok is false when the option is malformed (answered with FORMERR).
+func cookieOf(req *dns.Msg) (client, server []byte, ok bool) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil, nil, true
+	}
+	for _, o := range opt.Option {
+		c, isCookie := o.(*dns.EDNS0_COOKIE)
+		if !isCookie {
+			continue
+		}
+		b, err := hex.DecodeString(c.Cookie)
+		if err != nil || len(b) < clientCookieLen || len(b) > 40 || (len(b) > clientCookieLen && len(b) < clientCookieLen+8) {
+			return nil, nil, false
+		}
+		return b[:clientCookieLen], b[clientCookieLen:], true
+	}
+	return nil, nil, true
+}
+
+// serverCookie computes our server cookie for client at ts.
+func (r *Resolver) serverCookie(clientCookie []byte, client netip.Addr, ts uint32) []byte {
+	out := make([]byte, 8, serverCookieLen)
+	out[0] = cookieVersion
+	binary.BigEndian.PutUint32(out[4:], ts)
+	mac := hmac.New(sha256.New, r.CookieSecret)
+	mac.Write(clientCookie)
+	mac.Write(out)
+	mac.Write(client.Unmap().AsSlice())
+	return mac.Sum(out)[:serverCookieLen]
+}
+
+// validCookie reports whether server is a cookie we issued to client for
+// clientCookie that hasn't expired, and when it was issued.
+func (r *Resolver) validCookie(clientCookie, server []byte, client netip.Addr, now time.Time) (time.Time, bool) {
+	if len(server) != serverCookieLen || server[0] != cookieVersion {
+		return time.Time{}, false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if now.Sub(issued) > cookieMaxAge || issued.Sub(now) > cookieMaxSkew {
+		return time.Time{}, false
+	}
+	want := r.serverCookie(clientCookie, client, binary.BigEndian.Uint32(server[4:8]))
+	return issued, hmac.Equal(server, want)
+}
+
+// cookieValidated reports whether req, from client, came over TCP (plain,
+// DoT or DoH) or with a valid server cookie, so its source address can be
+// trusted.
+func (r *Resolver) cookieValidated(w dns.ResponseWriter, req *dns.Msg, client netip.Addr) bool {
+	if tcpConn(w) || overDoH(w) {
+		return true
+	}
+	cc, sc, _ := cookieOf(req)
+	if cc == nil {
+		return false
+	}
+	_, ok := r.validCookie(cc, sc, client, time.Now())
+	return ok
+}
+
+// withCookie returns resp carrying a COOKIE option for req: the client
+// cookie with the server cookie it sent while that is still fresh, else a
+// new one. Requests without a client cookie get resp unchanged.
+func (r *Resolver) withCookie(req, resp *dns.Msg, client netip.Addr) *dns.Msg {
+	cc, sc, ok := cookieOf(req)
+	if cc == nil || !ok || resp.IsEdns0() == nil {
+		return resp
+	}
+	now := time.Now()
+	if issued, valid := r.validCookie(cc, sc, client, now); !valid || now.Sub(issued) > cookieRenew {
+		sc = r.serverCookie(cc, client, uint32(now.Unix()))
+	}
+	resp = resp.Copy() // may be shared with the cache
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(append(cc[:len(cc):len(cc)], sc...))})
+	return resp
+}
+
+// badCookie answers a UDP request that needs a valid cookie: BADCOOKIE
+// (with a fresh cookie, attached by writeMsg) when the client sent one,
+// otherwise an empty truncated response so it retries over TCP.
+func (r *Resolver) badCookie(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if cc, _, _ := cookieOf(req); cc != nil {
+		m.Rcode = dns.RcodeBadCookie
+	} else {
+		m.Truncated = true
+	}
+	r.writeMsg(w, req, m)
+}
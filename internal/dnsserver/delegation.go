@@ -0,0 +1,82 @@
+package dnsserver
+
+import (
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+)
+
+// delegationCacheSize bounds the zone cuts the resolver remembers.
+const delegationCacheSize = 10000
+
+// delegation is a zone cut learned from a referral: the addresses of the
+// zone's servers and, when validating, the DS set that secured it (nil for
+// an unsigned zone).
+type delegation struct {
+	zone    string
+	servers []string
+	ds      []*dns.DS
+	expires time.Time
+}
+
+func newDelegationCache() *lru.Cache[string, delegation] {
+	c, _ := lru.New[string, delegation](delegationCacheSize) // size is constant and positive
+	return c
+}
+
+// closestDelegation returns the deepest unexpired cached zone cut above
+// name, so iteration can start there instead of at the roots. A DS set
+// lives in the parent zone, so for DS the search starts above name's own
+// cut.
+func (r *Resolver) closestDelegation(name string, qtype uint16) (delegation, bool) {
+	if r.delegations == nil {
+		return delegation{}, false
+	}
+	name = strings.ToLower(name)
+	off, end := 0, false
+	if qtype == dns.TypeDS {
+		if off, end = dns.NextLabel(name, 0); end {
+			return delegation{}, false
+		}
+	}
+	now := time.Now()
+	for ; !end; off, end = dns.NextLabel(name, off) {
+		d, ok := r.delegations.Get(name[off:])
+		if !ok {
+			continue
+		}
+		if now.After(d.expires) {
+			r.delegations.Remove(d.zone)
+			continue
+		}
+		return d, true
+	}
+	return delegation{}, false
+}
+
+// rememberDelegation caches a referral for the TTL of its NS records.
+func (r *Resolver) rememberDelegation(resp *dns.Msg, zone string, servers []string, ds []*dns.DS) {
+	if r.delegations == nil {
+		return
+	}
+	ttl := uint32(0)
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	zone = strings.ToLower(zone)
+	r.delegations.Add(zone, delegation{zone: zone, servers: servers, ds: ds, expires: time.Now().Add(time.Duration(ttl) * time.Second)})
+}
+
+// forgetDelegation drops a cached zone cut whose servers stopped answering.
+func (r *Resolver) forgetDelegation(zone string) {
+	if r.delegations != nil {
+		r.delegations.Remove(zone)
+	}
+}
@@ -0,0 +1,37 @@
+package dnsserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClosestDelegationDS(t *testing.T) {
+	r, _ := newTestResolver(t)
+	expires := time.Now().Add(time.Hour)
+	for _, zone := range []string{"com.", "example.com."} {
+		r.delegations.Add(zone, delegation{zone: zone, servers: []string{"192.0.2.53:53"}, expires: expires})
+	}
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string // "" for none: start at the roots
+	}{
+		{"www.example.com.", dns.TypeA, "example.com."},
+		{"example.com.", dns.TypeA, "example.com."},
+		{"example.com.", dns.TypeDS, "com."},
+		{"sub.example.com.", dns.TypeDS, "example.com."},
+		{"com.", dns.TypeDS, ""},
+		{".", dns.TypeDS, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if d, ok := r.closestDelegation(tt.name, tt.qtype); ok {
+			got = d.zone
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: start at %q, want %q", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
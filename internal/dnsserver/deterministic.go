@@ -0,0 +1,66 @@
+package dnsserver
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// sortRRsets returns resp with the records of each RRset in canonical order
+// (RFC 4034 section 6.3: by RDATA as unsigned octets), for
+// Resolver.Deterministic. Only adjacent records of the same name, type and
+// class are reordered, so CNAME chains and the order of RRsets stay as
+// built. resp is copied when anything moves, since it may be shared with
+// the cache.
+func sortRRsets(resp *dns.Msg) *dns.Msg {
+	sorted := true
+	forEachRRset(resp, func(set []dns.RR) {
+		sorted = sorted && sort.SliceIsSorted(set, rdataLess(set))
+	})
+	if sorted {
+		return resp
+	}
+	resp = resp.Copy()
+	forEachRRset(resp, func(set []dns.RR) {
+		sort.SliceStable(set, rdataLess(set))
+	})
+	return resp
+}
+
+// forEachRRset calls f with each run of two or more adjacent records of the
+// same name, type and class in m.
+func forEachRRset(m *dns.Msg, f func([]dns.RR)) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for i := 0; i < len(rrs); {
+			j := i + 1
+			for j < len(rrs) && sameRRset(rrs[i], rrs[j]) {
+				j++
+			}
+			if j-i > 1 {
+				f(rrs[i:j])
+			}
+			i = j
+		}
+	}
+}
+
+func sameRRset(a, b dns.RR) bool {
+	ha, hb := a.Header(), b.Header()
+	return ha.Rrtype == hb.Rrtype && ha.Class == hb.Class && strings.EqualFold(ha.Name, hb.Name)
+}
+
+func rdataLess(set []dns.RR) func(i, j int) bool {
+	return func(i, j int) bool { return bytes.Compare(rdata(set[i]), rdata(set[j])) < 0 }
+}
+
+// rdata returns rr's RDATA in wire form, uncompressed.
+func rdata(rr dns.RR) []byte {
+	buf := make([]byte, dns.Len(rr)+1)
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	return buf[off-int(rr.Header().Rdlength) : off]
+}
@@ -0,0 +1,161 @@
+package dnsserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"smart-dns/internal/cache"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// dns64MaxTTL caps the TTL of synthesized AAAA records, so clients notice
+// soon when a real AAAA shows up (or the prefix changes).
+const dns64MaxTTL = 300
+
+// ParseDNS64Prefix parses a NAT64 prefix such as 64:ff9b::/96. RFC 6052
+// allows lengths 32, 40, 48, 56, 64 and 96; bits 64-71 must be zero.
+func ParseDNS64Prefix(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if !p.Addr().Is6() || p.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("%s isn't an IPv6 prefix", s)
+	}
+	switch p.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return netip.Prefix{}, fmt.Errorf("prefix length /%d (want 32, 40, 48, 56, 64 or 96)", p.Bits())
+	}
+	if p.Masked() != p {
+		return netip.Prefix{}, fmt.Errorf("%s has host bits set", s)
+	}
+	if p.Addr().As16()[8] != 0 {
+		return netip.Prefix{}, fmt.Errorf("%s: bits 64-71 must be zero", s)
+	}
+	return p, nil
+}
+
+// embedIPv4 returns the IPv6 address of v4 in prefix (RFC 6052 section
+// 2.2), skipping the reserved octet at bits 64-71.
+func embedIPv4(prefix netip.Prefix, v4 [4]byte) netip.Addr {
+	b := prefix.Addr().As16()
+	i := prefix.Bits() / 8
+	for _, x := range v4 {
+		if i == 8 {
+			i++
+		}
+		b[i] = x
+		i++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// dns64Writer marks an AAAA query that DNS64 (Resolver.DNS64Prefix)
+// applies to; writeMsg synthesizes the answer when the name has no AAAA.
+// Synthesis happens per response, so caches only ever hold the real
+// answers.
+type dns64Writer struct {
+	dns.ResponseWriter
+	log    *slog.Logger
+	zones  *zone.Store
+	rcache cache.Cache[*dns.Msg]
+	// recurse is whether the client may use the resolver.
+	recurse bool
+}
+
+func (d *dns64Writer) Unwrap() dns.ResponseWriter { return d.ResponseWriter }
+
+// dns64 returns resp with AAAA records synthesized from the A records of
+// the name it answers (the end of its CNAME chain), when resp is a NODATA
+// answer to the AAAA query req (RFC 6147 section 5.1). Otherwise resp is
+// returned as is.
+func (r *Resolver) dns64(d *dns64Writer, req, resp *dns.Msg) *dns.Msg {
+	if resp.Rcode != dns.RcodeSuccess || resp.Truncated {
+		return resp
+	}
+	target := req.Question[0].Name
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.AAAA:
+			return resp
+		case *dns.CNAME:
+			if strings.EqualFold(rr.Hdr.Name, target) {
+				target = rr.Target
+			}
+		}
+	}
+	as := r.dns64Addresses(d, dns.Fqdn(target))
+	if len(as) == 0 {
+		return resp
+	}
+	ttl := uint32(dns64MaxTTL)
+	for _, rr := range resp.Ns {
+		// The NODATA answer's negative TTL bounds it too (section 5.1.7).
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(ttl, min(soa.Hdr.Ttl, soa.Minttl))
+		}
+	}
+	out := resp.Copy()
+	// The answer is ours, not the zone's: nothing signs it, nothing
+	// denies it.
+	out.AuthenticatedData = false
+	out.Answer = filterRRs(out.Answer, func(t uint16) bool { return !isDNSSECType(t) })
+	out.Ns = nil
+	for _, a := range as {
+		v4, ok := netip.AddrFromSlice(a.A.To4())
+		if !ok {
+			continue
+		}
+		out.Answer = append(out.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: a.Hdr.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: min(ttl, a.Hdr.Ttl)},
+			AAAA: net.IP(embedIPv4(r.DNS64Prefix, v4.As4()).AsSlice()),
+		})
+	}
+	return out
+}
+
+// dns64Addresses returns the A records of name, from our zones or, when the
+// client may recurse, the resolver.
+func (r *Resolver) dns64Addresses(d *dns64Writer, name string) []*dns.A {
+	var ans []dns.RR
+	zi, fwd := r.zoneFor(d.zones, name)
+	switch {
+	case zi != nil:
+		rrs, _, rcode, _ := r.lookup(d.log, zi, name, dns.TypeA)
+		if rcode != dns.RcodeSuccess {
+			return nil
+		}
+		ans = rrs
+	case !(r.EnableResolver || fwd) || !d.recurse:
+		return nil
+	case !fwd && (r.isLocalOnly(name) || (r.SpecialUse && specialZone(strings.ToLower(name)) != "")):
+		return nil
+	default:
+		if cached, ok := d.rcache.GetPositive(name, dns.TypeA); ok {
+			ans = cached.Answer
+			break
+		}
+		m, ttl, _ := r.resolve(d.log, name, dns.TypeA)
+		if m == nil || m.Rcode != dns.RcodeSuccess {
+			return nil
+		}
+		if len(m.Answer) > 0 && ttl > 0 && !uncacheable(m) {
+			d.rcache.PutPositive(name, dns.TypeA, m.Copy(), time.Duration(ttl)*time.Second)
+		}
+		ans = m.Answer
+	}
+	var as []*dns.A
+	for _, rr := range ans {
+		if a, ok := rr.(*dns.A); ok {
+			as = append(as, a)
+		}
+	}
+	return as
+}
@@ -0,0 +1,105 @@
+package dnsserver
+
+import (
+	"strings"
+
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// addDNSSEC decorates an authoritative response from a pre-signed zone for a
+// DO=1 client: RRSIGs for every RRset in the answer and authority sections,
+// and the NSEC records proving NXDOMAIN/NODATA.
+func (r *Resolver) addDNSSEC(zi *zone.ZoneIndex, resp *dns.Msg, qname string) {
+	resp.Answer = append(resp.Answer, r.sigsFor(zi, resp.Answer)...)
+	if len(resp.Answer) == 0 {
+		resp.Ns = append(resp.Ns, r.denialNSEC(zi, strings.ToLower(qname), resp.Rcode)...)
+	}
+	resp.Ns = append(resp.Ns, r.sigsFor(zi, resp.Ns)...)
+}
+
+// sigsFor returns the zone's RRSIGs covering each RRset in rrs. Signatures of
+// wildcard-expanded answers come from the wildcard owner.
+func (r *Resolver) sigsFor(zi *zone.ZoneIndex, rrs []dns.RR) []dns.RR {
+	type set struct {
+		name string
+		t    uint16
+	}
+	seen := map[set]struct{}{}
+	var out []dns.RR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		k := set{strings.ToLower(h.Name), h.Rrtype}
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		sigs := r.rrsigsAt(zi, k.name, k.t)
+		if ce := r.closestEncloser(zi, k.name); sigs == nil && ce != k.name {
+			sigs = r.rrsigsAt(zi, "*."+ce, k.t)
+		}
+		for _, s := range sigs {
+			s.Hdr.Name = h.Name
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (r *Resolver) rrsigsAt(zi *zone.ZoneIndex, name string, t uint16) []*dns.RRSIG {
+	set := zi.ByName[name][zone.TypeRRSIG]
+	if set == nil {
+		return nil
+	}
+	var out []*dns.RRSIG
+	for _, rr := range set.RR {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t {
+			out = append(out, dns.Copy(sig).(*dns.RRSIG))
+		}
+	}
+	return out
+}
+
+// denialNSEC picks the NSEC records proving the negative answer: the NSEC at
+// the name itself for NODATA, otherwise the NSEC covering the name plus the
+// one covering the wildcard at the closest encloser.
+func (r *Resolver) denialNSEC(zi *zone.ZoneIndex, name string, rcode int) []dns.RR {
+	if rcode == dns.RcodeSuccess {
+		if set := zi.ByName[name][zone.TypeNSEC]; set != nil {
+			return toRR(name, set)
+		}
+	}
+	var out []dns.RR
+	owners := map[string]struct{}{}
+	for _, n := range []string{name, "*." + r.closestEncloser(zi, name)} {
+		owner := zi.CoveringNSEC(n)
+		if owner == "" {
+			break
+		}
+		if _, dup := owners[owner]; dup {
+			continue
+		}
+		owners[owner] = struct{}{}
+		out = append(out, toRR(owner, zi.ByName[owner][zone.TypeNSEC])...)
+	}
+	return out
+}
+
+// closestEncloser returns the longest existing ancestor of name in the zone.
+func (r *Resolver) closestEncloser(zi *zone.ZoneIndex, name string) string {
+	for cur := name; cur != zi.ZoneFQDN; {
+		if r.hasName(zi, cur) {
+			return cur
+		}
+		i, end := dns.NextLabel(cur, 0)
+		if end {
+			break
+		}
+		cur = cur[i:]
+	}
+	return zi.ZoneFQDN
+}
@@ -0,0 +1,156 @@
+package dnsserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DoHHandler serves DNS over HTTPS (RFC 8484) at /dns-query by running the
+// wire-format query through h. TLS is left to whatever fronts the server.
+func DoHHandler(h dns.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, hr *http.Request) {
+		var buf []byte
+		switch hr.Method {
+		case http.MethodGet:
+			b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(hr.URL.Query().Get("dns"), "="))
+			if err != nil || len(b) == 0 {
+				http.Error(w, "bad dns parameter", http.StatusBadRequest)
+				return
+			}
+			buf = b
+		case http.MethodPost:
+			if hr.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "want "+dohMediaType, http.StatusUnsupportedMediaType)
+				return
+			}
+			b, err := io.ReadAll(io.LimitReader(hr.Body, dns.MaxMsgSize+1))
+			if err != nil || len(b) == 0 || len(b) > dns.MaxMsgSize {
+				http.Error(w, "bad request body", http.StatusBadRequest)
+				return
+			}
+			buf = b
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			http.Error(w, "malformed dns message", http.StatusBadRequest)
+			return
+		}
+
+		dw := &dohWriter{remote: httpRemoteAddr(hr)}
+		if len(req.Question) > 0 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+			// Transfers stream several messages; one HTTP response can't carry them
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeRefused)
+			setEDE(req, m, dns.ExtendedErrorCodeNotSupported, edeTextTCPOnly)
+			dw.msg = m
+		} else {
+			h.ServeDNS(dw, req)
+		}
+		if dw.msg == nil {
+			http.Error(w, "no response", http.StatusInternalServerError)
+			return
+		}
+		out, err := dw.msg.Pack()
+		if err != nil {
+			http.Error(w, "pack response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		if ttl, ok := minTTL(dw.msg); ok {
+			w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+		}
+		_, _ = w.Write(out)
+	})
+}
+
+const dohMediaType = "application/dns-message"
+
+// minTTL is the smallest TTL in m, ignoring OPT; ok is false without records.
+func minTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, s := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range s {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT && (!ok || h.Ttl < ttl) {
+				ttl, ok = h.Ttl, true
+			}
+		}
+	}
+	return ttl, ok
+}
+
+func httpRemoteAddr(hr *http.Request) net.Addr {
+	ap, err := netip.ParseAddrPort(hr.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// dohWriter is the in-process dns.ResponseWriter handed to the resolver; it
+// keeps the first message written. The remote is a TCPAddr, so UDP size
+// handling doesn't apply.
+type dohWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+var _ dns.ResponseWriter = (*dohWriter)(nil)
+
+// errNoTsig is the TSIG status of every DoH request: signatures aren't
+// verified there, so a signed request never counts as authenticated.
+var errNoTsig = errors.New("TSIG not supported over DoH")
+
+// overDoH reports whether w, or a writer it wraps (see unwrapper), answers
+// a DoH request.
+func overDoH(w dns.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case *dohWriter:
+			return true
+		case unwrapper:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// unwrapper is implemented by ResponseWriters wrapping another, so checks
+// on the transport see through them.
+type unwrapper interface {
+	Unwrap() dns.ResponseWriter
+}
+
+func (d *dohWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (d *dohWriter) RemoteAddr() net.Addr { return d.remote }
+
+func (d *dohWriter) WriteMsg(m *dns.Msg) error {
+	if d.msg == nil {
+		d.msg = m
+	}
+	return nil
+}
+
+func (d *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), d.WriteMsg(m)
+}
+
+func (d *dohWriter) Close() error        { return nil }
+func (d *dohWriter) TsigStatus() error   { return errNoTsig }
+func (d *dohWriter) TsigTimersOnly(bool) {}
+func (d *dohWriter) Hijack()             {}
@@ -0,0 +1,70 @@
+package dnsserver
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTCPConnDoH(t *testing.T) {
+	doh := &dohWriter{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}}
+	tests := []struct {
+		name string
+		w    dns.ResponseWriter
+		want bool
+	}{
+		{"tcp", &recorder{}, true},
+		{"tcp logged", &queryLogWriter{ResponseWriter: &recorder{}}, true},
+		{"doh", doh, false},
+		{"doh logged", &queryLogWriter{ResponseWriter: doh}, false},
+		{"doh dns64", &dns64Writer{ResponseWriter: &queryLogWriter{ResponseWriter: doh}}, false},
+	}
+	for _, tt := range tests {
+		if got := tcpConn(tt.w); got != tt.want {
+			t.Errorf("%s: tcpConn = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoHRequireCookie(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)})
+		w.WriteMsg(m)
+	})
+	r, _ := newTestResolver(t)
+	r.EnableResolver = true
+	r.RootServers = []string{upstream}
+	r.Family = FamilyV4
+	r.CookieSecret = make([]byte, 16)
+	r.RequireCookie = true
+
+	// No cookie at all: over UDP that gets TC=1, but HTTPS already proves
+	// the client's address.
+	req := new(dns.Msg)
+	req.SetQuestion("www.test.", dns.TypeA)
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(buf))
+	hr.Header.Set("Content-Type", dohMediaType)
+	rec := httptest.NewRecorder()
+	DoHHandler(r).ServeHTTP(rec, hr)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rec.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Truncated || len(resp.Answer) != 1 {
+		t.Errorf("TC=%v, answer %v; want the resolved A", resp.Truncated, resp.Answer)
+	}
+}
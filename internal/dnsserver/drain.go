@@ -0,0 +1,7 @@
+package dnsserver
+
+// SetDraining puts the resolver in (or takes it out of) drain mode. Queries
+// are still answered while draining; only the advertised TTLs change.
+func (r *Resolver) SetDraining(on bool) { r.draining.Store(on) }
+
+func (r *Resolver) Draining() bool { return r.draining.Load() }
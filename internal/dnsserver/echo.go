@@ -0,0 +1,30 @@
+package dnsserver
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EchoHandler answers every query with NOERROR and a single fixed A record,
+// bypassing zones, cache and resolver. It exists to benchmark the transport
+// layer in isolation and must never serve real traffic.
+type EchoHandler struct{}
+
+var echoA = net.IPv4(192, 0, 2, 1).To4()
+
+func (EchoHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	if len(req.Question) == 0 {
+		m.SetRcode(req, dns.RcodeFormatError)
+		_ = w.WriteMsg(m)
+		return
+	}
+	m.SetReply(req)
+	m.Authoritative = true
+	a := new(dns.A)
+	a.Hdr = dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+	a.A = echoA
+	m.Answer = []dns.RR{a}
+	_ = w.WriteMsg(m)
+}
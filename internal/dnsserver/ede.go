@@ -0,0 +1,89 @@
+package dnsserver
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// Extended DNS Errors (RFC 8914) attached to our failure responses:
+//
+//	13 Cached Error            SERVFAIL answered from the short failure cache
+//	22 No Reachable Authority  iterative resolution failed (no upstream answered)
+//	23 Network Error           no forwarder answered
+//	 3 Stale Answer            expired cache entry served, resolution failed
+//	 0 Other ("rate limited")  response limited; back off and retry later
+//	 0 Other ("unresolvable")  in-zone CNAME loop or ALIAS target not resolvable
+//	20 Not Authoritative       REFUSED/NOTAUTH for a name we don't serve to this client
+//	18 Prohibited              REFUSED/NOTAUTH by an ACL or missing TSIG
+//	21 Not Supported           transfer over a transport that can't carry it,
+//	                           or a CHAOS query we don't answer
+//	15 Blocked                 name is on the blocklist, or denied by a response
+//	                           policy rule
+//	 4 Forged Answer           answer rewritten by a response policy rule
+//	 6 DNSSEC Bogus            resolver answer failed DNSSEC validation
+//
+// EDE travels in the OPT record, so it is only added for EDNS clients. The
+// texts are fixed strings, never derived from the query, so they are safe
+// to log.
+const (
+	edeTextCachedFailure    = "cached resolver failure, retry later"
+	edeTextUpstreamFailed   = "upstream resolution failed"
+	edeTextNetworkError     = "network error"
+	edeTextRateLimited      = "rate limited, retry later"
+	edeTextStale            = "stale answer, upstream unreachable"
+	edeTextNotAuthoritative = "not authoritative"
+	edeTextNotAllowed       = "not allowed"
+	edeTextTSIGRequired     = "valid TSIG required"
+	edeTextTCPOnly          = "zone transfer needs TCP"
+	edeTextNotSupported     = "not supported"
+	edeTextUnresolvable     = "unresolvable: CNAME loop or ALIAS target"
+	edeTextBogus            = "DNSSEC bogus"
+	edeTextBlocked          = "blocked"
+	edeTextPolicy           = "response policy"
+)
+
+// setEDE attaches an Extended DNS Error option to resp. OPT may only be sent
+// to clients that used EDNS themselves, so this is a no-op otherwise.
+func setEDE(req, resp *dns.Msg, code uint16, text string) {
+	ropt := req.IsEdns0()
+	if ropt == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(maxUDPSize, ropt.Do())
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// upstreamFailure is the EDE for a resolution of qname that failed with
+// err: a validation failure is bogus, forwarders that didn't answer are a
+// network error, an iteration that ran out of servers has no reachable
+// authority.
+func (r *Resolver) upstreamFailure(qname string, err error) (uint16, string) {
+	if errors.Is(err, errBogus) {
+		return dns.ExtendedErrorCodeDNSBogus, edeTextBogus
+	}
+	if _, fwd := r.forwardersFor(qname); fwd != nil || len(r.ForwardServers) > 0 {
+		return dns.ExtendedErrorCodeNetworkError, edeTextNetworkError
+	}
+	return dns.ExtendedErrorCodeNoReachableAuthority, edeTextUpstreamFailed
+}
+
+// refused answers req with rcode (REFUSED or NOTAUTH) and an EDE.
+func (r *Resolver) refused(w dns.ResponseWriter, req *dns.Msg, rcode int, code uint16, text string) {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	setEDE(req, m, code, text)
+	r.writeMsg(w, req, m)
+}
+
+// servFail answers req with SERVFAIL and an EDE explaining why.
+func (r *Resolver) servFail(w dns.ResponseWriter, req *dns.Msg, code uint16, text string) {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	setEDE(req, m, code, text)
+	r.writeMsg(w, req, m)
+}
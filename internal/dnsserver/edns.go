@@ -0,0 +1,158 @@
+package dnsserver
+
+import (
+	"encoding/hex"
+	"net"
+	"time"
+
+	"smart-dns/internal/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// writeMsg is the single exit point for responses built by ServeDNS.
+func (r *Resolver) writeMsg(w dns.ResponseWriter, req, resp *dns.Msg) {
+	if d, ok := w.(*dns64Writer); ok {
+		resp = r.dns64(d, req, resp)
+	}
+	if r.Deterministic {
+		resp = sortRRsets(resp)
+	}
+	if r.DrainTTL > 0 && r.Draining() {
+		// resp may be shared with the cache; clamp a private copy
+		resp = resp.Copy()
+		clampTTLs(resp, r.DrainTTL)
+	}
+	resp = echoEDNS(req, resp)
+	if r.CookieSecret != nil {
+		resp = r.withCookie(req, resp, clientAddr(w))
+	}
+	if r.NSID != "" && hasOption(req, dns.EDNS0NSID) {
+		resp = withNSID(resp, r.NSID)
+	}
+	if r.TCPKeepalive > 0 && hasOption(req, dns.EDNS0TCPKEEPALIVE) && tcpConn(w) {
+		resp = withKeepalive(resp, r.TCPKeepalive)
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		outcome := "fit"
+		if len(req.Question) > 0 && !r.RRL.Allow(clientAddr(w), req.Question[0].Name, resp.Rcode) {
+			// Over the limit: answer TC=1 so genuine clients retry over TCP
+			resp = truncated(req, resp)
+			setEDE(req, resp, dns.ExtendedErrorCodeOther, edeTextRateLimited)
+			metrics.RateLimited.Inc()
+			outcome = "rate_limited"
+		} else if r.overTypeLimit(req, resp) {
+			resp = truncated(req, resp)
+			outcome = "type_limit"
+		} else if size := udpBufferSize(req); resp.Len() > size {
+			// Drop what doesn't fit (compressing first) and set TC so the
+			// client retries over TCP instead of us sending a fragment.
+			resp = resp.Copy()
+			resp.Truncate(size)
+			if resp.Truncated {
+				outcome = "truncated"
+			}
+		}
+		metrics.UDPResponseSize.WithLabelValues(outcome).Inc()
+	}
+	metrics.Queries.WithLabelValues(qtypeLabel(req), dns.RcodeToString[resp.Rcode]).Inc()
+	if t := req.IsTsig(); t != nil && w.TsigStatus() == nil {
+		// Answer signed requests (e.g. a secondary's SOA poll) in kind;
+		// the writer computes the MAC. resp may be shared with the cache.
+		resp = resp.Copy()
+		resp.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+	}
+	_ = w.WriteMsg(resp)
+}
+
+// echoEDNS makes resp's EDNS match req's: a query with OPT gets one back
+// advertising our payload size (RFC 6891 section 7), and one without gets
+// none, even when resp came from the cache built for an EDNS client.
+func echoEDNS(req, resp *dns.Msg) *dns.Msg {
+	ropt, opt := req.IsEdns0(), resp.IsEdns0()
+	switch {
+	case ropt != nil && opt == nil:
+		resp = resp.Copy()
+		resp.SetEdns0(maxUDPSize, ropt.Do())
+	case ropt == nil && opt != nil:
+		resp = resp.Copy()
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+	}
+	return resp
+}
+
+// hasOption reports whether req carries the EDNS option code.
+func hasOption(req *dns.Msg, code uint16) bool {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tcpConn reports whether w is a TCP or DoT connection. DoH requests have a
+// TCP remote too, but the connection is HTTP's to manage.
+func tcpConn(w dns.ResponseWriter) bool {
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	return tcp && !overDoH(w)
+}
+
+// withKeepalive returns resp with an EDNS TCP keepalive option advertising
+// idle (RFC 7828), in the option's units of 100ms.
+func withKeepalive(resp *dns.Msg, idle time.Duration) *dns.Msg {
+	resp = resp.Copy() // may be shared with the cache
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return resp
+	}
+	timeout := idle / (100 * time.Millisecond)
+	if timeout > 0xffff {
+		timeout = 0xffff
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(timeout)})
+	return resp
+}
+
+// withNSID returns resp with an NSID option carrying id (RFC 5001).
+func withNSID(resp *dns.Msg, id string) *dns.Msg {
+	resp = resp.Copy() // may be shared with the cache
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return resp
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(id))})
+	return resp
+}
+
+// qtypeLabel keeps the qtype label's cardinality bounded.
+func qtypeLabel(req *dns.Msg) string {
+	if len(req.Question) == 0 {
+		return "none"
+	}
+	if s, ok := dns.TypeToString[req.Question[0].Qtype]; ok {
+		return s
+	}
+	return "other"
+}
+
+// udpBufferSize is the largest UDP response the client accepts: its EDNS0
+// payload size (capped at ours), or 512 without EDNS.
+func udpBufferSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	return size
+}
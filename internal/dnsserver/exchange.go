@@ -0,0 +1,122 @@
+package dnsserver
+
+import (
+	"context"
+	"time"
+
+	"smart-dns/internal/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream query timeouts when Resolver leaves them zero, and the backoff
+// before the first retry of a step whose servers all failed (doubled for
+// each further one).
+const (
+	defaultUDPTimeout = 3 * time.Second
+	defaultTCPTimeout = 5 * time.Second
+	retryBackoff      = 100 * time.Millisecond
+)
+
+// upstreamClients returns the UDP and TCP clients for upstream queries.
+func (r *Resolver) upstreamClients() (cu, ct *dns.Client) {
+	udp, tcp := r.UDPTimeout, r.TCPTimeout
+	if udp <= 0 {
+		udp = defaultUDPTimeout
+	}
+	if tcp <= 0 {
+		tcp = defaultTCPTimeout
+	}
+	return &dns.Client{Net: "udp", Timeout: udp}, &dns.Client{Net: "tcp", Timeout: tcp}
+}
+
+// exchange sends m to servers as exchangeServers does, making up to Retries
+// more passes over them, each after a growing backoff, while none answers.
+// It gives up early once ctx is done.
+func (r *Resolver) exchange(ctx context.Context, cu, ct *dns.Client, servers []string, m *dns.Msg) *dns.Msg {
+	for attempt := 0; ; attempt++ {
+		if resp := r.exchangeServers(ctx, cu, ct, servers, m); resp != nil {
+			return resp
+		}
+		if attempt >= r.Retries || !sleepContext(ctx, retryBackoff<<attempt) {
+			return nil
+		}
+	}
+}
+
+// sleepContext waits for d, or until ctx is done; it reports whether the
+// full wait elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// exchangeServers sends m to servers, up to Parallelism at a time, and
+// returns the first response received; a server that fails is replaced by
+// the next one. Truncated responses are retried over TCP with the same
+// server. With CaseRandomization a response not echoing m's question in its
+// exact case counts as a failure. Once a response is in, the queries still
+// in flight are cancelled.
+func (r *Resolver) exchangeServers(ctx context.Context, cu, ct *dns.Client, servers []string, m *dns.Msg) *dns.Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	n := max(r.Parallelism, 1)
+	// buffered so late senders never block after we returned
+	results := make(chan *dns.Msg, len(servers))
+	next, pending := 0, 0
+	for {
+		for pending < n && next < len(servers) {
+			go func(srv string, m *dns.Msg) {
+				resp := exchangeOne(ctx, cu, ct, srv, m)
+				if resp != nil && r.CaseRandomization && !echoesCase(m, resp) {
+					metrics.CaseMismatches.Inc()
+					resp = nil
+				}
+				results <- resp
+			}(servers[next], m.Copy())
+			next++
+			pending++
+		}
+		if pending == 0 {
+			return nil
+		}
+		resp := <-results
+		pending--
+		if resp != nil {
+			return resp
+		}
+	}
+}
+
+// exchangeOne queries srv over UDP, then over TCP if the answer was
+// truncated. It returns nil on failure.
+func exchangeOne(ctx context.Context, cu, ct *dns.Client, srv string, m *dns.Msg) *dns.Msg {
+	resp, err := exchangeContext(ctx, cu, srv, m)
+	if err == nil && resp.Truncated {
+		resp, err = exchangeContext(ctx, ct, srv, m)
+	}
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// exchangeContext is c.Exchange, aborted when ctx is cancelled.
+func exchangeContext(ctx context.Context, c *dns.Client, srv string, m *dns.Msg) (*dns.Msg, error) {
+	co, err := c.DialContext(ctx, srv)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+	// closing the connection unblocks a pending read
+	stop := context.AfterFunc(ctx, func() { co.Close() })
+	defer stop()
+	resp, _, err := c.ExchangeWithConnContext(ctx, m, co)
+	return resp, err
+}
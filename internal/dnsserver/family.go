@@ -0,0 +1,101 @@
+package dnsserver
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// Address families the iterative resolver may use (Resolver.Family).
+const (
+	FamilyBoth = "both"
+	FamilyV4   = "v4"
+	FamilyV6   = "v6"
+)
+
+// probeV4 and probeV6 are addresses (a.root-servers.net) used to ask the
+// kernel for a route; connecting a UDP socket sends nothing.
+const (
+	probeV4 = "198.41.0.4:53"
+	probeV6 = "[2001:503:ba3e::2:30]:53"
+)
+
+// reachable reports which families this host has a route for, checked once.
+func (r *Resolver) reachable() (v4, v6 bool) {
+	r.reachOnce.Do(func() {
+		r.hasV4, r.hasV6 = canRoute(probeV4), canRoute(probeV6)
+	})
+	return r.hasV4, r.hasV6
+}
+
+func canRoute(addr string) bool {
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// useV4 and useV6 report whether servers of that family should be queried:
+// allowed by Family and, when both are allowed, routable from this host.
+// If neither is routable both are tried anyway.
+func (r *Resolver) useV4() bool {
+	v4, v6 := r.reachable()
+	return r.Family != FamilyV6 && (v4 || !v6 || r.Family == FamilyV4)
+}
+
+func (r *Resolver) useV6() bool {
+	v4, v6 := r.reachable()
+	return r.Family != FamilyV4 && (v6 || !v4 || r.Family == FamilyV6)
+}
+
+// glueTypes are the address types to look up for a server name, IPv6 last.
+func (r *Resolver) glueTypes() []uint16 {
+	var ts []uint16
+	if r.useV4() {
+		ts = append(ts, dns.TypeA)
+	}
+	if r.useV6() {
+		ts = append(ts, dns.TypeAAAA)
+	}
+	return ts
+}
+
+// orderServers drops the servers of families we don't use and interleaves
+// the rest, IPv6 first, so concurrent queries (see exchange) race both
+// families. If that would leave nothing, servers is returned unchanged.
+func (r *Resolver) orderServers(servers []string) []string {
+	var v4, v6 []string
+	for _, s := range servers {
+		ap, err := netip.ParseAddrPort(s)
+		switch {
+		case err != nil:
+			v4 = append(v4, s) // not an address literal; leave it to the dialer
+		case ap.Addr().Unmap().Is4():
+			v4 = append(v4, s)
+		default:
+			v6 = append(v6, s)
+		}
+	}
+	if !r.useV4() {
+		v4 = nil
+	}
+	if !r.useV6() {
+		v6 = nil
+	}
+	if len(v4)+len(v6) == 0 {
+		return servers
+	}
+	out := make([]string, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
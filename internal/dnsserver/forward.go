@@ -0,0 +1,91 @@
+package dnsserver
+
+import (
+	"errors"
+	"log/slog"
+
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// errNoUpstream is a resolution that no server answered.
+var errNoUpstream = errors.New("no upstream answered")
+
+// errDeadline is an iterative resolution that ran past Resolver.Deadline.
+var errDeadline = errors.New("resolution deadline exceeded")
+
+// resolve answers a name outside our zones: through its conditional
+// forwarders if a ForwardZones entry covers it, else through ForwardServers
+// when set, else iteratively from the roots.
+// When it fails, the error says why.
+func (r *Resolver) resolve(log *slog.Logger, qname string, qtype uint16) (*dns.Msg, uint32, error) {
+	if _, servers := r.forwardersFor(qname); servers != nil {
+		return r.forwardTo(log, servers, qname, qtype)
+	}
+	if len(r.ForwardServers) > 0 {
+		return r.forwardResolve(log, qname, qtype)
+	}
+	return r.iterativeResolve(qname, qtype)
+}
+
+// forwardersFor returns the ForwardZones entry for name: the longest suffix
+// covering it, on label boundaries, and its servers.
+func (r *Resolver) forwardersFor(name string) (string, []string) {
+	best := ""
+	var servers []string
+	for suffix, s := range r.ForwardZones {
+		if dns.IsSubDomain(suffix, name) && (servers == nil || len(suffix) > len(best)) {
+			best, servers = suffix, s
+		}
+	}
+	return best, servers
+}
+
+// zoneFor returns the zone that answers qname authoritatively, if any, and
+// whether qname is conditionally forwarded instead: a ForwardZones entry at
+// least as specific as the hosted zone takes precedence over it.
+func (r *Resolver) zoneFor(zones *zone.Store, qname string) (*zone.ZoneIndex, bool) {
+	zi, _ := zones.GetZoneForName(qname)
+	suffix, fwd := r.forwardersFor(qname)
+	if fwd != nil && (zi == nil || len(suffix) >= len(zi.ZoneFQDN)) {
+		return nil, true
+	}
+	return zi, false
+}
+
+// forwardResolve resolves through ForwardServers.
+func (r *Resolver) forwardResolve(log *slog.Logger, qname string, qtype uint16) (*dns.Msg, uint32, error) {
+	return r.forwardTo(log, r.ForwardServers, qname, qtype)
+}
+
+// forwardTo sends the query with RD=1 to each of servers in turn and
+// returns the first answer (NOERROR or NXDOMAIN) with the TTL to cache it
+// for. Servers that fail or answer SERVFAIL/REFUSED are skipped.
+func (r *Resolver) forwardTo(log *slog.Logger, servers []string, qname string, qtype uint16) (*dns.Msg, uint32, error) {
+	name := dns.Fqdn(qname)
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = true
+	clientUDP, clientTCP := r.upstreamClients()
+	for _, srv := range servers {
+		resp, _, err := clientUDP.Exchange(m, srv)
+		if err == nil && resp.Truncated {
+			resp, _, err = clientTCP.Exchange(m, srv)
+		}
+		if err != nil {
+			log.Debug("forwarder failed", "server", srv, "qname", name, "err", err)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			log.Debug("forwarder failed", "server", srv, "qname", name, "rcode", dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		sanitizeUpstream(resp, qtype)
+		if isCompactNXDomain(resp, name) {
+			resp.Rcode = dns.RcodeNameError
+		}
+		return resp, extractMinTTL(resp), nil
+	}
+	return nil, 0, errNoUpstream
+}
@@ -1,117 +1,522 @@
 package dnsserver
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"log/slog"
 	"net"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"smart-dns/internal/acl"
+	"smart-dns/internal/blocklist"
 	"smart-dns/internal/cache"
+	"smart-dns/internal/metrics"
+	"smart-dns/internal/ratelimit"
+	"smart-dns/internal/rpz"
+	"smart-dns/internal/tsig"
+	"smart-dns/internal/weighted"
 	"smart-dns/internal/zone"
 
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/miekg/dns"
 )
 
 type Resolver struct {
 	Logger         *slog.Logger
 	Zones          *zone.Store
-	Cache          *cache.RRCaches[*dns.Msg]
+	Cache          cache.Cache[*dns.Msg]
 	EnableResolver bool
 	RootServers    []string
+	// ForwardServers (host:port), when set, resolve names outside our
+	// zones by forwarding instead of iterating from RootServers.
+	ForwardServers []string
+	// ForwardZones maps domain suffixes (lowercase FQDN) to the servers
+	// names under them are forwarded to, whether or not EnableResolver is
+	// set. The longest suffix wins; one at least as long as a hosted zone
+	// overrides it.
+	ForwardZones map[string][]string
+	// LogTCQueries logs queries arriving with the TC bit set at debug level.
+	LogTCQueries bool
+	// LogMalformed logs the wire bytes of queries we answer with FORMERR
+	// (debug level, truncated to maxLoggedPacket bytes).
+	LogMalformed bool
+	// LocalOnly lists suffixes (lowercase FQDN) that are never resolved
+	// upstream; names under them that we don't host get NXDOMAIN.
+	LocalOnly []string
+	// SpecialUse answers localhost, invalid, local, onion and the RFC 1918
+	// reverse zones locally when no zone covers them (see specialuse.go).
+	SpecialUse bool
+	// DNS64Prefix, when valid, has AAAA queries for names with only A
+	// records answered with those addresses embedded in it (RFC 6147;
+	// see dns64.go).
+	DNS64Prefix netip.Prefix
+	// ServfailTTL caches resolver failures briefly so retrying clients
+	// get a cached SERVFAIL instead of triggering another resolution.
+	ServfailTTL time.Duration
+	// MaxNegativeTTL caps how long resolver NXDOMAIN and NODATA answers
+	// are cached (RFC 2308: the SOA's TTL or MINIMUM, whichever is less);
+	// 0 leaves them uncapped.
+	MaxNegativeTTL time.Duration
+	// LocalRoot, when set, replaces queries to the root servers (RFC 8806).
+	LocalRoot *LocalRoot
+	// ValidateDNSSEC validates iterative answers against TrustAnchors (the
+	// root KSKs when nil): validated answers get AD, bogus ones SERVFAIL.
+	ValidateDNSSEC bool
+	TrustAnchors   []*dns.DS
+	// DrainTTL caps response TTLs while draining so clients move to
+	// another node quickly (0 leaves TTLs alone).
+	DrainTTL uint32
+	// MinimalResponses omits the zone's NS set from the authority section
+	// of positive answers; AdditionalProcessing adds A/AAAA for MX/NS
+	// targets. Zones may override both.
+	MinimalResponses     bool
+	AdditionalProcessing bool
+	// Rotate serves multi-address A/AAAA RRsets round-robin, starting one
+	// address further on each answer. Such answers are then not cached.
+	Rotate bool
+	// Deterministic sorts the records of every RRset we send into
+	// canonical order (see deterministic.go) and turns off rotation and
+	// weighted ordering, so identical queries get identical answers.
+	// Rotate must be off.
+	Deterministic bool
+	// AllowTransfer lists the prefixes allowed to AXFR our zones (empty
+	// refuses all). MaxTransfers caps concurrent transfers and TransferRate
+	// the transfers one peer may start per minute; 0 means unlimited.
+	AllowTransfer acl.List
+	MaxTransfers  int
+	TransferRate  int
+	// TSIGKeys, when non-empty, makes a valid TSIG mandatory for transfers
+	// and dynamic updates.
+	TSIGKeys tsig.Keys
+	// AllowUpdate lists the prefixes allowed to send dynamic updates (empty
+	// refuses all). PersistUpdates writes updated zones back to their file.
+	AllowUpdate    acl.List
+	PersistUpdates bool
+	// CookieSecret keys our DNS server cookies (RFC 7873); nil disables
+	// cookies. RequireCookie only recurses for UDP clients that echo a valid
+	// server cookie: others get BADCOOKIE, or TC=1 without any cookie.
+	CookieSecret  []byte
+	RequireCookie bool
+	// TCPKeepalive is the idle timeout advertised to TCP/DoT clients that
+	// send the EDNS TCP keepalive option (RFC 7828); 0 never advertises.
+	TCPKeepalive time.Duration
+	// TypeLimits caps UDP response size per query type (see TypeLimit).
+	TypeLimits map[uint16]TypeLimit
+
+	// Views are matched in order against the client address; clients
+	// matching none are served from Zones.
+	Views []View
+	// Secondaries are the zones we pull from a primary; a NOTIFY from the
+	// primary triggers an immediate refresh.
+	Secondaries []*zone.TransferClient
+	// AllowQuery restricts who may query at all; AllowRecursion who the
+	// resolver serves (others get REFUSED outside our zones). Empty lists
+	// allow everyone.
+	AllowQuery     acl.List
+	AllowRecursion acl.List
+	// RRL rate-limits UDP responses per client network and response (nil
+	// disables).
+	RRL *ratelimit.Limiter
+	// QueryLog, when set, receives one entry per answered query (the same
+	// entries also go to Logger at debug level).
+	QueryLog *slog.Logger
+	// Blocklist, when set, sinkholes the names it lists (and everything
+	// below them) before any zone or resolver lookup; BlockMode picks the
+	// answer.
+	Blocklist *blocklist.List
+	BlockMode string
+	// RPZ, when set, is a response policy zone consulted before the
+	// blocklist, our zones and the resolver (see rpz.go).
+	RPZ *rpz.Policy
+	// AnyPolicy picks the answer to ANY queries: AnyMinimal (the default),
+	// AnyHINFO or AnyFull.
+	AnyPolicy string
+	// ChaosVersion answers TXT version.bind. and id.server. in the CHAOS
+	// class; empty refuses them like every other CHAOS query.
+	ChaosVersion string
+	// NSID identifies this node (RFC 5001) to clients that ask for it with
+	// the EDNS NSID option; empty sends none.
+	NSID string
+	// Family limits the iterative resolver to IPv4 (FamilyV4) or IPv6
+	// (FamilyV6) servers; both (the default) prefers the families this
+	// host can route.
+	Family string
+	// Parallelism is how many of a zone's servers the iterative resolver
+	// queries at once; the first response wins (<= 1 queries them in turn).
+	Parallelism int
+	// CaseRandomization randomizes the letter case of the iterative
+	// resolver's query names (0x20) and discards responses that don't echo
+	// it exactly.
+	CaseRandomization bool
+	// UDPTimeout and TCPTimeout bound each upstream query (3s and 5s when
+	// zero). Retries is how many more passes the iterative resolver makes
+	// over a step's servers, after a short backoff, when none of them
+	// answered. Deadline caps a whole iterative resolution (0: no cap).
+	UDPTimeout time.Duration
+	TCPTimeout time.Duration
+	Retries    int
+	Deadline   time.Duration
+	// PrefetchHits enables prefetch: resolver answers hit at least this
+	// often are refreshed in the background during the last tenth of their
+	// TTL (0 disables).
+	PrefetchHits uint32
+
+	draining    atomic.Bool
+	xfer        transfers
+	updateMu    sync.Mutex // serializes dynamic updates
+	prefetching sync.Map   // prefetchKey -> in-flight refresh
+	pick        *weighted.Picker
+	dnskeys     keyCache
+	delegations *lru.Cache[string, delegation]
+	reachOnce   sync.Once
+	hasV4       bool
+	hasV6       bool
 }
 
-func NewResolver(l *slog.Logger, zs *zone.Store, c *cache.RRCaches[*dns.Msg]) *Resolver {
-	return &Resolver{Logger: l, Zones: zs, Cache: c}
+func NewResolver(l *slog.Logger, zs *zone.Store, c cache.Cache[*dns.Msg]) *Resolver {
+	return &Resolver{Logger: l, Zones: zs, Cache: c, MinimalResponses: true, AdditionalProcessing: true,
+		pick: weighted.New(uint64(time.Now().UnixNano())), delegations: newDelegationCache()}
 }
 
 func (r *Resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+	source := sourceAuthoritative
+	// Every log line about this query carries its ID, as does its query
+	// log entry, so they can be matched up.
+	id := newRequestID()
+	log := r.Logger.With("req_id", id)
+	var qlw *queryLogWriter
+	if len(req.Question) > 0 && r.logQueries() {
+		qlw = &queryLogWriter{ResponseWriter: w}
+		w = qlw
+	}
+	defer func() {
+		elapsed := time.Since(start)
+		metrics.QueryDuration.Observe(elapsed.Seconds())
+		if qlw != nil {
+			r.logQuery(qlw, req, id, source, elapsed)
+		}
+	}()
 	if len(req.Question) == 0 {
+		r.logMalformed(log, w, req, "no question")
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeFormatError)
+		r.writeMsg(w, req, m)
+		return
+	}
+	if len(req.Question) > 1 {
+		// No one agrees on what several questions would mean; don't
+		// answer just the first.
+		r.logMalformed(log, w, req, "multiple questions")
 		m := new(dns.Msg)
 		m.SetRcode(req, dns.RcodeFormatError)
-		_ = w.WriteMsg(m)
+		r.writeMsg(w, req, m)
+		return
+	}
+	if r.CookieSecret != nil {
+		if _, _, ok := cookieOf(req); !ok {
+			r.logMalformed(log, w, req, "malformed cookie")
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeFormatError)
+			r.writeMsg(w, req, m)
+			return
+		}
+	}
+	if req.Opcode == dns.OpcodeNotify {
+		r.serveNotify(log, w, req)
+		return
+	}
+	if req.Opcode == dns.OpcodeUpdate {
+		r.serveUpdate(log, w, req)
 		return
 	}
 	q := req.Question[0]
 	qname := dns.Fqdn(q.Name)
 	qtype := q.Qtype
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	ecs := clientSubnet(req)
 
-	// Minimal ANY: avoid dumping whole RRsets. Return SOA only.
-	if qtype == dns.TypeANY {
-		resp := new(dns.Msg)
-		resp.SetReply(req)
-		resp.Authoritative = true
-		if zi, _ := r.Zones.GetZoneForName(qname); zi != nil {
-			resp.Ns = append(resp.Ns, r.makeSOA(zi))
+	// TC is meaningless on a query; drop it so only our own size checks
+	// ever decide truncation of the response.
+	if req.Truncated {
+		if r.LogTCQueries {
+			log.Debug("query with TC bit set", "client", w.RemoteAddr().String(), "qname", qname, "qtype", dns.TypeToString[qtype])
 		}
-		_ = w.WriteMsg(resp)
+		req.Truncated = false
+	}
+
+	client := clientAddr(w)
+	if len(r.AllowQuery) > 0 && !r.AllowQuery.Contains(client) {
+		r.refused(w, req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, edeTextNotAllowed)
+		return
+	}
+	if q.Qclass == dns.ClassCHAOS {
+		r.serveChaos(w, req)
+		return
+	}
+	allowRec := len(r.AllowRecursion) == 0 || r.AllowRecursion.Contains(client)
+	cookieOK := !r.RequireCookie || r.CookieSecret == nil || r.cookieValidated(w, req, client)
+	zones, rcache := r.viewFor(client)
+	if r.RPZ != nil && r.serveRPZ(log, w, req, zones, rcache, allowRec && cookieOK) {
+		return
+	}
+	if r.Blocklist != nil && r.Blocklist.Blocked(qname) {
+		r.serveBlocked(w, req)
+		return
+	}
+
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		r.serveTransfer(log, w, req, zones, qname)
 		return
 	}
 
-	if v, ok := r.Cache.GetPositive(qname, qtype); ok {
-		v.Id = req.Id
-		v.RecursionAvailable = false
-		_ = w.WriteMsg(v)
+	if qtype == dns.TypeANY {
+		r.serveANY(w, req, zones, qname)
+		return
+	}
+	if qtype == dns.TypeAAAA && q.Qclass == dns.ClassINET && r.DNS64Prefix.IsValid() && !req.CheckingDisabled {
+		// CD=1 clients validate themselves, which a synthesized answer
+		// would fail.
+		w = &dns64Writer{ResponseWriter: w, log: log, zones: zones, rcache: rcache, recurse: allowRec && cookieOK}
+	}
+
+	// Cached answers are unsigned; DO=1 clients get a freshly built one.
+	// The cache isn't keyed by DO: resolver answers are cached as resolved
+	// (signed when validating, whatever the client's DO), and forClient
+	// strips DNSSEC records and AD for DO=0 clients.
+	// So within a view (Cache.ForView) and an ECS scope (GetPositiveECS)
+	// one entry serves DO=0 and DO=1 clients alike. That's safe: the view
+	// and the client subnet decide which data a name has, while DO only
+	// decides how much of an answer's DNSSEC a client sees, and the entry
+	// always holds all of it, trimmed per client on a copy.
+	v, ok := rcache.GetPositiveECS(qname, qtype, ecs)
+	if ok && !do && (r.EnableResolver || len(r.ForwardZones) > 0) && !(allowRec && cookieOK) {
+		// The cache holds resolver answers too; only in-zone ones are for
+		// clients we don't recurse for (or not without a valid cookie).
+		zi, _ := r.zoneFor(zones, qname)
+		ok = zi != nil
+	}
+	if ok && !do {
+		metrics.CacheHits.WithLabelValues("hit").Inc()
+		source = sourceCache
+		if ecs == nil {
+			r.maybePrefetch(zones, rcache, qname, qtype)
+		}
+		// v is shared with the cache; set the header on a copy.
+		m := forClient(req, v, do).Copy()
+		m.Id = req.Id
+		m.RecursionAvailable = false
+		r.writeMsg(w, req, m)
 		return
 	}
+	metrics.CacheHits.WithLabelValues("miss").Inc()
 
 	resp := new(dns.Msg)
 	resp.SetReply(req)
 	resp.Authoritative = true
 	resp.RecursionAvailable = false
 
-	zi, _ := r.Zones.GetZoneForName(qname)
+	zi, fwd := r.zoneFor(zones, qname)
+	recurse := r.EnableResolver || fwd
 	if zi == nil {
-		if r.EnableResolver {
-			if cached, ok := r.Cache.GetPositive(qname, qtype); ok {
-				cached.Id = req.Id
-				_ = w.WriteMsg(cached)
+		if r.SpecialUse && !fwd && r.serveSpecialUse(w, req, resp, qname, qtype) {
+			return
+		}
+		if r.isLocalOnly(qname) && !fwd {
+			resp.Rcode = dns.RcodeNameError
+			r.writeMsg(w, req, resp)
+			return
+		}
+		if recurse && !allowRec {
+			r.refused(w, req, dns.RcodeRefused, dns.ExtendedErrorCodeNotAuthoritative, edeTextNotAuthoritative)
+			return
+		}
+		if recurse && !cookieOK {
+			r.badCookie(w, req)
+			return
+		}
+		if recurse {
+			source = sourceResolver
+			if cached, ok := rcache.GetPositive(qname, qtype); ok {
+				source = sourceCache
+				r.maybePrefetch(zones, rcache, qname, qtype)
+				m := forClient(req, cached, do).Copy()
+				m.Id = req.Id
+				r.writeMsg(w, req, m)
+				return
+			}
+			for _, rcode := range []int{dns.RcodeNameError, dns.RcodeSuccess} {
+				if denial, ok := rcache.GetNegativeData(qname, qtype, rcode); ok && denial != nil {
+					metrics.CacheHits.WithLabelValues("negative_hit").Inc()
+					metrics.ResolverNegativeHits.Inc()
+					source = sourceCache
+					m := forClient(req, denial, do).Copy()
+					m.Id = req.Id
+					r.writeMsg(w, req, m)
+					return
+				}
+			}
+			if rcache.GetNegative(qname, qtype, dns.RcodeServerFailure) {
+				metrics.CacheHits.WithLabelValues("negative_hit").Inc()
+				if r.serveStale(w, req, rcache, qname, qtype, "cached_failure") {
+					source = sourceStale
+					return
+				}
+				source = sourceCache
+				r.servFail(w, req, dns.ExtendedErrorCodeCachedError, edeTextCachedFailure)
 				return
 			}
-			if m, ttl := r.iterativeResolve(qname, qtype); m != nil {
+			m, ttl, err := r.resolve(log, qname, qtype)
+			if m != nil {
 				m.Id = req.Id
-				_ = w.WriteMsg(m)
-				if m.Rcode == dns.RcodeSuccess && (len(m.Answer) > 0 || len(m.Ns) > 0) {
-					r.Cache.PutPositive(qname, qtype, m.Copy(), time.Duration(ttl)*time.Second)
+				r.writeMsg(w, req, forClient(req, m, do))
+				if negttl, ok := negativeTTL(m); ok {
+					// NODATA is keyed by NOERROR
+					if r.MaxNegativeTTL > 0 && negttl > r.MaxNegativeTTL {
+						negttl = r.MaxNegativeTTL
+					}
+					rcache.PutNegativeData(qname, qtype, m.Rcode, m.Copy(), negttl)
+				} else if m.Rcode == dns.RcodeSuccess && (len(m.Answer) > 0 || len(m.Ns) > 0) && ttl > 0 && !uncacheable(m) {
+					rcache.PutPositive(qname, qtype, m.Copy(), time.Duration(ttl)*time.Second)
 				}
 				return
 			}
+			if r.ServfailTTL > 0 {
+				rcache.PutNegative(qname, qtype, dns.RcodeServerFailure, r.ServfailTTL)
+			}
+			if r.serveStale(w, req, rcache, qname, qtype, "upstream_failed") {
+				source = sourceStale
+				return
+			}
+			code, text := r.upstreamFailure(qname, err)
+			r.servFail(w, req, code, text)
+			return
 		}
-		resp.Rcode = dns.RcodeNameError
-		_ = w.WriteMsg(resp)
+		// Without recursion a name outside our zones isn't ours to deny:
+		// REFUSED, not authoritative, no SOA.
+		r.refused(w, req, dns.RcodeRefused, dns.ExtendedErrorCodeNotAuthoritative, edeTextNotAuthoritative)
 		return
 	}
 
-	ans, addl, rcode, ttl := r.lookup(zi, qname, qtype)
+	ans, addl, rcode, ttl := r.lookup(log, zi, qname, qtype)
 	resp.Rcode = rcode
+	if rcode == dns.RcodeServerFailure {
+		// CNAME loop or unresolvable ALIAS: nothing to cache or deny
+		setEDE(req, resp, dns.ExtendedErrorCodeOther, edeTextUnresolvable)
+		r.writeMsg(w, req, resp)
+		return
+	}
 	if len(ans) > 0 {
 		resp.Answer = ans
 	}
 	if len(addl) > 0 {
 		resp.Extra = append(resp.Extra, addl...)
 	}
-	if rcode == dns.RcodeSuccess && len(ans) > 0 {
-		r.Cache.PutPositive(qname, qtype, resp.Copy(), time.Duration(ttl)*time.Second)
-	} else if rcode != dns.RcodeSuccess {
-		negttl := time.Duration(zi.SOA.NegativeTTL) * time.Second
-		r.Cache.PutNegative(qname, qtype, rcode, negttl)
-		// Attach SOA in authority for negative answers
+	if rcode != dns.RcodeSuccess || len(ans) == 0 || chainNoData(zi, ans, qtype) {
+		// Attach SOA in authority for negative answers (NXDOMAIN and NODATA)
 		resp.Ns = append(resp.Ns, r.makeSOA(zi))
+	} else if len(ans) > 0 && qtype != dns.TypeNS && !r.minimalFor(zi) {
+		// Full responses name the zone's servers in authority
+		if ns := zi.ByName[zi.ZoneFQDN][zone.TypeNS]; ns != nil {
+			nsrrs := toRR(zi.ZoneFQDN, ns)
+			resp.Ns = append(resp.Ns, nsrrs...)
+			if r.additionalFor(zi) {
+				resp.Extra = append(resp.Extra, r.addAdditionals(zi, nsrrs)...)
+			}
+		}
+	}
+	// The zone's TTL floor is applied before caching, so cached copies
+	// carry it as well: the cache hands answers back with the TTLs they
+	// were stored with, never decremented, so they can't age below it.
+	floorTTLs(resp, zi.MinTTL)
+	if rcode == dns.RcodeSuccess && len(ans) > 0 && !r.perQuery(zi, qtype) && !uncacheable(resp) {
+		ttl = max(ttl, zi.MinTTL)
+		rcache.PutPositiveECS(qname, qtype, ecs, resp.Copy(), time.Duration(ttl)*time.Second)
+	} else if rcode != dns.RcodeSuccess && zi.SOA.NegativeTTL > 0 {
+		negttl := time.Duration(zi.SOA.NegativeTTL) * time.Second
+		rcache.PutNegative(qname, qtype, rcode, negttl)
+	}
+	if do && zi.Signed() {
+		resp.SetEdns0(maxUDPSize, true)
+		r.addDNSSEC(zi, resp, qname)
+		floorTTLs(resp, zi.MinTTL)
 	}
-	_ = w.WriteMsg(resp)
+	r.writeMsg(w, req, resp)
 }
 
-func (r *Resolver) lookup(zi *zone.ZoneIndex, qname string, qtype uint16) (ans []dns.RR, addl []dns.RR, rcode int, ttl uint32) {
+// maxLoggedPacket bounds the hex dump of a malformed query.
+const maxLoggedPacket = 512
+
+// logMalformed dumps req at debug level for diagnosing misbehaving clients.
+// miekg/dns doesn't hand us the received bytes, so this is the message
+// re-encoded, which matches the wire form for anything it could parse.
+func (r *Resolver) logMalformed(log *slog.Logger, w dns.ResponseWriter, req *dns.Msg, reason string) {
+	if !r.LogMalformed || !log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	b, err := req.Pack()
+	if err != nil {
+		log.Debug("malformed query", "client", w.RemoteAddr().String(), "reason", reason, "pack_err", err)
+		return
+	}
+	n := len(b)
+	if n > maxLoggedPacket {
+		b = b[:maxLoggedPacket]
+	}
+	log.Debug("malformed query", "client", w.RemoteAddr().String(), "reason", reason, "len", n, "hex", hex.EncodeToString(b))
+}
+
+func (r *Resolver) lookup(log *slog.Logger, zi *zone.ZoneIndex, qname string, qtype uint16) (ans []dns.RR, addl []dns.RR, rcode int, ttl uint32) {
 	name := strings.ToLower(dns.Fqdn(qname))
-	maxCNAME := 8
 	visited := map[string]struct{}{}
 	cur := name
-	for i := 0; i < maxCNAME; i++ {
+	for i := 0; i <= zone.MaxCNAMEChain; i++ { // the chain, then its target
+		if owner, dname := r.findDNAME(zi, cur); dname != nil {
+			// Names below a DNAME are redirected (RFC 6672): answer with
+			// the DNAME and a CNAME synthesized from it, then follow that.
+			if _, seen := visited[cur]; seen {
+				return nil, nil, dns.RcodeServerFailure, 0
+			}
+			visited[cur] = struct{}{}
+			target := strings.TrimSuffix(cur, owner) + dname.DNAME
+			if len(target) > 255 {
+				return nil, nil, dns.RcodeYXDomain, 0
+			}
+			ans = append(ans, toRR(owner, dname)...)
+			ans = append(ans, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: cur, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: dname.TTL},
+				Target: target,
+			})
+			ttl = min(ttl, dname.TTL)
+			cur = target
+			continue
+		}
 		rrset, t, ok := r.findRRSet(zi, cur, qtype)
 		if ok {
 			ans = append(ans, rrset...)
 			// Additional for MX/NS
-			addl = append(addl, r.addAdditionals(zi, rrset)...)
-			return ans, addl, dns.RcodeSuccess, t
+			if r.additionalFor(zi) {
+				addl = append(addl, r.addAdditionals(zi, rrset)...)
+			}
+			return ans, addl, dns.RcodeSuccess, min(ttl, t)
+		}
+		if alias := zi.ByName[cur][zone.TypeALIAS]; alias != nil && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+			addrs, t, ok := r.resolveAlias(log, zi, cur, alias, qtype)
+			if !ok {
+				return nil, nil, dns.RcodeServerFailure, 0
+			}
+			if len(addrs) > 0 {
+				return append(ans, addrs...), nil, dns.RcodeSuccess, min(ttl, t)
+			}
+			break // NODATA
 		}
 		// Try CNAME at this name
 		if _, seen := visited[cur]; seen {
@@ -131,49 +536,125 @@ func (r *Resolver) lookup(zi *zone.ZoneIndex, qname string, qtype uint16) (ans [
 		}
 		break
 	}
-	// NX or NODATA
-	if r.hasName(zi, name) || r.hasWildcardCandidate(zi, name) {
-		return nil, nil, dns.RcodeSuccess, 0 // NODATA; SOA will be attached by caller
+	// The rest of a chain leaving the zone is for the client to resolve
+	if len(ans) > 0 && !dns.IsSubDomain(zi.ZoneFQDN, cur) {
+		return ans, nil, dns.RcodeSuccess, ttl
+	}
+	// NX or NODATA, for the name the chain (if any) ended at
+	if r.hasName(zi, cur) || r.hasWildcardCandidate(zi, cur) {
+		return ans, nil, dns.RcodeSuccess, ttl // NODATA; SOA will be attached by caller
+	}
+	return ans, nil, dns.RcodeNameError, ttl
+}
+
+// chainNoData reports whether ans is a CNAME chain that ends inside zi
+// without reaching data of qtype, i.e. NODATA for the chain's last name.
+func chainNoData(zi *zone.ZoneIndex, ans []dns.RR, qtype uint16) bool {
+	if len(ans) == 0 || qtype == dns.TypeCNAME {
+		return false
+	}
+	c, ok := ans[len(ans)-1].(*dns.CNAME)
+	return ok && dns.IsSubDomain(zi.ZoneFQDN, strings.ToLower(c.Target))
+}
+
+// findDNAME returns the DNAME owned by a proper ancestor of name inside zi.
+// Names below a DNAME owner are occluded, so the one closest to the apex
+// wins.
+func (r *Resolver) findDNAME(zi *zone.ZoneIndex, name string) (string, *zone.RRSet) {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i > 0; i-- {
+		owner := strings.Join(labels[i:], ".") + "."
+		if !dns.IsSubDomain(zi.ZoneFQDN, owner) {
+			continue
+		}
+		if rs := zi.ByName[owner][zone.TypeDNAME]; rs != nil {
+			return owner, rs
+		}
 	}
-	return nil, nil, dns.RcodeNameError, 0
+	return "", nil
 }
 
 func (r *Resolver) findRRSet(zi *zone.ZoneIndex, name string, qtype uint16) (rrs []dns.RR, ttl uint32, ok bool) {
-	// Exact name
+	// SOA exists only at the apex; below it the caller answers NODATA
+	if qtype == dns.TypeSOA {
+		if name != zi.ZoneFQDN {
+			return nil, 0, false
+		}
+		soa := r.makeSOA(zi)
+		return []dns.RR{soa}, soa.Header().Ttl, true
+	}
+	// Exact name; a name that exists is never answered from a wildcard
 	if m := zi.ByName[name]; m != nil {
 		if rr, ok2 := m[toRRType(qtype)]; ok2 {
-			return toRR(name, rr), rr.TTL, true
+			return r.answerRR(name, rr), rr.TTL, true
 		}
+		return nil, 0, false
 	}
-	// Wildcard: *.closest
-	labels := dns.SplitDomainName(name)
-	for i := 0; i < len(labels)-1; i++ {
-		wc := "*." + strings.Join(labels[i+1:], ".") + "."
-		if m := zi.ByName[wc]; m != nil {
-			if rr, ok2 := m[toRRType(qtype)]; ok2 {
-				return toRR(name, rr), rr.TTL, true
-			}
-			if rr, ok2 := m[zone.TypeCNAME]; ok2 {
-				return toRR(name, rr), rr.TTL, true
-			}
+	// Wildcard, synthesized with name as owner. A wildcard CNAME isn't an
+	// answer for other types; lookup follows it.
+	if m := r.wildcardFor(zi, name); m != nil {
+		if rr, ok2 := m[toRRType(qtype)]; ok2 {
+			return r.answerRR(name, rr), rr.TTL, true
 		}
 	}
 	return nil, 0, false
 }
 
-func (r *Resolver) hasName(zi *zone.ZoneIndex, name string) bool { _, ok := zi.ByName[name]; return ok }
+func (r *Resolver) minimalFor(zi *zone.ZoneIndex) bool {
+	if zi.MinimalResponses != nil {
+		return *zi.MinimalResponses
+	}
+	return r.MinimalResponses
+}
 
-func (r *Resolver) hasWildcardCandidate(zi *zone.ZoneIndex, name string) bool {
-	labels := dns.SplitDomainName(name)
-	for i := 0; i < len(labels)-1; i++ {
-		wc := "*." + strings.Join(labels[i+1:], ".") + "."
-		if _, ok := zi.ByName[wc]; ok {
+func (r *Resolver) additionalFor(zi *zone.ZoneIndex) bool {
+	if zi.AdditionalProcessing != nil {
+		return *zi.AdditionalProcessing
+	}
+	return r.AdditionalProcessing
+}
+
+func (r *Resolver) isLocalOnly(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range r.LocalOnly {
+		if dns.IsSubDomain(suffix, name) {
 			return true
 		}
 	}
 	return false
 }
 
+// hasName reports whether name exists in zi, with records or as an empty
+// non-terminal.
+func (r *Resolver) hasName(zi *zone.ZoneIndex, name string) bool {
+	_, ok := zi.ByName[name]
+	return ok || zi.EmptyNonTerminal(name)
+}
+
+// hasWildcardCandidate reports whether a wildcard answers for name, which
+// doesn't exist: a query for a type it lacks is then NODATA, not NXDOMAIN.
+func (r *Resolver) hasWildcardCandidate(zi *zone.ZoneIndex, name string) bool {
+	return r.wildcardFor(zi, name) != nil
+}
+
+// wildcardFor returns the records of the wildcard that applies to name,
+// which doesn't exist in zi: the one directly below its closest encloser
+// (RFC 4592), if that holds any records. Wildcards further up don't apply.
+func (r *Resolver) wildcardFor(zi *zone.ZoneIndex, name string) map[zone.RRType]*zone.RRSet {
+	ce := r.closestEncloser(zi, name)
+	if ce == name {
+		return nil
+	}
+	wc := "*." + ce
+	if ce == "." {
+		wc = "*."
+	}
+	if m := zi.ByName[wc]; len(m) > 0 {
+		return m
+	}
+	return nil
+}
+
 func toRRType(qt uint16) zone.RRType {
 	switch qt {
 	case dns.TypeA:
@@ -190,11 +671,58 @@ func toRRType(qt uint16) zone.RRType {
 		return zone.TypeTXT
 	case dns.TypeSRV:
 		return zone.TypeSRV
+	case dns.TypePTR:
+		return zone.TypePTR
+	case dns.TypeCAA:
+		return zone.TypeCAA
+	case dns.TypeSVCB:
+		return zone.TypeSVCB
+	case dns.TypeHTTPS:
+		return zone.TypeHTTPS
+	case dns.TypeDNAME:
+		return zone.TypeDNAME
+	case dns.TypeHINFO:
+		return zone.TypeHINFO
+	case dns.TypeLOC:
+		return zone.TypeLOC
+	case dns.TypeNAPTR:
+		return zone.TypeNAPTR
+	case dns.TypeDNSKEY:
+		return zone.TypeDNSKEY
+	case dns.TypeDS:
+		return zone.TypeDS
+	case dns.TypeRRSIG:
+		return zone.TypeRRSIG
+	case dns.TypeNSEC:
+		return zone.TypeNSEC
 	default:
 		return zone.RRType("")
 	}
 }
 
+// answerRR is toRR for answer records, applying weighted selection or
+// round-robin rotation.
+func (r *Resolver) answerRR(name string, rrset *zone.RRSet) []dns.RR {
+	rrs := toRR(name, rrset)
+	if r.Deterministic {
+		return rrs
+	}
+	if len(rrset.Weights) == len(rrs) && len(rrs) > 1 {
+		return r.weightedOrder(rrs, rrset.Weights)
+	}
+	if !r.Rotate || len(rrs) < 2 || (rrset.Type != zone.TypeA && rrset.Type != zone.TypeAAAA) {
+		return rrs
+	}
+	n := rrset.NextRotation() % len(rrs)
+	return append(rrs[n:], rrs[:n]...)
+}
+
+// perQuery reports whether answers to qtype from zi may be rotated or
+// weighted, and so must be built per query rather than served from cache.
+func (r *Resolver) perQuery(zi *zone.ZoneIndex, qtype uint16) bool {
+	return !r.Deterministic && (r.Rotate || zi.Weighted) && (qtype == dns.TypeA || qtype == dns.TypeAAAA)
+}
+
 func toRR(name string, rrset *zone.RRSet) []dns.RR {
 	var out []dns.RR
 	switch rrset.Type {
@@ -217,6 +745,11 @@ func toRR(name string, rrset *zone.RRSet) []dns.RR {
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rrset.TTL}
 		r.Target = rrset.CNAME
 		out = append(out, r)
+	case zone.TypeDNAME:
+		r := new(dns.DNAME)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: rrset.TTL}
+		r.Target = rrset.DNAME
+		out = append(out, r)
 	case zone.TypeNS:
 		for _, ns := range rrset.NS {
 			r := new(dns.NS)
@@ -224,6 +757,13 @@ func toRR(name string, rrset *zone.RRSet) []dns.RR {
 			r.Ns = ns
 			out = append(out, r)
 		}
+	case zone.TypePTR:
+		for _, ptr := range rrset.PTR {
+			r := new(dns.PTR)
+			r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rrset.TTL}
+			r.Ptr = ptr
+			out = append(out, r)
+		}
 	case zone.TypeTXT:
 		for _, s := range rrset.TXT {
 			r := new(dns.TXT)
@@ -249,6 +789,65 @@ func toRR(name string, rrset *zone.RRSet) []dns.RR {
 			r.Target = s.Target
 			out = append(out, r)
 		}
+	case zone.TypeCAA:
+		for _, c := range rrset.CAA {
+			r := new(dns.CAA)
+			r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: rrset.TTL}
+			r.Flag = c.Flag
+			r.Tag = c.Tag
+			r.Value = c.Value
+			out = append(out, r)
+		}
+	case zone.TypeSVCB:
+		for _, s := range rrset.SVCB {
+			r := new(dns.SVCB)
+			r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: rrset.TTL}
+			r.Priority = s.Priority
+			r.Target = s.Target
+			r.Value = s.Value
+			out = append(out, r)
+		}
+	case zone.TypeHTTPS:
+		for _, s := range rrset.SVCB {
+			r := new(dns.HTTPS)
+			r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: rrset.TTL}
+			r.Priority = s.Priority
+			r.Target = s.Target
+			r.Value = s.Value
+			out = append(out, r)
+		}
+	case zone.TypeHINFO:
+		for _, h := range rrset.HINFO {
+			r := new(dns.HINFO)
+			r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: rrset.TTL}
+			r.Cpu = h.CPU
+			r.Os = h.OS
+			out = append(out, r)
+		}
+	case zone.TypeLOC:
+		for _, l := range rrset.LOC {
+			r := l.Wire
+			r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeLOC, Class: dns.ClassINET, Ttl: rrset.TTL}
+			out = append(out, &r)
+		}
+	case zone.TypeNAPTR:
+		for _, x := range rrset.NAPTR {
+			r := new(dns.NAPTR)
+			r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeNAPTR, Class: dns.ClassINET, Ttl: rrset.TTL}
+			r.Order = x.Order
+			r.Preference = x.Preference
+			r.Flags = x.Flags
+			r.Service = x.Service
+			r.Regexp = x.Regexp
+			r.Replacement = x.Replacement
+			out = append(out, r)
+		}
+	case zone.TypeDNSKEY, zone.TypeDS, zone.TypeRRSIG, zone.TypeNSEC:
+		for _, rr := range rrset.RR {
+			c := dns.Copy(rr)
+			c.Header().Name = name
+			out = append(out, c)
+		}
 	}
 	return out
 }
@@ -261,11 +860,47 @@ func (r *Resolver) addAdditionals(zi *zone.ZoneIndex, answers []dns.RR) []dns.RR
 			extra = append(extra, r.lookupAorAAAA(zi, x.Mx)...)
 		case *dns.NS:
 			extra = append(extra, r.lookupAorAAAA(zi, x.Ns)...)
+		case *dns.SVCB:
+			extra = append(extra, r.svcbAdditionals(zi, &x.Hdr, x.Target, x.Value)...)
+		case *dns.HTTPS:
+			extra = append(extra, r.svcbAdditionals(zi, &x.Hdr, x.Target, x.Value)...)
 		}
 	}
 	return extra
 }
 
+// svcbAdditionals returns the A/AAAA records of an SVCB/HTTPS target ("."
+// means the owner name itself, RFC 9460 section 2.5): the zone's own
+// addresses for in-zone targets like MX glue, else the ipv4hint/ipv6hint
+// params.
+func (r *Resolver) svcbAdditionals(zi *zone.ZoneIndex, hdr *dns.RR_Header, target string, kv []dns.SVCBKeyValue) []dns.RR {
+	if target == "." {
+		target = hdr.Name
+	}
+	if glue := r.lookupAorAAAA(zi, target); len(glue) > 0 {
+		return glue
+	}
+	return svcbHints(hdr, target, kv)
+}
+
+// svcbHints turns ipv4hint/ipv6hint SvcParams into A/AAAA records for target.
+func svcbHints(hdr *dns.RR_Header, target string, kv []dns.SVCBKeyValue) []dns.RR {
+	var out []dns.RR
+	for _, p := range kv {
+		switch h := p.(type) {
+		case *dns.SVCBIPv4Hint:
+			for _, ip := range h.Hint {
+				out = append(out, &dns.A{Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: hdr.Ttl}, A: ip})
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, ip := range h.Hint {
+				out = append(out, &dns.AAAA{Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: hdr.Ttl}, AAAA: ip})
+			}
+		}
+	}
+	return out
+}
+
 func (r *Resolver) lookupAorAAAA(zi *zone.ZoneIndex, host string) []dns.RR {
 	name := strings.ToLower(dns.Fqdn(host))
 	var out []dns.RR
@@ -306,44 +941,98 @@ func min(a, b uint32) uint32 {
 	return b
 }
 
-// Iterative resolver using root servers, referrals and glue.
-func (r *Resolver) iterativeResolve(qname string, qtype uint16) (*dns.Msg, uint32) {
+// Iterative resolver using root servers, referrals and glue. With
+// ValidateDNSSEC the walk also follows the chain of trust from the root
+// anchors: a validated answer comes back with AD set, one that fails
+// validation as errBogus.
+func (r *Resolver) iterativeResolve(qname string, qtype uint16) (*dns.Msg, uint32, error) {
 	if len(r.RootServers) == 0 {
-		return nil, 0
+		return nil, 0, errNoUpstream
 	}
+	ctx := context.Background()
+	if r.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Deadline)
+		defer cancel()
+	}
+	if d, ok := r.closestDelegation(dns.Fqdn(qname), qtype); ok {
+		m, ttl, err := r.iterate(ctx, qname, qtype, d)
+		if !errors.Is(err, errNoUpstream) {
+			return m, ttl, err
+		}
+		// The cached servers may be gone; start over from the roots.
+		r.forgetDelegation(d.zone)
+	}
+	return r.iterate(ctx, qname, qtype, delegation{zone: ".", servers: r.RootServers, ds: r.trustAnchors()})
+}
+
+// iterate resolves qname starting at the zone cut start, giving up with
+// errDeadline once ctx is done.
+func (r *Resolver) iterate(ctx context.Context, qname string, qtype uint16, start delegation) (*dns.Msg, uint32, error) {
+	metrics.ResolverStartDepth.Observe(float64(dns.CountLabel(start.zone)))
 	name := dns.Fqdn(qname)
-	servers := append([]string(nil), r.RootServers...)
-	ttlMin := uint32(0)
+	servers := r.orderServers(start.servers)
+	// chainTTL is the lowest TTL of the CNAMEs followed so far; chained
+	// says there are any. 0 is a real TTL here, not "unset".
+	var chainTTL uint32
+	chained := false
 	maxDepth := 16
-	clientUDP := &dns.Client{Net: "udp", Timeout: 3 * time.Second}
-	clientTCP := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	clientUDP, clientTCP := r.upstreamClients()
+
+	var v *validator
+	cut := start.zone
+	atRoot := cut == "."
+	if r.ValidateDNSSEC {
+		v = &validator{r: r, ctx: ctx, cu: clientUDP, ct: clientTCP, secure: true}
+		// A local root copy is trusted as loaded; otherwise the cut's keys
+		// must match its DS (the trust anchors at the root).
+		if !atRoot || r.LocalRoot == nil {
+			if err := v.enter(cut, servers, start.ds); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
 
 	for depth := 0; depth < maxDepth; depth++ {
 		// query current server set
 		var resp *dns.Msg
-		for _, srv := range servers {
+		local := atRoot && r.LocalRoot != nil
+		if local {
+			resp = r.LocalRoot.Answer(name, qtype)
+		} else {
+			sent := name
+			if r.CaseRandomization {
+				sent = randomCase(name)
+			}
 			m := new(dns.Msg)
-			m.SetQuestion(name, qtype)
+			m.SetQuestion(sent, qtype)
 			m.RecursionDesired = false
-			r1, _, err := clientUDP.Exchange(m, srv)
-			if err != nil {
-				continue
+			if v != nil {
+				m.SetEdns0(maxUDPSize, true)
 			}
-			if r1.Truncated {
-				r1, _, err = clientTCP.Exchange(m, srv)
-				if err != nil {
-					continue
-				}
+			resp = r.exchange(ctx, clientUDP, clientTCP, servers, m)
+			if resp != nil && sent != name {
+				restoreCase(resp, sent, name)
 			}
-			resp = r1
-			break
+		}
+		if ctx.Err() != nil {
+			return nil, 0, errDeadline
 		}
 		if resp == nil {
-			return nil, 0
+			return nil, 0, errNoUpstream
+		}
+		sanitizeUpstream(resp, qtype)
+		referral := len(resp.Answer) == 0 && isReferral(resp)
+		if v != nil && v.keys != nil && !local && !referral {
+			if err := v.check(resp, cut); err != nil {
+				return nil, 0, err
+			}
 		}
-		// NXDOMAIN
-		if resp.Rcode == dns.RcodeNameError {
-			return resp, extractMinTTL(resp)
+		// NXDOMAIN, including compact denial (NOERROR + NSEC with NXNAME)
+		if resp.Rcode == dns.RcodeNameError || isCompactNXDomain(resp, name) {
+			resp.Rcode = dns.RcodeNameError
+			resp.AuthenticatedData = v.done()
+			return resp, extractMinTTL(resp), nil
 		}
 		// Answer
 		if len(resp.Answer) > 0 {
@@ -354,64 +1043,84 @@ func (r *Resolver) iterativeResolve(qname string, qtype uint16) (*dns.Msg, uint3
 					if rr.Header().Rrtype == qtype {
 						hasFinal = true
 					}
-					t := rr.Header().Ttl
-					ttlMin = min(ttlMin, t)
 				}
 				if !hasFinal {
 					// follow first CNAME target
 					for _, rr := range resp.Answer {
 						if c, ok := rr.(*dns.CNAME); ok {
 							name = dns.Fqdn(c.Target)
-							ttlMin = min(ttlMin, rr.Header().Ttl)
+							if ttl := extractMinTTL(resp); !chained || ttl < chainTTL {
+								chainTTL, chained = ttl, true
+							}
 							// keep same servers and continue
 							goto next
 						}
 					}
 				}
-			} else {
-				for _, rr := range resp.Answer {
-					ttlMin = min(ttlMin, rr.Header().Ttl)
-				}
 			}
-			return resp, ternaryTTL(ttlMin, 60)
+			resp.AuthenticatedData = v.done()
+			ttl := extractMinTTL(resp)
+			if chained && chainTTL < ttl {
+				ttl = chainTTL
+			}
+			return resp, ttl, nil
 		}
 		// Referral: use NS in Authority and glue from Additional
-		if len(resp.Ns) > 0 {
+		if referral {
 			nsNames := make([]string, 0, len(resp.Ns))
+			child := ""
 			for _, rr := range resp.Ns {
 				if rr.Header().Rrtype == dns.TypeNS {
 					ns := rr.(*dns.NS).Ns
 					nsNames = append(nsNames, ns)
+					child = rr.Header().Name
 				}
 			}
-			nextServers := pickGlue(resp, nsNames)
+			nextServers := r.orderServers(pickGlue(resp, nsNames))
 			if len(nextServers) == 0 {
 				// try to resolve glue via current servers
 				for _, nsn := range nsNames {
-					if aips := r.lookupGlueA(clientUDP, clientTCP, servers, nsn); len(aips) > 0 {
-						for _, ip := range aips {
+					for _, t := range r.glueTypes() {
+						for _, ip := range r.lookupGlue(ctx, clientUDP, clientTCP, servers, nsn, t) {
 							nextServers = append(nextServers, net.JoinHostPort(ip.String(), "53"))
 						}
+					}
+					if len(nextServers) > 0 {
+						nextServers = r.orderServers(nextServers)
 						break
 					}
 				}
 			}
 			if len(nextServers) == 0 {
-				return nil, 0
+				return nil, 0, errNoUpstream
+			}
+			var ds []*dns.DS
+			if v != nil && (v.keys != nil || local) {
+				ds = localDS(resp, child)
+				if !local {
+					var err error
+					if ds, err = v.referral(resp, cut, child); err != nil {
+						return nil, 0, err
+					}
+				}
+				if err := v.enter(child, nextServers, ds); err != nil {
+					return nil, 0, err
+				}
 			}
+			r.rememberDelegation(resp, child, nextServers, ds)
+			cut = child
 			servers = nextServers
+			atRoot = false
 			// continue
 			goto next
 		}
-		// NODATA but with SOA in authority -> return
-		if len(resp.Ns) > 0 {
-			return resp, extractMinTTL(resp)
-		}
-		return resp, extractMinTTL(resp)
+		// NODATA (SOA in authority) or an upstream error -> return
+		resp.AuthenticatedData = v.done()
+		return resp, extractMinTTL(resp), nil
 	next:
 		continue
 	}
-	return nil, 0
+	return nil, 0, errNoUpstream
 }
 
 func pickGlue(resp *dns.Msg, nsNames []string) []string {
@@ -442,25 +1151,20 @@ func pickGlue(resp *dns.Msg, nsNames []string) []string {
 	return glue
 }
 
-func (r *Resolver) lookupGlueA(cu, ct *dns.Client, servers []string, host string) []net.IP {
+// lookupGlue asks servers for the A or AAAA (qtype) addresses of host.
+func (r *Resolver) lookupGlue(ctx context.Context, cu, ct *dns.Client, servers []string, host string, qtype uint16) []net.IP {
 	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	m.SetQuestion(dns.Fqdn(host), qtype)
 	m.RecursionDesired = false
 	for _, srv := range servers {
-		resp, _, err := cu.Exchange(m, srv)
-		if err != nil {
+		resp := exchangeOne(ctx, cu, ct, srv, m)
+		if resp == nil {
 			continue
 		}
-		if resp.Truncated {
-			resp, _, err = ct.Exchange(m, srv)
-			if err != nil {
-				continue
-			}
-		}
 		var ips []net.IP
 		for _, a := range resp.Answer {
-			if ar, ok := a.(*dns.A); ok {
-				ips = append(ips, ar.A)
+			if ip := addrOf(a, qtype); ip != nil {
+				ips = append(ips, ip)
 			}
 		}
 		if len(ips) > 0 {
@@ -468,30 +1172,41 @@ func (r *Resolver) lookupGlueA(cu, ct *dns.Client, servers []string, host string
 		}
 		// follow referrals quickly by reading extras
 		for _, ex := range resp.Extra {
-			if ar, ok := ex.(*dns.A); ok {
-				return []net.IP{ar.A}
+			if ip := addrOf(ex, qtype); ip != nil {
+				return []net.IP{ip}
 			}
 		}
 	}
 	return nil
 }
 
-func extractMinTTL(m *dns.Msg) uint32 {
-	ttl := uint32(0)
-	for _, s := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
-		for _, rr := range s {
-			ttl = min(ttl, rr.Header().Ttl)
+// addrOf returns the address in rr if it is an A or AAAA record of qtype.
+func addrOf(rr dns.RR, qtype uint16) net.IP {
+	switch x := rr.(type) {
+	case *dns.A:
+		if qtype == dns.TypeA {
+			return x.A
+		}
+	case *dns.AAAA:
+		if qtype == dns.TypeAAAA {
+			return x.AAAA
 		}
 	}
-	if ttl == 0 {
-		ttl = 60
-	}
-	return ttl
+	return nil
 }
 
-func ternaryTTL(v uint32, def uint32) uint32 {
-	if v == 0 {
-		return def
+// extractMinTTL is how long to cache an upstream response: its smallest
+// TTL, so a TTL-0 record makes it uncacheable, or 60s without records.
+func extractMinTTL(m *dns.Msg) uint32 {
+	if ttl, ok := minTTL(m); ok {
+		return ttl
 	}
-	return v
+	return 60
+}
+
+// uncacheable reports whether m holds a TTL-0 record: such records are
+// meant to be used once and never cached (RFC 1035 3.2.1).
+func uncacheable(m *dns.Msg) bool {
+	ttl, ok := minTTL(m)
+	return ok && ttl == 0
 }
@@ -0,0 +1,559 @@
+package dnsserver
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"smart-dns/internal/cache"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is the zone most tests answer from; records are added per test.
+const testZone = `{
+  "zone": "example.com.",
+  "serial": 1,
+  "ttl_default": 300,
+  "soa": {"mname": "ns1.example.com.", "rname": "hostmaster.example.com.",
+          "refresh": 3600, "retry": 600, "expire": 604800, "negative_ttl": 300},
+  "ns": ["ns1.example.com."],
+  "records": [
+    {"name": "ns1", "type": "A", "values": ["192.0.2.53"]}
+  ]
+}`
+
+// loadZone indexes the JSON zone file src, with records (a JSON array of
+// record objects) appended to its own.
+func loadZone(t testing.TB, src, records string) *zone.ZoneIndex {
+	t.Helper()
+	var zf zone.ZoneFile
+	if err := json.Unmarshal([]byte(src), &zf); err != nil {
+		t.Fatal(err)
+	}
+	if records != "" {
+		var extra []zone.RawRecord
+		if err := json.Unmarshal([]byte(records), &extra); err != nil {
+			t.Fatal(err)
+		}
+		zf.Records = append(zf.Records, extra...)
+	}
+	zi, err := zf.ToIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zi
+}
+
+// newTestResolver returns a resolver serving zones, with a cache of its own.
+func newTestResolver(t testing.TB, zones ...*zone.ZoneIndex) (*Resolver, *cache.RRCaches[*dns.Msg]) {
+	t.Helper()
+	zs := zone.NewStore()
+	for _, zi := range zones {
+		zs.SwapZone(zi)
+	}
+	c, err := cache.NewRRCaches[*dns.Msg](1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewResolver(slog.New(slog.NewTextHandler(io.Discard, nil)), zs, c), c
+}
+
+// recorder is a dns.ResponseWriter keeping what the handler wrote.
+type recorder struct {
+	msg *dns.Msg
+}
+
+func (w *recorder) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *recorder) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+}
+func (w *recorder) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *recorder) Write([]byte) (int, error) { return 0, nil }
+func (w *recorder) Close() error              { return nil }
+func (w *recorder) TsigStatus() error         { return nil }
+func (w *recorder) TsigTimersOnly(bool)       {}
+func (w *recorder) Hijack()                   {}
+
+// serve sends req through r and returns the response.
+func serve(t testing.TB, r *Resolver, req *dns.Msg) *dns.Msg {
+	t.Helper()
+	w := &recorder{}
+	r.ServeDNS(w, req)
+	if w.msg == nil {
+		t.Fatalf("no response to %v", req.Question)
+	}
+	return w.msg
+}
+
+// query asks r for name and qtype.
+func query(t testing.TB, r *Resolver, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return serve(t, r, req)
+}
+
+func TestMinTTLFloor(t *testing.T) {
+	zi := loadZone(t, testZone, `[
+    {"name": "www", "type": "A", "ttl": 5, "values": ["192.0.2.1"]},
+    {"name": "slow", "type": "A", "ttl": 3600, "values": ["192.0.2.2"]}
+  ]`)
+	zi.MinTTL = 60
+	r, c := newTestResolver(t, zi)
+
+	// The cache keeps answers with the TTLs they were stored with, so the
+	// floor applied before caching holds however long the entry lives.
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(1100 * time.Millisecond)
+		}
+		resp := query(t, r, "www.example.com.", dns.TypeA)
+		if len(resp.Answer) != 1 {
+			t.Fatalf("answer %v, want one A", resp.Answer)
+		}
+		if ttl := resp.Answer[0].Header().Ttl; ttl != 60 {
+			t.Errorf("query %d: TTL %d, want the 60s floor", i+1, ttl)
+		}
+		cached, ok := c.GetPositive("www.example.com.", dns.TypeA)
+		if !ok {
+			t.Fatalf("query %d: answer not cached", i+1)
+		}
+		if ttl := cached.Answer[0].Header().Ttl; ttl != 60 {
+			t.Errorf("query %d: cached with TTL %d, want the 60s floor", i+1, ttl)
+		}
+	}
+
+	resp := query(t, r, "slow.example.com.", dns.TypeA)
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 3600 {
+		t.Errorf("TTL %d above the floor changed, want 3600", ttl)
+	}
+}
+
+func TestZoneResponseOverrides(t *testing.T) {
+	on, off := true, false
+	records := `[
+    {"name": "@", "type": "MX", "values": [{"preference": 10, "host": "mail.example.com."}]},
+    {"name": "mail", "type": "A", "values": ["192.0.2.25"]}
+  ]`
+	tests := []struct {
+		name                 string
+		minimal, additional  bool  // server-wide
+		zoneMin, zoneAddl    *bool // the zone's overrides
+		wantNS, wantMailGlue bool
+	}{
+		{"defaults", true, true, nil, nil, false, true},
+		{"zone not minimal", true, true, &off, nil, true, true},
+		{"zone minimal", false, true, &on, nil, false, true},
+		{"zone without additionals", true, true, nil, &off, false, false},
+		{"zone with additionals", true, false, nil, &on, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zi := loadZone(t, testZone, records)
+			zi.MinimalResponses, zi.AdditionalProcessing = tt.zoneMin, tt.zoneAddl
+			r, _ := newTestResolver(t, zi)
+			r.MinimalResponses, r.AdditionalProcessing = tt.minimal, tt.additional
+
+			resp := query(t, r, "example.com.", dns.TypeMX)
+			if len(resp.Answer) != 1 {
+				t.Fatalf("answer %v, want the MX", resp.Answer)
+			}
+			gotNS := false
+			for _, rr := range resp.Ns {
+				gotNS = gotNS || rr.Header().Rrtype == dns.TypeNS
+			}
+			if gotNS != tt.wantNS {
+				t.Errorf("NS in authority: %v, want %v", gotNS, tt.wantNS)
+			}
+			gotGlue := false
+			for _, rr := range resp.Extra {
+				gotGlue = gotGlue || rr.Header().Name == "mail.example.com."
+			}
+			if gotGlue != tt.wantMailGlue {
+				t.Errorf("mail.example.com A in additional: %v, want %v", gotGlue, tt.wantMailGlue)
+			}
+		})
+	}
+}
+
+func TestSOAQueries(t *testing.T) {
+	r, _ := newTestResolver(t, loadZone(t, testZone, `[
+    {"name": "sub", "type": "A", "values": ["192.0.2.7"]}
+  ]`))
+	tests := []struct {
+		name       string
+		wantAnswer bool // else NODATA with the SOA in authority
+	}{
+		{"example.com.", true},
+		{"sub.example.com.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := query(t, r, tt.name, dns.TypeSOA)
+			if resp.Rcode != dns.RcodeSuccess {
+				t.Fatalf("rcode %s, want NOERROR", dns.RcodeToString[resp.Rcode])
+			}
+			section := resp.Ns
+			if tt.wantAnswer {
+				section = resp.Answer
+			} else if len(resp.Answer) > 0 {
+				t.Errorf("answer %v, want none", resp.Answer)
+			}
+			if len(section) != 1 {
+				t.Fatalf("got %v, want one SOA", section)
+			}
+			soa, ok := section[0].(*dns.SOA)
+			if !ok || soa.Hdr.Name != "example.com." || soa.Ns != "ns1.example.com." {
+				t.Errorf("got %v, want the example.com. SOA", section[0])
+			}
+		})
+	}
+}
+
+func TestApexHTTPS(t *testing.T) {
+	r, _ := newTestResolver(t, loadZone(t, testZone, `[
+    {"name": "@", "type": "HTTPS", "values": [{"priority": 1, "target": ".",
+      "params": {"alpn": "h2,h3", "ipv4hint": "192.0.2.10", "ipv6hint": "2001:db8::10"}}]}
+  ]`))
+	resp := query(t, r, "example.com.", dns.TypeHTTPS)
+	if resp.Rcode != dns.RcodeSuccess || !resp.Authoritative || len(resp.Answer) != 1 {
+		t.Fatalf("got %s %v, want one authoritative HTTPS", dns.RcodeToString[resp.Rcode], resp.Answer)
+	}
+	https, ok := resp.Answer[0].(*dns.HTTPS)
+	if !ok {
+		t.Fatalf("answer %v isn't HTTPS", resp.Answer[0])
+	}
+	if https.Hdr.Name != "example.com." || https.Priority != 1 || https.Target != "." {
+		t.Errorf("got %v, want example.com. 1 .", https)
+	}
+	params := map[dns.SVCBKey]string{}
+	for _, kv := range https.Value {
+		params[kv.Key()] = kv.String()
+	}
+	want := map[dns.SVCBKey]string{
+		dns.SVCB_ALPN:     "h2,h3",
+		dns.SVCB_IPV4HINT: "192.0.2.10",
+		dns.SVCB_IPV6HINT: "2001:db8::10",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("%s = %q, want %q", k, params[k], v)
+		}
+	}
+	// The apex has no A/AAAA of its own, so the hints become its addresses.
+	extra := map[string]bool{}
+	for _, rr := range resp.Extra {
+		if h := rr.Header(); h.Name == "example.com." {
+			extra[dns.TypeToString[h.Rrtype]+" "+strings.TrimPrefix(rr.String(), h.String())] = true
+		}
+	}
+	for _, want := range []string{"A 192.0.2.10", "AAAA 2001:db8::10"} {
+		if !extra[want] {
+			t.Errorf("additional section %v lacks example.com. %s", resp.Extra, want)
+		}
+	}
+}
+
+func TestDuplicateRecordsCollapse(t *testing.T) {
+	zi := loadZone(t, testZone, `[
+    {"name": "www", "type": "A", "values": ["192.0.2.1", "192.0.2.1"]},
+    {"name": "www", "type": "A", "values": ["192.0.2.1", "192.0.2.2"]}
+  ]`)
+	if zi.Duplicates != 2 {
+		t.Errorf("Duplicates = %d, want 2", zi.Duplicates)
+	}
+	r, _ := newTestResolver(t, zi)
+	resp := query(t, r, "www.example.com.", dns.TypeA)
+	got := map[string]int{}
+	for _, rr := range resp.Answer {
+		got[rr.(*dns.A).A.String()]++
+	}
+	if len(resp.Answer) != 2 || got["192.0.2.1"] != 1 || got["192.0.2.2"] != 1 {
+		t.Errorf("answer %v, want 192.0.2.1 and 192.0.2.2 once each", resp.Answer)
+	}
+}
+
+// startUpstream runs h as a DNS server on a local UDP port and returns its
+// address.
+func startUpstream(t testing.TB, h dns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: h, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestTTLZeroNotCached(t *testing.T) {
+	r, c := newTestResolver(t, loadZone(t, testZone, `[
+    {"name": "now", "type": "A", "ttl": 0, "values": ["192.0.2.1"]}
+  ]`))
+	for i := 0; i < 2; i++ {
+		resp := query(t, r, "now.example.com.", dns.TypeA)
+		if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 0 {
+			t.Fatalf("answer %v, want the A with TTL 0", resp.Answer)
+		}
+	}
+	if _, _, ok := c.PeekPositive("now.example.com.", dns.TypeA); ok {
+		t.Error("TTL-0 zone answer was cached")
+	}
+	if hits := c.Stats().PositiveHits; hits != 0 {
+		t.Errorf("%d cache hits, want every answer built fresh", hits)
+	}
+}
+
+func TestTTLZeroNotCachedFromResolver(t *testing.T) {
+	// An authoritative server for everything: the resolver gets its answers
+	// straight from the "root".
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		q := req.Question[0]
+		switch q.Name {
+		case "now.test.":
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0}, A: net.IPv4(192, 0, 2, 1)})
+		case "alias.test.":
+			// Only the first link of the chain has TTL 0.
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 0}, Target: "target.test."})
+		case "target.test.":
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 2)})
+		}
+		w.WriteMsg(m)
+	})
+	r, c := newTestResolver(t)
+	r.EnableResolver = true
+	r.RootServers = []string{upstream}
+	r.Family = FamilyV4
+
+	for _, name := range []string{"now.test.", "alias.test."} {
+		queries.Store(0)
+		for i := 0; i < 2; i++ {
+			if resp := query(t, r, name, dns.TypeA); len(resp.Answer) == 0 {
+				t.Fatalf("%s: no answer (rcode %s)", name, dns.RcodeToString[resp.Rcode])
+			}
+		}
+		if _, _, ok := c.PeekPositive(name, dns.TypeA); ok {
+			t.Errorf("%s: answer with a TTL-0 record was cached", name)
+		}
+		if n := queries.Load(); n < 2 || n%2 != 0 {
+			t.Errorf("%s: %d upstream queries for 2 lookups, want each resolved afresh", name, n)
+		}
+	}
+}
+
+func TestMultipleQuestionsFormErr(t *testing.T) {
+	r, _ := newTestResolver(t, loadZone(t, testZone, `[
+    {"name": "www", "type": "A", "values": ["192.0.2.1"]}
+  ]`))
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET})
+	resp := serve(t, r, req)
+	if resp.Rcode != dns.RcodeFormatError {
+		t.Errorf("rcode %s, want FORMERR", dns.RcodeToString[resp.Rcode])
+	}
+	if len(resp.Answer)+len(resp.Ns) > 0 {
+		t.Errorf("FORMERR carries records: answer %v, authority %v", resp.Answer, resp.Ns)
+	}
+
+	req.Question = nil
+	if resp := serve(t, r, req); resp.Rcode != dns.RcodeFormatError {
+		t.Errorf("no question: rcode %s, want FORMERR", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestWildcardCNAME(t *testing.T) {
+	r, _ := newTestResolver(t, loadZone(t, testZone, `[
+    {"name": "*", "type": "CNAME", "ttl": 120, "value": "www"},
+    {"name": "www", "type": "A", "values": ["192.0.2.1"]}
+  ]`))
+	for _, name := range []string{"foo.example.com.", "foo.bar.example.com."} {
+		t.Run(name, func(t *testing.T) {
+			resp := query(t, r, name, dns.TypeA)
+			if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+				t.Fatalf("got %s %v, want the CNAME and the A", dns.RcodeToString[resp.Rcode], resp.Answer)
+			}
+			cname, ok := resp.Answer[0].(*dns.CNAME)
+			if !ok || cname.Hdr.Name != name || cname.Target != "www.example.com." || cname.Hdr.Ttl != 120 {
+				t.Errorf("first answer %v, want %s CNAME www.example.com.", resp.Answer[0], name)
+			}
+			a, ok := resp.Answer[1].(*dns.A)
+			if !ok || a.Hdr.Name != "www.example.com." || !a.A.Equal(net.IPv4(192, 0, 2, 1)) {
+				t.Errorf("second answer %v, want www.example.com. A 192.0.2.1", resp.Answer[1])
+			}
+		})
+	}
+
+	// A CNAME query gets the synthesized CNAME alone.
+	resp := query(t, r, "foo.bar.example.com.", dns.TypeCNAME)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "foo.bar.example.com." {
+		t.Errorf("CNAME query answered %v", resp.Answer)
+	}
+}
+
+func TestNoDataVersusNXDomain(t *testing.T) {
+	r, _ := newTestResolver(t, loadZone(t, testZone, `[
+    {"name": "www", "type": "A", "values": ["192.0.2.1"]},
+    {"name": "*.w", "type": "A", "values": ["192.0.2.2"]},
+    {"name": "host.ent", "type": "A", "values": ["192.0.2.3"]}
+  ]`))
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"exact match", "www.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"exact match NODATA", "www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"wildcard match", "x.w.example.com.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"wildcard match NODATA", "x.w.example.com.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"empty non-terminal NODATA", "ent.example.com.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"NXDOMAIN", "nope.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+		{"NXDOMAIN below a name", "x.www.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := query(t, r, tt.qname, tt.qtype)
+			if resp.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if len(resp.Answer) != tt.answers {
+				t.Errorf("answer %v, want %d records", resp.Answer, tt.answers)
+			}
+			if tt.answers == 0 {
+				if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+					t.Errorf("authority %v, want the zone's SOA", resp.Ns)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheHitsLeaveCachedMessages(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		q := req.Question[0]
+		if q.Name == "pos.test." {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)})
+		} else {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, &dns.SOA{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+				Ns: "ns.test.", Mbox: "hostmaster.test.", Serial: 1, Minttl: 300})
+		}
+		w.WriteMsg(m)
+	})
+	r, c := newTestResolver(t, loadZone(t, testZone, `[
+    {"name": "www", "type": "A", "values": ["192.0.2.1"]}
+  ]`))
+	r.EnableResolver = true
+	r.RootServers = []string{upstream}
+	r.Family = FamilyV4
+
+	tests := []struct {
+		qname  string
+		rcode  int
+		cached func() *dns.Msg
+	}{
+		{"www.example.com.", dns.RcodeSuccess, func() *dns.Msg { m, _, _ := c.PeekPositive("www.example.com.", dns.TypeA); return m }},
+		{"pos.test.", dns.RcodeSuccess, func() *dns.Msg { m, _, _ := c.PeekPositive("pos.test.", dns.TypeA); return m }},
+		{"nx.test.", dns.RcodeNameError, func() *dns.Msg {
+			m, _ := c.GetNegativeData("nx.test.", dns.TypeA, dns.RcodeNameError)
+			return m
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			for id := uint16(1); id <= 3; id++ {
+				req := new(dns.Msg)
+				req.SetQuestion(tt.qname, dns.TypeA)
+				req.Id = id
+				resp := serve(t, r, req)
+				if resp.Id != id || resp.Rcode != tt.rcode {
+					t.Fatalf("query %d: got id %d, rcode %s", id, resp.Id, dns.RcodeToString[resp.Rcode])
+				}
+			}
+			m := tt.cached()
+			if m == nil {
+				t.Fatal("answer wasn't cached")
+			}
+			if m.Id != 1 {
+				t.Errorf("cached message has id %d, want 1 from when it was stored", m.Id)
+			}
+		})
+	}
+}
+
+func TestNAPTRSIP(t *testing.T) {
+	r, _ := newTestResolver(t, loadZone(t, testZone, `[
+    {"name": "@", "type": "NAPTR", "values": [
+      {"order": 50, "preference": 50, "flags": "s", "service": "SIPS+D2T", "regexp": "", "replacement": "_sips._tcp.example.com"},
+      {"order": 90, "preference": 50, "flags": "s", "service": "SIP+D2T", "regexp": "", "replacement": "_sip._tcp.example.com."},
+      {"order": 100, "preference": 50, "flags": "s", "service": "SIP+D2U", "regexp": "", "replacement": "_sip._udp.example.com."}
+    ]}
+  ]`))
+	resp := query(t, r, "example.com.", dns.TypeNAPTR)
+	want := []string{
+		`example.com.	300	IN	NAPTR	50 50 "s" "SIPS+D2T" "" _sips._tcp.example.com.`,
+		`example.com.	300	IN	NAPTR	90 50 "s" "SIP+D2T" "" _sip._tcp.example.com.`,
+		`example.com.	300	IN	NAPTR	100 50 "s" "SIP+D2U" "" _sip._udp.example.com.`,
+	}
+	if len(resp.Answer) != len(want) {
+		t.Fatalf("answer %v, want %d NAPTRs", resp.Answer, len(want))
+	}
+	for i, rr := range resp.Answer {
+		if rr.String() != want[i] {
+			t.Errorf("answer %d = %s, want %s", i, rr, want[i])
+		}
+	}
+}
+
+func TestOutOfZoneRefused(t *testing.T) {
+	r, _ := newTestResolver(t, loadZone(t, testZone, ""))
+	tests := []struct {
+		name          string
+		qname         string
+		rcode         int
+		authoritative bool
+		soa           bool
+	}{
+		{"outside our zones", "www.example.org.", dns.RcodeRefused, false, false},
+		{"in zone, absent", "nope.example.com.", dns.RcodeNameError, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := query(t, r, tt.qname, dns.TypeA)
+			if resp.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if resp.Authoritative != tt.authoritative {
+				t.Errorf("AA = %v, want %v", resp.Authoritative, tt.authoritative)
+			}
+			if soa := len(resp.Ns) == 1 && resp.Ns[0].Header().Rrtype == dns.TypeSOA; soa != tt.soa {
+				t.Errorf("authority %v, want SOA: %v", resp.Ns, tt.soa)
+			}
+			if len(resp.Answer) > 0 {
+				t.Errorf("answer %v, want none", resp.Answer)
+			}
+		})
+	}
+}
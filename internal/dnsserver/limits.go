@@ -0,0 +1,39 @@
+package dnsserver
+
+import "github.com/miekg/dns"
+
+// TypeLimit caps UDP responses to one query type; 0 means unlimited. A
+// response over either cap goes out empty with TC set, so the client has to
+// retry over TCP, where no caps apply.
+type TypeLimit struct {
+	MaxBytes   int
+	MaxRecords int // answer records
+}
+
+// overTypeLimit reports whether resp exceeds the cap for req's qtype.
+func (r *Resolver) overTypeLimit(req, resp *dns.Msg) bool {
+	if len(r.TypeLimits) == 0 || len(req.Question) == 0 {
+		return false
+	}
+	lim, ok := r.TypeLimits[req.Question[0].Qtype]
+	if !ok {
+		return false
+	}
+	if lim.MaxRecords > 0 && len(resp.Answer) > lim.MaxRecords {
+		return true
+	}
+	return lim.MaxBytes > 0 && resp.Len() > lim.MaxBytes
+}
+
+// truncated returns the header-only TC response that replaces resp.
+func truncated(req, resp *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = resp.Authoritative
+	m.Rcode = resp.Rcode
+	m.Truncated = true
+	if opt := resp.IsEdns0(); opt != nil {
+		m.Extra = []dns.RR{dns.Copy(opt)}
+	}
+	return m
+}
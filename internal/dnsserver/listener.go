@@ -0,0 +1,99 @@
+package dnsserver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"smart-dns/internal/metrics"
+)
+
+// TCPTuning configures the TCP and DNS-over-TLS listeners; zero values keep
+// the defaults.
+type TCPTuning struct {
+	// Backlog is the listen(2) queue length for pending connections. The
+	// kernel caps it (net.core.somaxconn on Linux); not applied on Windows.
+	Backlog int
+	// MaxConns caps open connections per listener; connections accepted
+	// beyond it are closed right away and counted as dropped.
+	MaxConns int
+	// MaxQueries is how many queries one connection may send before we
+	// close it (miekg/dns default: 128).
+	MaxQueries int
+	// IdleTimeout is how long a connection may wait between queries before
+	// we close it (0: the miekg/dns default of 8s). Clients asking for EDNS
+	// TCP keepalive are told this value.
+	IdleTimeout time.Duration
+}
+
+// tcpReadTimeout is how long a new TCP/DoT connection has to send its
+// first query.
+const tcpReadTimeout = 2 * time.Second
+
+// idleTimeout is IdleTimeout as dns.Server wants it (nil: its default).
+func (t TCPTuning) idleTimeout() func() time.Duration {
+	if t.IdleTimeout <= 0 {
+		return nil
+	}
+	return func() time.Duration { return t.IdleTimeout }
+}
+
+// listenTCP opens a TCP listener for addr with the tuning applied.
+func (t TCPTuning) listenTCP(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.Backlog > 0 {
+		if err := setBacklog(l, t.Backlog); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return &limitListener{Listener: l, sem: newSem(t.MaxConns)}, nil
+}
+
+func newSem(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// limitListener counts accepted connections and sheds those over its cap.
+type limitListener struct {
+	net.Listener
+	sem chan struct{} // nil: unlimited
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.sem == nil {
+			metrics.TCPConnections.WithLabelValues("accepted").Inc()
+			return c, nil
+		}
+		select {
+		case l.sem <- struct{}{}:
+			metrics.TCPConnections.WithLabelValues("accepted").Inc()
+			return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+		default:
+			metrics.TCPConnections.WithLabelValues("dropped").Inc()
+			c.Close()
+		}
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
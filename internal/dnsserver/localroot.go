@@ -0,0 +1,100 @@
+package dnsserver
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LocalRoot is a local copy of the root zone (RFC 8806). When set on the
+// Resolver, the first step of iterative resolution is answered from it
+// instead of querying the root servers.
+type LocalRoot struct {
+	soa dns.RR
+	// owner (lowercase FQDN) -> type -> records
+	rrs map[string]map[uint16][]dns.RR
+}
+
+// LoadLocalRoot parses a root zone file in master format (e.g. root.zone
+// as published by IANA).
+func LoadLocalRoot(path string) (*LocalRoot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lr := &LocalRoot{rrs: make(map[string]map[uint16][]dns.RR)}
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if lr.rrs[name] == nil {
+			lr.rrs[name] = make(map[uint16][]dns.RR)
+		}
+		lr.rrs[name][h.Rrtype] = append(lr.rrs[name][h.Rrtype], rr)
+		if h.Rrtype == dns.TypeSOA && name == "." {
+			lr.soa = rr
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if lr.soa == nil {
+		return nil, errors.New("local root zone has no SOA at .")
+	}
+	return lr, nil
+}
+
+// Answer builds the response a root server would give for qname/qtype:
+// an answer for data at the root itself (or a TLD's DS), a referral to the
+// TLD, or NXDOMAIN for TLDs that don't exist.
+func (lr *LocalRoot) Answer(qname string, qtype uint16) *dns.Msg {
+	name := strings.ToLower(dns.Fqdn(qname))
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.Response = true
+	m.RecursionDesired = false
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 0 {
+		m.Authoritative = true
+		m.Answer = lr.copyRRs(".", qtype)
+		if len(m.Answer) == 0 {
+			m.Ns = []dns.RR{dns.Copy(lr.soa)}
+		}
+		return m
+	}
+	tld := labels[len(labels)-1] + "."
+	ns := lr.copyRRs(tld, dns.TypeNS)
+	if len(ns) == 0 {
+		m.Authoritative = true
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{dns.Copy(lr.soa)}
+		return m
+	}
+	if name == tld && qtype == dns.TypeDS {
+		m.Authoritative = true
+		m.Answer = lr.copyRRs(tld, dns.TypeDS)
+		if len(m.Answer) == 0 {
+			m.Ns = []dns.RR{dns.Copy(lr.soa)}
+		}
+		return m
+	}
+	m.Ns = append(ns, lr.copyRRs(tld, dns.TypeDS)...)
+	for _, rr := range ns {
+		host := strings.ToLower(rr.(*dns.NS).Ns)
+		m.Extra = append(m.Extra, lr.copyRRs(host, dns.TypeA)...)
+		m.Extra = append(m.Extra, lr.copyRRs(host, dns.TypeAAAA)...)
+	}
+	return m
+}
+
+func (lr *LocalRoot) copyRRs(name string, t uint16) []dns.RR {
+	src := lr.rrs[name][t]
+	out := make([]dns.RR, 0, len(src))
+	for _, rr := range src {
+		out = append(out, dns.Copy(rr))
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package dnsserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NOTIFY (RFC 1996) retry schedule: a target that doesn't acknowledge is
+// tried notifyAttempts times, notifyTimeout apart.
+const (
+	notifyAttempts = 3
+	notifyTimeout  = 2 * time.Second
+)
+
+// SendNotify tells each target that zone has a new serial, so secondaries
+// pull it now instead of at their next refresh. It returns once every
+// target acknowledged or ran out of attempts.
+func SendNotify(l *slog.Logger, zone string, serial uint32, targets []string) {
+	done := make(chan struct{}, len(targets))
+	for _, t := range targets {
+		go func(target string) {
+			defer func() { done <- struct{}{} }()
+			if err := notify(zone, serial, target); err != nil {
+				l.Warn("notify failed", "zone", zone, "serial", serial, "target", target, "err", err)
+				return
+			}
+			l.Debug("notify acknowledged", "zone", zone, "serial", serial, "target", target)
+		}(t)
+	}
+	for range targets {
+		<-done
+	}
+}
+
+func notify(zone string, serial uint32, target string) error {
+	m := new(dns.Msg)
+	m.SetNotify(dns.Fqdn(zone))
+	m.Answer = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+		Ns:     ".",
+		Mbox:   ".",
+		Serial: serial,
+	}}
+	c := &dns.Client{Timeout: notifyTimeout}
+	for i := 1; ; i++ {
+		resp, _, err := c.Exchange(m, target)
+		if err == nil {
+			if resp.Opcode == dns.OpcodeNotify && resp.Rcode == dns.RcodeSuccess {
+				return nil
+			}
+			err = fmt.Errorf("not acknowledged: %s", dns.RcodeToString[resp.Rcode])
+		}
+		if i == notifyAttempts {
+			return err
+		}
+		time.Sleep(notifyTimeout)
+	}
+}
+
+// serveNotify handles an incoming NOTIFY for one of our secondary zones:
+// from the zone's primary it is acknowledged and triggers a refresh unless
+// the announced serial is one we already have. NOTIFYs for zones we aren't
+// a secondary for get NOTAUTH; from anyone but the primary, REFUSED.
+func (r *Resolver) serveNotify(log *slog.Logger, w dns.ResponseWriter, req *dns.Msg) {
+	name := strings.ToLower(dns.Fqdn(req.Question[0].Name))
+	peer := clientAddr(w)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Rcode = dns.RcodeNotAuth
+	ede, text := dns.ExtendedErrorCodeNotAuthoritative, edeTextNotAuthoritative
+	for _, tc := range r.Secondaries {
+		if tc.Zone != name {
+			continue
+		}
+		if !isPrimary(tc.Primary, peer) {
+			m.Rcode = dns.RcodeRefused
+			ede, text = dns.ExtendedErrorCodeProhibited, edeTextNotAllowed
+			continue
+		}
+		m.Rcode = dns.RcodeSuccess
+		m.Authoritative = true
+		serial, have := tc.Serial()
+		if soa, ok := notifySOA(req); ok && have && soa.Serial <= serial {
+			log.Debug("notify for current serial", "zone", name, "serial", soa.Serial, "peer", peer)
+			break
+		}
+		log.Info("notify received, refreshing", "zone", name, "peer", peer)
+		tc.Notify()
+		break
+	}
+	if m.Rcode != dns.RcodeSuccess {
+		setEDE(req, m, ede, text)
+	}
+	r.writeMsg(w, req, m)
+}
+
+// isPrimary reports whether peer is the address of primary (host:port).
+func isPrimary(primary string, peer netip.Addr) bool {
+	host, _, err := net.SplitHostPort(primary)
+	if err != nil {
+		host = primary
+	}
+	a, err := netip.ParseAddr(host)
+	return err == nil && a.Unmap() == peer.Unmap()
+}
+
+// notifySOA returns the SOA a NOTIFY may carry in its answer section.
+func notifySOA(req *dns.Msg) (*dns.SOA, bool) {
+	for _, rr := range req.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,39 @@
+package dnsserver
+
+import (
+	"strings"
+	"time"
+
+	"smart-dns/internal/cache"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+type prefetchKey struct {
+	name  string
+	qtype uint16
+}
+
+// maybePrefetch refreshes a popular resolver answer in the background when
+// it is about to expire. Authoritative answers are skipped: they are rebuilt
+// from memory on a miss anyway.
+func (r *Resolver) maybePrefetch(zones *zone.Store, c cache.Cache[*dns.Msg], qname string, qtype uint16) {
+	if r.PrefetchHits == 0 || !r.EnableResolver || !c.PrefetchDue(qname, qtype, r.PrefetchHits) {
+		return
+	}
+	if zi, _ := r.zoneFor(zones, qname); zi != nil {
+		return
+	}
+	key := prefetchKey{strings.ToLower(qname), qtype}
+	if _, busy := r.prefetching.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	go func() {
+		defer r.prefetching.Delete(key)
+		m, ttl, _ := r.resolve(r.Logger, qname, qtype)
+		if m != nil && m.Rcode == dns.RcodeSuccess && (len(m.Answer) > 0 || len(m.Ns) > 0) && ttl > 0 && !uncacheable(m) {
+			c.PutPositive(qname, qtype, m, time.Duration(ttl)*time.Second)
+		}
+	}()
+}
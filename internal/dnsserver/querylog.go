@@ -0,0 +1,71 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Where an answer came from, as recorded in the query log.
+const (
+	sourceAuthoritative = "authoritative"
+	sourceCache         = "cache"
+	sourceResolver      = "resolver"
+	sourceStale         = "stale"
+)
+
+// queryLogWriter remembers the last message written so the query log can
+// report on it once ServeDNS returns.
+type queryLogWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (q *queryLogWriter) WriteMsg(m *dns.Msg) error {
+	q.msg = m
+	return q.ResponseWriter.WriteMsg(m)
+}
+
+func (q *queryLogWriter) Unwrap() dns.ResponseWriter { return q.ResponseWriter }
+
+// newRequestID returns a short random ID for a query, to tie together the
+// log lines it produces.
+func newRequestID() string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], rand.Uint32())
+	return hex.EncodeToString(b[:])
+}
+
+func (r *Resolver) logQueries() bool {
+	return r.QueryLog != nil || r.Logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// logQuery writes one entry per answered query to the debug log and, if
+// configured, the query log file.
+func (r *Resolver) logQuery(q *queryLogWriter, req *dns.Msg, id, source string, elapsed time.Duration) {
+	if q.msg == nil {
+		return
+	}
+	attrs := []any{
+		"req_id", id,
+		"client", clientAddr(q).String(),
+		"qname", req.Question[0].Name,
+		"qtype", dns.TypeToString[req.Question[0].Qtype],
+		"rcode", dns.RcodeToString[q.msg.Rcode],
+		"answers", len(q.msg.Answer),
+		"source", source,
+		"latency", elapsed,
+	}
+	if r.NSID != "" {
+		attrs = append(attrs, "nsid", r.NSID)
+	}
+	r.Logger.Debug("query", attrs...)
+	if r.QueryLog != nil {
+		r.QueryLog.Info("query", attrs...)
+	}
+}
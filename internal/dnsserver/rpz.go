@@ -0,0 +1,103 @@
+package dnsserver
+
+import (
+	"log/slog"
+	"time"
+
+	"smart-dns/internal/cache"
+	"smart-dns/internal/metrics"
+	"smart-dns/internal/rpz"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// serveRPZ applies the response policy rule matching qname, if any, and
+// reports whether it answered req (or, for rpz-drop, chose not to). A
+// passthru rule, or none, leaves the query to be answered as usual.
+// Rewritten answers are never cached, so policy changes apply at once.
+func (r *Resolver) serveRPZ(log *slog.Logger, w dns.ResponseWriter, req *dns.Msg, zones *zone.Store, rcache cache.Cache[*dns.Msg], recurse bool) bool {
+	q := req.Question[0]
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		return false
+	}
+	rule := r.RPZ.Match(q.Name)
+	if rule == nil {
+		return false
+	}
+	metrics.RPZHits.WithLabelValues(string(rule.Action)).Inc()
+	log.Debug("response policy", "qname", q.Name, "action", rule.Action)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	switch rule.Action {
+	case rpz.Passthru:
+		return false
+	case rpz.Drop:
+		return true
+	case rpz.NXDomain, rpz.NoData:
+		if rule.Action == rpz.NXDomain {
+			m.Rcode = dns.RcodeNameError
+		}
+		// The policy zone's SOA, so clients can tell the denial from a
+		// real one.
+		m.Ns = []dns.RR{r.RPZ.SOA()}
+		setEDE(req, m, dns.ExtendedErrorCodeBlocked, edeTextPolicy)
+	case rpz.Rewrite:
+		m.Answer = []dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rule.TTL},
+			Target: rule.Target,
+		}}
+		if q.Qtype != dns.TypeCNAME {
+			// Chase the target like any CNAME; its answer isn't
+			// covered by the policy.
+			ans, rcode := r.rpzTarget(log, zones, rcache, dns.Fqdn(rule.Target), q.Qtype, recurse)
+			m.Answer = append(m.Answer, ans...)
+			m.Rcode = rcode
+		}
+		setEDE(req, m, dns.ExtendedErrorCodeForgedAnswer, edeTextPolicy)
+	case rpz.LocalData:
+		for _, rr := range rule.Records {
+			if rr.Header().Rrtype == q.Qtype && rr.Header().Class == q.Qclass {
+				rr = dns.Copy(rr)
+				rr.Header().Name = q.Name
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if len(m.Answer) == 0 {
+			m.Ns = []dns.RR{r.RPZ.SOA()}
+		}
+		setEDE(req, m, dns.ExtendedErrorCodeForgedAnswer, edeTextPolicy)
+	}
+	r.writeMsg(w, req, m)
+	return true
+}
+
+// rpzTarget answers qtype for the target of a rewrite: from our zones or,
+// when the client may recurse, the resolver. Failing that the CNAME goes
+// out alone.
+func (r *Resolver) rpzTarget(log *slog.Logger, zones *zone.Store, rcache cache.Cache[*dns.Msg], target string, qtype uint16, recurse bool) ([]dns.RR, int) {
+	zi, fwd := r.zoneFor(zones, target)
+	if zi != nil {
+		ans, _, rcode, _ := r.lookup(log, zi, target, qtype)
+		if rcode == dns.RcodeServerFailure {
+			return nil, dns.RcodeSuccess
+		}
+		return ans, rcode
+	}
+	if !recurse || !(r.EnableResolver || fwd) || (!fwd && r.isLocalOnly(target)) {
+		return nil, dns.RcodeSuccess
+	}
+	if cached, ok := rcache.GetPositive(target, qtype); ok {
+		return cached.Answer, dns.RcodeSuccess
+	}
+	m, ttl, err := r.resolve(log, target, qtype)
+	if m == nil {
+		log.Debug("response policy target unresolved", "target", target, "err", err)
+		return nil, dns.RcodeSuccess
+	}
+	if m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0 && ttl > 0 && !uncacheable(m) {
+		rcache.PutPositive(target, qtype, m.Copy(), time.Duration(ttl)*time.Second)
+	}
+	return m.Answer, m.Rcode
+}
@@ -2,76 +2,190 @@ package dnsserver
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// maxUDPSize is the EDNS0 UDP payload size we advertise and accept.
+const maxUDPSize = 4096
+
 type Server struct {
-	Logger  *slog.Logger
-	UDPAddr string
-	TCPAddr string
-	Handler dns.Handler
-
-	udpSrv *dns.Server
-	tcpSrv *dns.Server
-	wg     sync.WaitGroup
+	Logger *slog.Logger
+	// UDPAddrs and TCPAddrs are the addresses to listen on, one dns.Server
+	// each; all of them share Handler.
+	UDPAddrs []string
+	TCPAddrs []string
+	Handler  dns.Handler
+
+	// DNS over TLS (RFC 7858); served only when both are set.
+	TLSAddr   string
+	TLSConfig *tls.Config
+	// TCP tunes the TCP and DoT listeners.
+	TCP TCPTuning
+	// TsigSecret holds the TSIG keys (name -> base64 secret) requests are
+	// verified against; see dns.ResponseWriter.TsigStatus.
+	TsigSecret map[string]string
+	// OnShutdown runs as soon as shutdown begins, before any listener
+	// closes (e.g. to fail health checks). ShutdownTimeout bounds how long
+	// in-flight queries then get to finish (0: 3s).
+	OnShutdown      func()
+	ShutdownTimeout time.Duration
+
+	udpSrvs  []*dns.Server
+	tcpSrvs  []*dns.Server
+	tlsSrv   *dns.Server
+	wg       sync.WaitGroup
+	inflight atomic.Int64
 }
 
-func NewServer(l *slog.Logger, udp, tcp string, h dns.Handler) *Server {
-	return &Server{Logger: l, UDPAddr: udp, TCPAddr: tcp, Handler: h}
+func NewServer(l *slog.Logger, udp, tcp []string, h dns.Handler) *Server {
+	return &Server{Logger: l, UDPAddrs: udp, TCPAddrs: tcp, Handler: h}
 }
 
-func (s *Server) Start(ctx context.Context) error {
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		// Respect EDNS0 size
-		if o := r.IsEdns0(); o != nil {
-			// nothing to do now; miekg/dns manages payload sizes
-		}
-		s.Handler.ServeDNS(w, r)
-	})
+// ServeDNS passes req to Handler, counting it in flight so shutdown waits
+// for the answer. Serve DoH with s as its handler (DoHHandler(s)) for its
+// queries to count too.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+	s.Handler.ServeDNS(w, req)
+}
 
-	s.udpSrv = &dns.Server{Addr: s.UDPAddr, Net: "udp", UDPSize: 4096}
-	s.tcpSrv = &dns.Server{Addr: s.TCPAddr, Net: "tcp"}
+// Start binds every listener, failing (with none left open) if any address
+// can't be bound, then serves until ctx is done.
+func (s *Server) Start(ctx context.Context) error {
+	// EDNS payload sizes are enforced by the handler (Resolver.writeMsg).
+	dns.Handle(".", s)
 
-	s.wg.Add(2)
-	go func() {
-		defer s.wg.Done()
-		if err := s.udpSrv.ListenAndServe(); err != nil {
-			s.Logger.Error("udp server", "err", err)
+	var closers []io.Closer
+	fail := func(err error) error {
+		for _, c := range closers {
+			c.Close()
 		}
-	}()
-	go func() {
-		defer s.wg.Done()
-		if err := s.tcpSrv.ListenAndServe(); err != nil {
-			s.Logger.Error("tcp server", "err", err)
+		return err
+	}
+	for _, addr := range s.UDPAddrs {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return fail(err)
 		}
-	}()
+		closers = append(closers, pc)
+		s.udpSrvs = append(s.udpSrvs, &dns.Server{PacketConn: pc, Net: "udp", UDPSize: maxUDPSize, MsgAcceptFunc: acceptMsg, TsigSecret: s.TsigSecret})
+	}
+	for _, addr := range s.TCPAddrs {
+		ln, err := s.TCP.listenTCP(addr)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, ln)
+		s.tcpSrvs = append(s.tcpSrvs, s.streamServer(ln, "tcp"))
+	}
+	if s.TLSAddr != "" && s.TLSConfig != nil {
+		ln, err := s.TCP.listenTCP(s.TLSAddr)
+		if err != nil {
+			return fail(err)
+		}
+		s.tlsSrv = s.streamServer(tls.NewListener(ln, s.TLSConfig), "tcp-tls")
+	}
 
+	all := append(append([]*dns.Server{}, s.udpSrvs...), s.tcpSrvs...)
+	if s.tlsSrv != nil {
+		all = append(all, s.tlsSrv)
+	}
+	for _, srv := range all {
+		s.wg.Add(1)
+		go func(srv *dns.Server) {
+			defer s.wg.Done()
+			if err := srv.ActivateAndServe(); err != nil {
+				s.Logger.Error(srv.Net+" server", "err", err)
+			}
+		}(srv)
+	}
+
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		<-ctx.Done()
-		ctx2, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		_ = s.udpSrv.ShutdownContext(ctx2)
-		_ = s.tcpSrv.ShutdownContext(ctx2)
+		s.shutdown(all)
 	}()
 	return nil
 }
 
-func (s *Server) AddrUDP() (net.Addr, bool) {
-	if s.udpSrv != nil && s.udpSrv.Listener != nil {
-		return s.udpSrv.Listener.Addr(), true
+// shutdown stops accepting queries and gives the ones in flight until
+// ShutdownTimeout to be answered.
+func (s *Server) shutdown(all []*dns.Server) {
+	if s.OnShutdown != nil {
+		s.OnShutdown()
+	}
+	timeout := s.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
 	}
-	return nil, false
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range all {
+		_ = srv.ShutdownContext(ctx)
+	}
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for s.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			s.Logger.Warn("shutdown timeout, abandoning in-flight queries", "queries", s.inflight.Load())
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// streamServer is the dns.Server for a TCP or DoT listener.
+func (s *Server) streamServer(ln net.Listener, network string) *dns.Server {
+	return &dns.Server{Listener: ln, Net: network, MaxTCPQueries: s.TCP.MaxQueries, ReadTimeout: tcpReadTimeout, IdleTimeout: s.TCP.idleTimeout(), MsgAcceptFunc: acceptMsg, TsigSecret: s.TsigSecret}
 }
-func (s *Server) AddrTCP() (net.Addr, bool) {
-	if s.tcpSrv != nil && s.tcpSrv.Listener != nil {
-		return s.tcpSrv.Listener.Addr(), true
+
+// acceptMsg is dns.DefaultMsgAcceptFunc, except that queries without a
+// question or with several reach the handler, which answers FORMERR itself
+// (and logs them), and so do dynamic updates, whose sections may hold any
+// number of records.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qr = 1 << 15
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&qr == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	if dh.Qdcount != 1 {
+		dh.Qdcount = 1
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// AddrUDP returns the bound UDP addresses (with the real port for ":0").
+func (s *Server) AddrUDP() []net.Addr {
+	out := make([]net.Addr, 0, len(s.udpSrvs))
+	for _, srv := range s.udpSrvs {
+		out = append(out, srv.PacketConn.LocalAddr())
+	}
+	return out
+}
+
+// AddrTCP returns the bound TCP addresses.
+func (s *Server) AddrTCP() []net.Addr {
+	out := make([]net.Addr, 0, len(s.tcpSrvs))
+	for _, srv := range s.tcpSrvs {
+		out = append(out, srv.Listener.Addr())
 	}
-	return nil, false
+	return out
 }
 
+// Wait returns once the server has shut down and its in-flight queries are
+// answered (or abandoned at ShutdownTimeout).
 func (s *Server) Wait() { s.wg.Wait() }
@@ -0,0 +1,44 @@
+package dnsserver
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestInflightDoH(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s := NewServer(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, nil, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		close(started)
+		<-release
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	}))
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(buf))
+	hr.Header.Set("Content-Type", dohMediaType)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		DoHHandler(s).ServeHTTP(httptest.NewRecorder(), hr)
+	}()
+	<-started
+	if n := s.inflight.Load(); n != 1 {
+		t.Errorf("%d queries in flight during a DoH query, want 1", n)
+	}
+	close(release)
+	<-done
+	if n := s.inflight.Load(); n != 0 {
+		t.Errorf("%d queries in flight after it, want 0", n)
+	}
+}
@@ -0,0 +1,94 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Special-use names answered locally (Resolver.SpecialUse) unless a loaded
+// or forwarded zone covers them: localhost (RFC 6761) resolves to the
+// loopback addresses; invalid (RFC 6761), local (mDNS, RFC 6762) and onion
+// (RFC 7686) don't exist in the DNS; the RFC 1918 reverse zones are served
+// empty (RFC 6303), since their PTRs only mean something inside a site.
+var (
+	specialNXDomain = []string{"invalid.", "local.", "onion."}
+	privateReverse  = func() []string {
+		zones := []string{"10.in-addr.arpa.", "168.192.in-addr.arpa."}
+		for i := 16; i < 32; i++ {
+			zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa.", i))
+		}
+		return zones
+	}()
+)
+
+// specialUseTTL is the TTL of localhost answers and of the SOA sent with
+// denials, whose minimum (RFC 2308) is the same.
+const specialUseTTL = 10800
+
+// serveSpecialUse answers req if qname is a special-use name, and reports
+// whether it did. resp is the reply prepared by ServeDNS.
+func (r *Resolver) serveSpecialUse(w dns.ResponseWriter, req, resp *dns.Msg, qname string, qtype uint16) bool {
+	name := strings.ToLower(qname)
+	hdr := dns.RR_Header{Name: qname, Rrtype: qtype, Class: dns.ClassINET, Ttl: specialUseTTL}
+	switch apex := specialZone(name); {
+	case dns.IsSubDomain("localhost.", name):
+		switch qtype {
+		case dns.TypeA:
+			resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)}}
+		case dns.TypeAAAA:
+			resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback}}
+		default:
+			resp.Ns = []dns.RR{specialSOA("localhost.")}
+		}
+	case apex != "":
+		if name != apex || qtype != dns.TypeSOA {
+			resp.Ns = []dns.RR{specialSOA(apex)}
+		} else {
+			resp.Answer = []dns.RR{specialSOA(apex)}
+		}
+		if name != apex && !isPrivateReverse(apex) {
+			resp.Rcode = dns.RcodeNameError
+		}
+	default:
+		return false
+	}
+	r.writeMsg(w, req, resp)
+	return true
+}
+
+// specialZone returns the special-use zone holding name other than
+// localhost, or "".
+func specialZone(name string) string {
+	for _, z := range specialNXDomain {
+		if dns.IsSubDomain(z, name) {
+			return z
+		}
+	}
+	for _, z := range privateReverse {
+		if dns.IsSubDomain(z, name) {
+			return z
+		}
+	}
+	return ""
+}
+
+func isPrivateReverse(zone string) bool {
+	return strings.HasSuffix(zone, ".in-addr.arpa.")
+}
+
+// specialSOA is the SOA of a locally served zone (RFC 6303 section 3).
+func specialSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: specialUseTTL},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 604800,
+		Retry:   86400,
+		Expire:  2419200,
+		Minttl:  specialUseTTL,
+	}
+}
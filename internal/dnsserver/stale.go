@@ -0,0 +1,30 @@
+package dnsserver
+
+import (
+	"smart-dns/internal/cache"
+	"smart-dns/internal/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// staleAnswerTTL is the TTL on stale answers (RFC 8767 recommends 30s), so
+// clients come back soon for fresh data.
+const staleAnswerTTL = 30
+
+// serveStale answers req from an expired cache entry after resolution
+// failed, if the cache still holds one within its stale window.
+func (r *Resolver) serveStale(w dns.ResponseWriter, req *dns.Msg, c cache.Cache[*dns.Msg], qname string, qtype uint16, reason string) bool {
+	v, ok := c.GetStale(qname, qtype)
+	if !ok {
+		return false
+	}
+	opt := req.IsEdns0()
+	m := forClient(req, v, opt != nil && opt.Do()).Copy()
+	m.Id = req.Id
+	clampTTLs(m, staleAnswerTTL)
+	setEDE(req, m, dns.ExtendedErrorCodeStaleAnswer, edeTextStale)
+	metrics.StaleAnswers.WithLabelValues(reason).Inc()
+	metrics.CacheHits.WithLabelValues("stale").Inc()
+	r.writeMsg(w, req, m)
+	return true
+}
@@ -0,0 +1,51 @@
+package dnsserver
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// negativeTTL reports whether m is an NXDOMAIN or NODATA answer that can be
+// cached, i.e. has an SOA in authority, and for how long: the lesser of the
+// SOA's TTL and its MINIMUM field (RFC 2308 section 5).
+func negativeTTL(m *dns.Msg) (time.Duration, bool) {
+	if m.Rcode != dns.RcodeNameError && (m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0) {
+		return 0, false
+	}
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// clampTTLs caps every TTL in m (except OPT) at ttl.
+func clampTTLs(m *dns.Msg, ttl uint32) {
+	for _, s := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range s {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT && h.Ttl > ttl {
+				h.Ttl = ttl
+			}
+		}
+	}
+}
+
+// floorTTLs raises every TTL in m (except OPT) to at least floor.
+func floorTTLs(m *dns.Msg, floor uint32) {
+	if floor == 0 {
+		return
+	}
+	for _, s := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range s {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT && h.Ttl < floor {
+				h.Ttl = floor
+			}
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package dnsserver
+
+import (
+	"log/slog"
+	"strings"
+
+	"smart-dns/internal/metrics"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// serveUpdate applies a dynamic update (RFC 2136) to one of our primary
+// zones. Updates are only taken from clients in AllowUpdate and, once TSIG
+// keys are configured, must be signed (by the zone's tsig_key if it names
+// one). Prerequisites are checked against the zone as loaded; the update
+// section is then applied to a copy of the zone, which replaces the old one
+// with the serial bumped, unless a reload replaced it first (SERVFAIL).
+// Changes to the apex SOA and NS are ignored.
+func (r *Resolver) serveUpdate(log *slog.Logger, w dns.ResponseWriter, req *dns.Msg) {
+	client := clientAddr(w)
+	if len(r.AllowUpdate) == 0 || !r.AllowUpdate.Contains(client) {
+		metrics.Updates.WithLabelValues("refused").Inc()
+		r.refused(w, req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited, edeTextNotAllowed)
+		return
+	}
+	zq := req.Question[0]
+	if len(req.Question) != 1 || zq.Qtype != dns.TypeSOA || zq.Qclass != dns.ClassINET {
+		r.updateReply(w, req, dns.RcodeFormatError)
+		return
+	}
+	name := dns.CanonicalName(zq.Name)
+	zones, rcache := r.viewFor(client)
+
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+	zi := zones.Snapshot()[name]
+	if zi == nil || zi.Primary != "" {
+		metrics.Updates.WithLabelValues("refused").Inc()
+		r.refused(w, req, dns.RcodeNotAuth, dns.ExtendedErrorCodeNotAuthoritative, edeTextNotAuthoritative)
+		return
+	}
+	if !r.transferSigned(w, req, zi) {
+		log.Warn("update without valid TSIG", "zone", zi.ZoneFQDN, "client", client)
+		metrics.Updates.WithLabelValues("refused").Inc()
+		r.refused(w, req, dns.RcodeNotAuth, dns.ExtendedErrorCodeProhibited, edeTextTSIGRequired)
+		return
+	}
+	if zi.Signed() {
+		metrics.Updates.WithLabelValues("refused").Inc()
+		r.refused(w, req, dns.RcodeRefused, dns.ExtendedErrorCodeNotSupported, edeTextNotSupported)
+		return
+	}
+
+	u := &zoneUpdate{zi: zi, sets: make(map[updateSet][]dns.RR)}
+	if rcode := u.prerequisites(req.Answer); rcode != dns.RcodeSuccess {
+		r.updateReply(w, req, rcode)
+		return
+	}
+	if rcode := u.prescan(req.Ns); rcode != dns.RcodeSuccess {
+		r.updateReply(w, req, rcode)
+		return
+	}
+	if !u.apply(req.Ns) {
+		r.updateReply(w, req, dns.RcodeSuccess)
+		return
+	}
+	nz, err := u.zone()
+	if err != nil {
+		log.Warn("update rejected", "zone", zi.ZoneFQDN, "client", client, "err", err)
+		r.updateReply(w, req, dns.RcodeRefused)
+		return
+	}
+	if !zones.CompareAndSwapZone(zi, nz) {
+		// A reload replaced the zone meanwhile; the client can retry
+		// against it.
+		log.Warn("update dropped: zone reloaded meanwhile", "zone", zi.ZoneFQDN, "client", client)
+		r.updateReply(w, req, dns.RcodeServerFailure)
+		return
+	}
+	rcache.InvalidateZone(nz.ZoneFQDN)
+	log.Info("zone updated", "zone", nz.ZoneFQDN, "view", nz.View, "serial", nz.Serial, "client", client)
+	if len(nz.AlsoNotify) > 0 {
+		go SendNotify(log, nz.ZoneFQDN, nz.Serial, nz.AlsoNotify)
+	}
+	if r.PersistUpdates && len(nz.Files) > 1 {
+		// One file can't take back the records of the others.
+		log.Warn("update not persisted: zone is split across files", "zone", nz.ZoneFQDN, "files", strings.Join(nz.Files, ","))
+	} else if r.PersistUpdates && nz.File != "" {
+		if err := zone.WriteZoneFile(nz.File, nz.ToZoneFile()); err != nil {
+			log.Warn("update not persisted", "zone", nz.ZoneFQDN, "path", nz.File, "err", err)
+		}
+	}
+	r.updateReply(w, req, dns.RcodeSuccess)
+}
+
+// updateReply answers an update with rcode and counts it.
+func (r *Resolver) updateReply(w dns.ResponseWriter, req *dns.Msg, rcode int) {
+	metrics.Updates.WithLabelValues(strings.ToLower(dns.RcodeToString[rcode])).Inc()
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	r.writeMsg(w, req, m)
+}
+
+type updateSet struct {
+	name  string
+	rtype uint16
+}
+
+// zoneUpdate is an update in progress: the RRsets it changed, over the zone
+// they are applied to.
+type zoneUpdate struct {
+	zi   *zone.ZoneIndex
+	sets map[updateSet][]dns.RR
+}
+
+// rrset returns the current records of name/rtype.
+func (u *zoneUpdate) rrset(name string, rtype uint16) []dns.RR {
+	if rrs, ok := u.sets[updateSet{name, rtype}]; ok {
+		return rrs
+	}
+	if rs := u.zi.ByName[name][toRRType(rtype)]; rs != nil {
+		return toRR(name, rs)
+	}
+	return nil
+}
+
+// types lists the types name currently has records of; types DNS can't
+// carry (ALIAS) are reported as TypeNone.
+func (u *zoneUpdate) types(name string) []uint16 {
+	var out []uint16
+	for t := range u.zi.ByName[name] {
+		rtype := dns.StringToType[string(t)]
+		if _, changed := u.sets[updateSet{name, rtype}]; !changed || rtype == dns.TypeNone {
+			out = append(out, rtype)
+		}
+	}
+	for k, rrs := range u.sets {
+		if k.name == name && len(rrs) > 0 {
+			out = append(out, k.rtype)
+		}
+	}
+	return out
+}
+
+func (u *zoneUpdate) inZone(name string) bool {
+	return dns.IsSubDomain(u.zi.ZoneFQDN, dns.CanonicalName(name))
+}
+
+// prerequisites checks the prerequisite section (RFC 2136 3.2) against the
+// zone before any change.
+func (u *zoneUpdate) prerequisites(rrs []dns.RR) int {
+	exact := make(map[updateSet][]dns.RR)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !u.inZone(h.Name) {
+			return dns.RcodeNotZone
+		}
+		name := dns.CanonicalName(h.Name)
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(u.types(name)) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(u.rrset(name, h.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(u.types(name)) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(u.rrset(name, h.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			k := updateSet{name, h.Rrtype}
+			exact[k] = append(exact[k], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for k, want := range exact {
+		if !sameRRs(u.rrset(k.name, k.rtype), want) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// sameRRs reports whether a and b hold the same records, ignoring TTLs and
+// order.
+func sameRRs(a, b []dns.RR) bool {
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		for _, x := range rrs {
+			if dns.IsDuplicate(x, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// prescan validates the update section (RFC 2136 3.4.1) so that it is
+// applied entirely or not at all. Types the zone can't hold are refused.
+func (u *zoneUpdate) prescan(rrs []dns.RR) int {
+	for _, rr := range rrs {
+		h := rr.Header()
+		if !u.inZone(h.Name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if metaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 || (metaType(h.Rrtype) && h.Rrtype != dns.TypeANY) {
+				return dns.RcodeFormatError
+			}
+			continue
+		case dns.ClassNONE:
+			if h.Ttl != 0 || metaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+		if h.Rrtype == dns.TypeSOA {
+			continue // ignored when applied
+		}
+		if _, err := zone.RecordFromRR(rr); toRRType(h.Rrtype) == "" || err != nil {
+			return dns.RcodeRefused
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// metaType reports whether t is a query-only type that no zone can hold.
+func metaType(t uint16) bool {
+	switch t {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY:
+		return true
+	}
+	return false
+}
+
+// apply applies the update section (RFC 2136 3.4.2) and reports whether
+// anything changed.
+func (u *zoneUpdate) apply(rrs []dns.RR) bool {
+	changed := false
+	set := func(name string, rtype uint16, rrs []dns.RR) {
+		u.sets[updateSet{name, rtype}] = rrs
+		changed = true
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		name := dns.CanonicalName(h.Name)
+		if h.Class != dns.ClassANY && (h.Rrtype == dns.TypeSOA || (name == u.zi.ZoneFQDN && h.Rrtype == dns.TypeNS)) {
+			continue
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if u.cnameConflict(name, h.Rrtype) {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			// The new record joins the RRset, which takes its TTL; a CNAME
+			// replaces the old one.
+			cur := u.rrset(name, h.Rrtype)
+			var next []dns.RR
+			if h.Rrtype != dns.TypeCNAME {
+				for _, x := range cur {
+					if !dns.IsDuplicate(x, rr) {
+						x = dns.Copy(x)
+						x.Header().Ttl = h.Ttl
+						next = append(next, x)
+					}
+				}
+			}
+			next = append(next, rr)
+			if len(cur) > 0 && cur[0].Header().Ttl == h.Ttl && sameRRs(cur, next) {
+				continue
+			}
+			set(name, h.Rrtype, next)
+		case dns.ClassANY:
+			for _, t := range u.types(name) {
+				if t == dns.TypeNone || (h.Rrtype != dns.TypeANY && t != h.Rrtype) {
+					continue
+				}
+				if name == u.zi.ZoneFQDN && (t == dns.TypeNS || t == dns.TypeSOA) {
+					continue
+				}
+				set(name, t, nil)
+			}
+		case dns.ClassNONE:
+			rr = dns.Copy(rr)
+			rr.Header().Class = dns.ClassINET
+			cur := u.rrset(name, h.Rrtype)
+			next := make([]dns.RR, 0, len(cur))
+			for _, x := range cur {
+				if !dns.IsDuplicate(x, rr) {
+					next = append(next, x)
+				}
+			}
+			if len(next) != len(cur) {
+				set(name, h.Rrtype, next)
+			}
+		}
+	}
+	return changed
+}
+
+// cnameConflict reports whether adding an rtype record at name must be
+// ignored: CNAMEs don't coexist with other data (RFC 2136 3.4.2.2).
+func (u *zoneUpdate) cnameConflict(name string, rtype uint16) bool {
+	for _, t := range u.types(name) {
+		if (rtype == dns.TypeCNAME) != (t == dns.TypeCNAME) {
+			return true
+		}
+	}
+	return false
+}
+
+// zone builds the updated zone: the old one with the changed RRsets
+// replaced and the serial bumped.
+func (u *zoneUpdate) zone() (*zone.ZoneIndex, error) {
+	zf := u.zi.ToZoneFile()
+	records := zf.Records[:0]
+	for _, rec := range zf.Records {
+		k := updateSet{dns.CanonicalName(rec.Name), dns.StringToType[rec.Type]}
+		if _, changed := u.sets[k]; !changed {
+			records = append(records, rec)
+		}
+	}
+	for _, rrs := range u.sets {
+		for _, rr := range rrs {
+			rec, err := zone.RecordFromRR(rr)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+	}
+	zf.Records = records
+	zf.Serial = u.zi.Serial + 1
+	nz, err := zf.Reindex()
+	if err != nil {
+		return nil, err
+	}
+	nz.File, nz.Files = u.zi.File, u.zi.Files
+	return nz, nil
+}
@@ -0,0 +1,83 @@
+package dnsserver
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// typeNXNAME is the meta-type compact denial of existence puts in the NSEC
+// bitmap of a NOERROR response to say the name does not exist
+// (draft-ietf-dnsop-compact-denial-of-existence).
+const typeNXNAME uint16 = 128
+
+// isMetaType reports OPT and the RFC 6895 Q/Meta range (128-255), none of
+// which are data that belongs in an answer or authority section.
+func isMetaType(t uint16) bool {
+	return t == dns.TypeOPT || (t >= 128 && t <= 255)
+}
+
+// sanitizeUpstream drops records we must not relay or cache from an
+// upstream response: meta-types in the answer/authority sections, answer
+// records unrelated to the question, and its OPT record.
+func sanitizeUpstream(m *dns.Msg, qtype uint16) {
+	m.Answer = filterRRs(m.Answer, func(t uint16) bool {
+		if isMetaType(t) {
+			return false
+		}
+		switch t {
+		case qtype, dns.TypeCNAME, dns.TypeDNAME, dns.TypeRRSIG:
+			return true
+		}
+		return qtype == dns.TypeANY
+	})
+	m.Ns = filterRRs(m.Ns, func(t uint16) bool { return !isMetaType(t) })
+	// The upstream's OPT (its payload size, DO bit and options) is no
+	// business of our clients; writeMsg gives each its own.
+	m.Extra = filterRRs(m.Extra, func(t uint16) bool { return t != dns.TypeOPT })
+}
+
+func filterRRs(rrs []dns.RR, keep func(t uint16) bool) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if keep(rr.Header().Rrtype) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// isCompactNXDomain detects a compact-denial NOERROR response whose NSEC at
+// name lists NXNAME, i.e. an NXDOMAIN in disguise.
+func isCompactNXDomain(m *dns.Msg, name string) bool {
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0 {
+		return false
+	}
+	for _, rr := range m.Ns {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok || !strings.EqualFold(nsec.Hdr.Name, name) {
+			continue
+		}
+		for _, t := range nsec.TypeBitMap {
+			if t == typeNXNAME {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isReferral reports a delegation: NS records in authority and no SOA
+// (a SOA there means a negative answer, not a referral).
+func isReferral(m *dns.Msg) bool {
+	hasNS := false
+	for _, rr := range m.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			return false
+		case dns.TypeNS:
+			hasNS = true
+		}
+	}
+	return hasNS
+}
@@ -0,0 +1,353 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootAnchors are the DS records of the root zone KSKs (KSK-2017 and
+// KSK-2024), as published by IANA in root-anchors.xml.
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// RootTrustAnchors returns the built-in root trust anchors.
+func RootTrustAnchors() []*dns.DS {
+	out := make([]*dns.DS, 0, len(rootAnchors))
+	for _, s := range rootAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, rr.(*dns.DS))
+	}
+	return out
+}
+
+// errBogus marks a resolution whose DNSSEC validation failed.
+var errBogus = errors.New("DNSSEC validation failed")
+
+// trustAnchors returns the configured anchors, the root's by default.
+func (r *Resolver) trustAnchors() []*dns.DS {
+	if r.TrustAnchors != nil {
+		return r.TrustAnchors
+	}
+	return RootTrustAnchors()
+}
+
+// supportedAlgorithms are the DNSKEY algorithms we can verify; zones signed
+// only with others are treated as unsigned (RFC 4035 section 5.2).
+var supportedAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+// keyCache keeps validated DNSKEY sets by zone for their TTL, so the chain
+// of trust isn't re-fetched for every resolution.
+type keyCache struct {
+	mu sync.Mutex
+	m  map[string]keyEntry
+}
+
+type keyEntry struct {
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+func (c *keyCache) get(zone string) []*dns.DNSKEY {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[zone]
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	return e.keys
+}
+
+func (c *keyCache) put(zone string, keys []*dns.DNSKEY, ttl uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]keyEntry)
+	}
+	c.m[zone] = keyEntry{keys: keys, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// validator follows one iterative resolution down the chain of trust. keys
+// holds the validated DNSKEYs of the zone cut being queried; nil once an
+// insecure delegation was crossed, below which nothing validates.
+type validator struct {
+	r      *Resolver
+	ctx    context.Context
+	cu, ct *dns.Client
+	keys   []*dns.DNSKEY
+	// secure is cleared when data we can't vouch for (insecure zones,
+	// records signed by a zone we have no keys for) enters the answer.
+	secure bool
+}
+
+// enter makes zone the current cut: its DNSKEY set is fetched from servers
+// and must be signed by a key matching one of ds. Empty ds (or only
+// unsupported algorithms) makes the zone insecure.
+func (v *validator) enter(zone string, servers []string, ds []*dns.DS) error {
+	zone = strings.ToLower(zone)
+	var usable []*dns.DS
+	for _, d := range ds {
+		if supportedAlgorithms[d.Algorithm] {
+			usable = append(usable, d)
+		}
+	}
+	if len(usable) == 0 {
+		v.keys, v.secure = nil, false
+		return nil
+	}
+	if keys := v.r.dnskeys.get(zone); keys != nil {
+		v.keys = keys
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeDNSKEY)
+	m.RecursionDesired = false
+	m.SetEdns0(maxUDPSize, true)
+	resp := v.r.exchange(v.ctx, v.cu, v.ct, servers, m)
+	if resp == nil {
+		if v.ctx.Err() != nil {
+			return errDeadline
+		}
+		return errBogus
+	}
+	sets, sigs := rrsets(resp.Answer)
+	k := rrsetKey{zone, dns.TypeDNSKEY}
+	var keys []*dns.DNSKEY
+	for _, rr := range sets[k] {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	for _, d := range usable {
+		for _, key := range keys {
+			if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+				continue
+			}
+			kds := key.ToDS(d.DigestType)
+			if kds == nil || !strings.EqualFold(kds.Digest, d.Digest) {
+				continue
+			}
+			if verifyRRset(sets[k], sigs[k], []*dns.DNSKEY{key}, zone) {
+				v.keys = keys
+				v.r.dnskeys.put(zone, keys, sets[k][0].Header().Ttl)
+				return nil
+			}
+		}
+	}
+	return errBogus
+}
+
+// done reports whether the resolution validated all the way: the value
+// for the response's AD bit. A nil validator (validation off) never does.
+func (v *validator) done() bool {
+	return v != nil && v.keys != nil && v.secure
+}
+
+// referral validates the delegation from cut to child in resp and returns
+// the child's DS set, or nil when the parent proves it has none (an
+// unsigned child).
+func (v *validator) referral(resp *dns.Msg, cut, child string) ([]*dns.DS, error) {
+	sets, sigs := rrsets(resp.Ns)
+	child = strings.ToLower(child)
+	if set := sets[rrsetKey{child, dns.TypeDS}]; len(set) > 0 {
+		if !verifyRRset(set, sigs[rrsetKey{child, dns.TypeDS}], v.keys, cut) {
+			return nil, errBogus
+		}
+		ds := make([]*dns.DS, 0, len(set))
+		for _, rr := range set {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return ds, nil
+	}
+	// No DS: a signed NSEC/NSEC3 has to show there is none.
+	for k, set := range sets {
+		if (k.t != dns.TypeNSEC && k.t != dns.TypeNSEC3) || !verifyRRset(set, sigs[k], v.keys, cut) {
+			continue
+		}
+		for _, rr := range set {
+			switch x := rr.(type) {
+			case *dns.NSEC:
+				if strings.EqualFold(x.Hdr.Name, child) && !hasType(x.TypeBitMap, dns.TypeDS) {
+					return nil, nil
+				}
+			case *dns.NSEC3:
+				if x.Match(child) && !hasType(x.TypeBitMap, dns.TypeDS) {
+					return nil, nil
+				}
+				if x.Cover(child) && x.Flags&1 == 1 { // opt-out span
+					return nil, nil
+				}
+			}
+		}
+	}
+	return nil, errBogus
+}
+
+// check validates the answer and authority RRsets of a final response from
+// cut's servers. Records outside cut or signed by another zone can't be
+// vouched for and only clear secure; unsigned or badly signed records of
+// cut itself are bogus. Denial records are checked for valid signatures,
+// not for a complete proof of nonexistence.
+func (v *validator) check(resp *dns.Msg, cut string) error {
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		sets, sigs := rrsets(section)
+		for k, set := range sets {
+			if !dns.IsSubDomain(cut, k.name) || (len(sigs[k]) > 0 && !signedBy(sigs[k], cut)) {
+				v.secure = false
+				continue
+			}
+			if k.t == dns.TypeCNAME && len(sigs[k]) == 0 && fromDNAME(set[0].(*dns.CNAME), sets) {
+				// synthesized CNAMEs are unsigned; the DNAME is checked
+				continue
+			}
+			if !verifyRRset(set, sigs[k], v.keys, cut) {
+				return errBogus
+			}
+		}
+	}
+	return nil
+}
+
+// localDS returns the DS records for child in a referral from the local
+// root copy, which is trusted as loaded.
+func localDS(resp *dns.Msg, child string) []*dns.DS {
+	var ds []*dns.DS
+	for _, rr := range resp.Ns {
+		if d, ok := rr.(*dns.DS); ok && strings.EqualFold(d.Hdr.Name, child) {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+type rrsetKey struct {
+	name string
+	t    uint16
+}
+
+// rrsets groups rrs into RRsets and the RRSIGs covering each.
+func rrsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	sets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := rrsetKey{name, sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		k := rrsetKey{name, rr.Header().Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	return sets, sigs
+}
+
+// verifyRRset reports whether one of sigs by signer is currently valid for
+// rrs under one of keys.
+func verifyRRset(rrs []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, signer string) bool {
+	if len(rrs) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, signer) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrs) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fromDNAME reports whether cname is the CNAME synthesized (RFC 6672) from
+// one of the DNAMEs in sets.
+func fromDNAME(cname *dns.CNAME, sets map[rrsetKey][]dns.RR) bool {
+	for k, set := range sets {
+		if k.t != dns.TypeDNAME || !dns.IsSubDomain(k.name, strings.ToLower(cname.Hdr.Name)) {
+			continue
+		}
+		d := set[0].(*dns.DNAME)
+		prefix := cname.Hdr.Name[:len(cname.Hdr.Name)-len(d.Hdr.Name)]
+		if strings.EqualFold(prefix+d.Target, cname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+func signedBy(sigs []*dns.RRSIG, signer string) bool {
+	for _, sig := range sigs {
+		if strings.EqualFold(sig.SignerName, signer) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// forClient adapts a resolver answer, validated or not, to what req asked
+// for: AD only for clients that set DO or AD (RFC 6840 section 5.7), and
+// DNSSEC records only for DO clients.
+func forClient(req, m *dns.Msg, do bool) *dns.Msg {
+	strip := !do && hasDNSSECRecords(m)
+	clearAD := m.AuthenticatedData && !do && !req.AuthenticatedData
+	if !strip && !clearAD {
+		return m
+	}
+	m = m.Copy()
+	if clearAD {
+		m.AuthenticatedData = false
+	}
+	if strip {
+		qtype := req.Question[0].Qtype
+		keep := func(t uint16) bool { return t == qtype || !isDNSSECType(t) }
+		m.Answer = filterRRs(m.Answer, keep)
+		m.Ns = filterRRs(m.Ns, keep)
+	}
+	return m
+}
+
+func hasDNSSECRecords(m *dns.Msg) bool {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if isDNSSECType(rr.Header().Rrtype) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isDNSSECType(t uint16) bool {
+	switch t {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package dnsserver
+
+import (
+	"net/netip"
+
+	"smart-dns/internal/acl"
+	"smart-dns/internal/cache"
+	"smart-dns/internal/zone"
+
+	"github.com/miekg/dns"
+)
+
+// View is a split-horizon view: clients in Match are answered from Zones
+// instead of the default store, with cache entries of their own. A view is
+// complete on its own; zones it lacks are not looked up in the default store.
+type View struct {
+	Name  string
+	Match acl.List
+	Zones *zone.Store
+}
+
+// viewFor picks the zones and cache serving client: the first view that
+// matches, else the defaults.
+func (r *Resolver) viewFor(client netip.Addr) (*zone.Store, cache.Cache[*dns.Msg]) {
+	for i := range r.Views {
+		if r.Views[i].Match.Contains(client) {
+			return r.Views[i].Zones, r.Cache.ForView(r.Views[i].Name)
+		}
+	}
+	return r.Zones, r.Cache
+}
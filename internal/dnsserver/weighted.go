@@ -0,0 +1,15 @@
+package dnsserver
+
+import (
+	"github.com/miekg/dns"
+)
+
+// weightedOrder returns rrs ordered by r.pick: each address is picked
+// ahead of the rest with probability proportional to its weight.
+func (r *Resolver) weightedOrder(rrs []dns.RR, weights []uint32) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, j := range r.pick.Order(weights) {
+		out[i] = rrs[j]
+	}
+	return out
+}
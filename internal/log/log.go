@@ -20,3 +20,12 @@ func New(level string) *slog.Logger {
 	h := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: lvl})
 	return slog.New(h)
 }
+
+// NewQueryLog returns a logger that appends JSON lines to path.
+func NewQueryLog(path string) (*slog.Logger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(slog.NewJSONHandler(f, nil)), nil
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"net/http"
+
+	"smart-dns/internal/cache"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics exported at /metrics in Prometheus text format.
+var (
+	// Queries counts answered queries by qtype ("other" for types without
+	// a mnemonic) and rcode; QueryDuration times ServeDNS end to end.
+	Queries       = promauto.NewCounterVec(prometheus.CounterOpts{Name: "smartdns_queries_total", Help: "Answered queries by qtype and rcode."}, []string{"qtype", "rcode"})
+	QueryDuration = promauto.NewHistogram(prometheus.HistogramOpts{Name: "smartdns_query_duration_seconds", Help: "Time to answer a query.", Buckets: prometheus.ExponentialBuckets(0.00005, 4, 10)})
+
+	// CacheHits counts response cache lookups by result: "hit", "miss",
+	// "negative_hit" (cached SERVFAIL) or "stale" (serve-stale).
+	CacheHits = promauto.NewCounterVec(prometheus.CounterOpts{Name: "smartdns_cache_hits_total", Help: "Response cache lookups by result."}, []string{"result"})
+
+	// UDPResponseSize counts UDP responses by how they compare to the
+	// client's advertised buffer (512 without EDNS): "fit", "truncated" (TC
+	// set to make it fit), "type_limit" (over a per-qtype cap) or
+	// "rate_limited" (truncated by RRL, whatever its size).
+	UDPResponseSize = promauto.NewCounterVec(prometheus.CounterOpts{Name: "smartdns_udp_response_size_total", Help: "UDP responses by size against the client's buffer."}, []string{"outcome"})
+
+	// Transfers counts outgoing AXFR requests by result: "ok", "refused",
+	// "throttled" or "error". TransfersActive is the number in progress.
+	Transfers       = promauto.NewCounterVec(prometheus.CounterOpts{Name: "smartdns_transfers_total", Help: "Outgoing zone transfer requests by result."}, []string{"result"})
+	TransfersActive = promauto.NewGauge(prometheus.GaugeOpts{Name: "smartdns_transfers_active", Help: "Outgoing zone transfers in progress."})
+
+	// Updates counts dynamic updates (RFC 2136) by response code, lowercase
+	// ("noerror", "refused", "nxrrset", ...).
+	Updates = promauto.NewCounterVec(prometheus.CounterOpts{Name: "smartdns_updates_total", Help: "Dynamic updates by response code."}, []string{"rcode"})
+
+	// StaleAnswers counts expired cache entries served because resolution
+	// failed (serve-stale), by reason: "upstream_failed" or "cached_failure".
+	StaleAnswers = promauto.NewCounterVec(prometheus.CounterOpts{Name: "smartdns_stale_answers_total", Help: "Stale answers served on resolver failure."}, []string{"reason"})
+
+	// RateLimited counts UDP responses replaced by an empty TC=1 reply by
+	// response rate limiting.
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{Name: "smartdns_rrl_limited_total", Help: "UDP responses truncated by response rate limiting."})
+
+	// ResolverStartDepth is the label count of the zone cut iterative
+	// resolution starts from: 0 at the roots, more when a cached delegation
+	// lets it skip levels.
+	ResolverStartDepth = promauto.NewHistogram(prometheus.HistogramOpts{Name: "smartdns_resolver_start_depth", Help: "Labels in the zone cut iterative resolution starts from.", Buckets: prometheus.LinearBuckets(0, 1, 6)})
+
+	// ResolverNegativeHits counts resolver queries answered with a cached
+	// NXDOMAIN or NODATA instead of being resolved again.
+	ResolverNegativeHits = promauto.NewCounter(prometheus.CounterOpts{Name: "smartdns_resolver_negative_hits_total", Help: "Resolver queries answered from cached NXDOMAIN/NODATA."})
+
+	// CaseMismatches counts iterative resolver responses discarded for not
+	// echoing the query name's randomized case (--0x20).
+	CaseMismatches = promauto.NewCounter(prometheus.CounterOpts{Name: "smartdns_resolver_case_mismatches_total", Help: "Upstream responses discarded for a 0x20 case mismatch."})
+
+	// Blocked counts queries answered from the blocklist.
+	Blocked = promauto.NewCounter(prometheus.CounterOpts{Name: "smartdns_blocked_total", Help: "Queries for blocklisted names."})
+
+	// RPZHits counts queries matching a response policy zone rule, by the
+	// rule's action (rpz.Action).
+	RPZHits = promauto.NewCounterVec(prometheus.CounterOpts{Name: "smartdns_rpz_hits_total", Help: "Queries matching a response policy rule by action."}, []string{"action"})
+
+	// TCPConnections counts TCP/DoT connections by result: "accepted", or
+	// "dropped" when over the per-listener connection cap.
+	TCPConnections = promauto.NewCounterVec(prometheus.CounterOpts{Name: "smartdns_tcp_connections_total", Help: "TCP and DoT connections by accept result."}, []string{"result"})
+)
+
+// RegisterCacheStats exports the response cache's own counters and sizes
+// (cache.Stats), read from stats at scrape time. Unlike CacheHits, which
+// counts client queries by how they were answered, the lookup counters
+// count every cache lookup: a query may make several (the resolver path
+// looks again, then for a denial), and DNS64 and RPZ targets make their own.
+func RegisterCacheStats(stats func() cache.Stats) {
+	counter := func(name, help string, value func(cache.Stats) uint64) {
+		promauto.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 { return float64(value(stats())) })
+	}
+	gauge := func(name, help string, value func(cache.Stats) int) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 { return float64(value(stats())) })
+	}
+	counter("smartdns_cache_positive_hits_total", "Positive cache lookups answered from the cache.", func(s cache.Stats) uint64 { return s.PositiveHits })
+	counter("smartdns_cache_negative_hits_total", "Negative cache lookups answered from the cache.", func(s cache.Stats) uint64 { return s.NegativeHits })
+	counter("smartdns_cache_misses_total", "Positive cache lookups that found no live entry.", func(s cache.Stats) uint64 { return s.Misses })
+	counter("smartdns_cache_evictions_total", "Cache entries evicted by the size limit.", func(s cache.Stats) uint64 { return s.Evictions })
+	counter("smartdns_cache_expired_total", "Cache entries dropped past their TTL.", func(s cache.Stats) uint64 { return s.Expired })
+	gauge("smartdns_cache_positive_entries", "Entries in the positive cache.", func(s cache.Stats) int { return s.PositiveEntries })
+	gauge("smartdns_cache_negative_entries", "Entries in the negative cache.", func(s cache.Stats) int { return s.NegativeEntries })
+}
+
+// Handler serves the default registry, Go runtime and process metrics
+// included.
+func Handler() http.Handler { return promhttp.Handler() }
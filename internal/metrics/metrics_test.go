@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"testing"
+
+	"smart-dns/internal/cache"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRegisterCacheStats(t *testing.T) {
+	RegisterCacheStats(func() cache.Stats {
+		return cache.Stats{PositiveHits: 7, Misses: 2, PositiveEntries: 3}
+	})
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		got[mf.GetName()] = mf
+	}
+	for name, want := range map[string]struct {
+		typ   dto.MetricType
+		value float64
+	}{
+		"smartdns_cache_positive_hits_total": {dto.MetricType_COUNTER, 7},
+		"smartdns_cache_misses_total":        {dto.MetricType_COUNTER, 2},
+		"smartdns_cache_expired_total":       {dto.MetricType_COUNTER, 0},
+		"smartdns_cache_positive_entries":    {dto.MetricType_GAUGE, 3},
+	} {
+		mf := got[name]
+		if mf == nil {
+			t.Errorf("%s not registered", name)
+			continue
+		}
+		m := mf.GetMetric()[0]
+		value := m.GetGauge().GetValue()
+		if mf.GetType() == dto.MetricType_COUNTER {
+			value = m.GetCounter().GetValue()
+		}
+		if mf.GetType() != want.typ || value != want.value {
+			t.Errorf("%s: %s %v, want %s %v", name, mf.GetType(), value, want.typ, want.value)
+		}
+	}
+}
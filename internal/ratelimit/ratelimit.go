@@ -0,0 +1,102 @@
+// Package ratelimit implements DNS Response Rate Limiting (RRL): token
+// buckets keyed by the client's network and the response it is getting, so a
+// spoofed victim can't be flooded with identical answers.
+package ratelimit
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client networks share a bucket: /24 for IPv4, /56 for IPv6.
+const (
+	v4Bits = 24
+	v6Bits = 56
+)
+
+type key struct {
+	net   netip.Prefix
+	name  string
+	rcode int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter allows rate responses per second per bucket, with bursts of up to
+// rate*window. A nil Limiter allows everything.
+type Limiter struct {
+	rate   float64
+	burst  float64
+	window time.Duration
+
+	mu        sync.Mutex
+	buckets   map[key]*bucket
+	lastSweep time.Time
+}
+
+// New returns a limiter, or nil (no limiting) when perSecond is 0.
+func New(perSecond int, window time.Duration) *Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+	return &Limiter{
+		rate:    float64(perSecond),
+		burst:   float64(perSecond) * window.Seconds(),
+		window:  window,
+		buckets: make(map[key]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket for (client network, name, rcode) and
+// reports whether the response may be sent.
+func (l *Limiter) Allow(client netip.Addr, name string, rcode int) bool {
+	if l == nil || !client.IsValid() {
+		return true
+	}
+	bits := v6Bits
+	if client.Is4() {
+		bits = v4Bits
+	}
+	pfx, _ := client.Prefix(bits)
+	k := key{net: pfx, name: strings.ToLower(name), rcode: rcode}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b := l.buckets[k]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[k] = b
+	} else {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets idle for a whole window (they'd be full again), at
+// most once per window.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= l.window {
+			delete(l.buckets, k)
+		}
+	}
+}
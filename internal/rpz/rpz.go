@@ -0,0 +1,213 @@
+// Package rpz loads a Response Policy Zone (RPZ): a zone in RFC 1035 master
+// format whose owner names, relative to its apex, are query names to
+// override, and whose records say how.
+package rpz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Action is what a policy rule does to a query it matches.
+type Action string
+
+// Actions, chosen by a rule's CNAME target (any other target rewrites).
+const (
+	NXDomain  Action = "nxdomain"   // CNAME .
+	NoData    Action = "nodata"     // CNAME *.
+	Passthru  Action = "passthru"   // CNAME rpz-passthru.: answer as usual
+	Drop      Action = "drop"       // CNAME rpz-drop.: don't answer at all
+	Rewrite   Action = "cname"      // CNAME to any other name
+	LocalData Action = "local_data" // other records, answered in place of the real ones
+)
+
+// Rule is the policy for one trigger.
+type Rule struct {
+	Action Action
+	// Target is the CNAME target of a Rewrite, TTL the TTL to answer it
+	// with.
+	Target string
+	TTL    uint32
+	// Records are the LocalData records, as written in the zone; they are
+	// answered under the query name.
+	Records []dns.RR
+}
+
+// Policy is a response policy zone loaded from a file. It is safe for
+// concurrent use; Reload swaps in the file's current contents.
+type Policy struct {
+	path  string
+	rules atomic.Pointer[rules]
+}
+
+// rules are keyed by lowercase trigger FQDN. A rule in names matches that
+// name only; one in wildcards ("*.example.com" in the zone) the names
+// below it.
+type rules struct {
+	zone      string
+	soa       *dns.SOA
+	names     map[string]*Rule
+	wildcards map[string]*Rule
+	// skipped counts records of trigger kinds not supported: response IP,
+	// NSDNAME, NSIP and client IP triggers.
+	skipped int
+}
+
+// New loads the zone at path.
+func New(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Path returns the file the policy is loaded from.
+func (p *Policy) Path() string { return p.path }
+
+// Reload re-reads the file. On error the previous policy stays in use.
+func (p *Policy) Reload() error {
+	rs, err := load(p.path)
+	if err != nil {
+		return err
+	}
+	p.rules.Store(rs)
+	return nil
+}
+
+// Zone returns the apex of the policy zone.
+func (p *Policy) Zone() string { return p.rules.Load().zone }
+
+// SOA returns a copy of the policy zone's SOA record.
+func (p *Policy) SOA() *dns.SOA { return dns.Copy(p.rules.Load().soa).(*dns.SOA) }
+
+// Len returns the number of triggers loaded.
+func (p *Policy) Len() int {
+	rs := p.rules.Load()
+	return len(rs.names) + len(rs.wildcards)
+}
+
+// Skipped returns the number of records ignored for using triggers other
+// than QNAME.
+func (p *Policy) Skipped() int { return p.rules.Load().skipped }
+
+// Match returns the rule for name: its own, else that of the closest
+// wildcard above it, else nil.
+func (p *Policy) Match(name string) *Rule {
+	rs := p.rules.Load()
+	name = dns.CanonicalName(name)
+	if rule, ok := rs.names[name]; ok {
+		return rule
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule, ok := rs.wildcards[name[off:]]; ok {
+			return rule
+		}
+	}
+	if rule, ok := rs.wildcards["."]; ok && name != "." {
+		return rule
+	}
+	return nil
+}
+
+func load(path string) (*rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	base := filepath.Base(path)
+	zp := dns.NewZoneParser(f, dns.Fqdn(strings.TrimSuffix(base, filepath.Ext(base))), path)
+	zp.SetIncludeAllowed(true)
+	var rrs []dns.RR
+	var soa *dns.SOA
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if s, isSOA := rr.(*dns.SOA); isSOA {
+			if soa != nil {
+				return nil, fmt.Errorf("%s: more than one SOA record", path)
+			}
+			soa = s
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if soa == nil {
+		return nil, fmt.Errorf("%s: SOA record required", path)
+	}
+	rs := &rules{
+		zone:      dns.CanonicalName(soa.Hdr.Name),
+		soa:       soa,
+		names:     make(map[string]*Rule),
+		wildcards: make(map[string]*Rule),
+	}
+	for _, rr := range rrs {
+		if err := rs.add(rr); err != nil {
+			return nil, fmt.Errorf("%s: %s %s: %w", path, rr.Header().Name, dns.TypeToString[rr.Header().Rrtype], err)
+		}
+	}
+	return rs, nil
+}
+
+func (rs *rules) add(rr dns.RR) error {
+	owner := dns.CanonicalName(rr.Header().Name)
+	if owner == rs.zone {
+		// the zone's own SOA and NS
+		return nil
+	}
+	if !dns.IsSubDomain(rs.zone, owner) {
+		return fmt.Errorf("outside zone %s", rs.zone)
+	}
+	trigger := owner[:len(owner)-len(rs.zone)]
+	if rs.zone == "." {
+		trigger = owner
+	}
+	labels := dns.SplitDomainName(trigger)
+	if strings.HasPrefix(labels[len(labels)-1], "rpz-") {
+		rs.skipped++
+		return nil
+	}
+	set := rs.names
+	if strings.HasPrefix(trigger, "*.") {
+		set, trigger = rs.wildcards, dns.Fqdn(trigger[2:])
+	}
+	rule := set[trigger]
+	if rule == nil {
+		rule = &Rule{Action: LocalData}
+		set[trigger] = rule
+	}
+	cname, isCNAME := rr.(*dns.CNAME)
+	if !isCNAME {
+		if rule.Action != LocalData {
+			return errors.New("CNAME and other data at the same trigger")
+		}
+		rule.Records = append(rule.Records, rr)
+		return nil
+	}
+	if rule.Action != LocalData || len(rule.Records) > 0 {
+		return errors.New("CNAME and other data at the same trigger")
+	}
+	switch target := dns.CanonicalName(cname.Target); {
+	case target == ".":
+		rule.Action = NXDomain
+	case target == "*.":
+		rule.Action = NoData
+	case target == "rpz-passthru.":
+		rule.Action = Passthru
+	case target == "rpz-drop.":
+		rule.Action = Drop
+	case strings.HasPrefix(target, "rpz-") || strings.HasPrefix(target, "*."):
+		return fmt.Errorf("unsupported policy %s", cname.Target)
+	default:
+		rule.Action, rule.Target, rule.TTL = Rewrite, cname.Target, cname.Hdr.Ttl
+	}
+	return nil
+}
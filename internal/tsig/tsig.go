@@ -0,0 +1,99 @@
+// Package tsig loads the shared-secret keys (RFC 8945) that authenticate
+// zone transfers.
+package tsig
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fudge is the clock skew allowed on messages we sign.
+const fudge = 300
+
+// Key is one named secret.
+type Key struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"` // e.g. hmac-sha256 (the default)
+	Secret    string `json:"secret"`    // base64
+}
+
+// Keys maps canonical key names to keys.
+type Keys map[string]Key
+
+var algorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Load reads a JSON array of keys:
+//
+//	[{"name": "xfr.example.", "algorithm": "hmac-sha256", "secret": "base64..."}]
+func Load(path string) (Keys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Key
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	keys := make(Keys, len(list))
+	for _, k := range list {
+		if k.Name == "" {
+			return nil, errors.New("key without name")
+		}
+		k.Name = dns.CanonicalName(k.Name)
+		if k.Algorithm == "" {
+			k.Algorithm = "hmac-sha256"
+		}
+		alg, ok := algorithms[strings.TrimSuffix(strings.ToLower(k.Algorithm), ".")]
+		if !ok {
+			return nil, fmt.Errorf("key %s: unsupported algorithm %q", k.Name, k.Algorithm)
+		}
+		k.Algorithm = alg
+		if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || k.Secret == "" {
+			return nil, fmt.Errorf("key %s: secret must be base64", k.Name)
+		}
+		if _, dup := keys[k.Name]; dup {
+			return nil, fmt.Errorf("key %s defined twice", k.Name)
+		}
+		keys[k.Name] = k
+	}
+	return keys, nil
+}
+
+// Secrets returns the keys in the form dns.Server, dns.Client and
+// dns.Transfer take as TsigSecret.
+func (ks Keys) Secrets() map[string]string {
+	out := make(map[string]string, len(ks))
+	for name, k := range ks {
+		out[name] = k.Secret
+	}
+	return out
+}
+
+// Lookup returns the key called name, if any.
+func (ks Keys) Lookup(name string) (Key, bool) {
+	k, ok := ks[dns.CanonicalName(name)]
+	return k, ok
+}
+
+// Sign adds a TSIG record for k to m; it is computed when m is written.
+func (k Key) Sign(m *dns.Msg) {
+	m.SetTsig(k.Name, k.Algorithm, fudge, time.Now().Unix())
+}
+
+// Secrets is the TsigSecret map for k alone.
+func (k Key) Secrets() map[string]string {
+	return map[string]string{k.Name: k.Secret}
+}
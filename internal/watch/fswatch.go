@@ -2,10 +2,13 @@ package watch
 
 import (
 	"context"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"smart-dns/internal/zone"
+
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -14,6 +17,16 @@ type ZoneReloader interface {
 	OnZoneRemoved(zone string)
 }
 
+// debounce is how long WatchDir waits after the last event for a path
+// before acting on it.
+const debounce = 100 * time.Millisecond
+
+// WatchDir reports changes to the zone files in dir until ctx is done.
+// Events are coalesced per path: once a path has been quiet for the
+// debounce window, it is reloaded if the file exists (written, created or
+// renamed into place) and removed otherwise. Files already present are
+// reconciled once at start, so changes made between the initial load and
+// the watch taking effect aren't missed.
 func WatchDir(ctx context.Context, dir string, r ZoneReloader) error {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -23,26 +36,96 @@ func WatchDir(ctx context.Context, dir string, r ZoneReloader) error {
 	if err := w.Add(dir); err != nil {
 		return err
 	}
+	pending := make(map[string]time.Time) // path -> last event
+	// the ticker only runs while something is pending
+	var tick *time.Ticker
+	var tickC <-chan time.Time
+	touch := func(path string) {
+		pending[path] = time.Now()
+		if tick == nil {
+			tick = time.NewTicker(debounce / 2)
+			tickC = tick.C
+		}
+	}
+	defer func() {
+		if tick != nil {
+			tick.Stop()
+		}
+	}()
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			if !e.IsDir() && zone.IsZoneFile(strings.ToLower(e.Name())) {
+				touch(filepath.Join(dir, e.Name()))
+			}
+		}
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case ev := <-w.Events:
-			name := strings.ToLower(ev.Name)
-			if !strings.HasSuffix(name, ".dns") {
+			if !zone.IsZoneFile(strings.ToLower(ev.Name)) || ev.Op == fsnotify.Chmod {
 				continue
 			}
-			// Debounce brief burst
-			time.AfterFunc(100*time.Millisecond, func() {
-				if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
-					// zone name equals filename without dir
-					base := filepath.Base(name)
-					zone := strings.TrimSuffix(base, filepath.Ext(base))
-					r.OnZoneRemoved(zone)
-					return
+			touch(ev.Name)
+		case <-tickC:
+			for path, last := range pending {
+				if time.Since(last) < debounce {
+					continue
+				}
+				delete(pending, path)
+				if _, err := os.Stat(path); err == nil {
+					r.OnZoneUpdated(path)
+					continue
 				}
-				r.OnZoneUpdated(name)
-			})
+				// zone name equals filename without dir
+				base := strings.ToLower(filepath.Base(path))
+				r.OnZoneRemoved(strings.TrimSuffix(base, filepath.Ext(base)))
+			}
+			if len(pending) == 0 {
+				tick.Stop()
+				tick, tickC = nil, nil
+			}
+		case <-w.Errors:
+			// ignore
+		}
+	}
+}
+
+// WatchFiles calls onChange (debounced) whenever one of paths is written,
+// created or replaced. It watches the files' directories, so editors and
+// tools that replace a file by renaming a new one over it are seen too.
+func WatchFiles(ctx context.Context, paths []string, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	files := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		files[abs] = true
+		if err := w.Add(filepath.Dir(abs)); err != nil {
+			return err
+		}
+	}
+	var pending *time.Timer
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-w.Events:
+			if !files[filepath.Clean(ev.Name)] || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			// one reload per burst of writes
+			if pending != nil {
+				pending.Stop()
+			}
+			pending = time.AfterFunc(100*time.Millisecond, onChange)
 		case <-w.Errors:
 			// ignore
 		}
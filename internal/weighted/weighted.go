@@ -0,0 +1,58 @@
+package weighted
+
+import (
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+)
+
+// Picker orders records by weight for crude load balancing. It owns its RNG
+// so a fixed seed gives a reproducible sequence. Safe for concurrent use.
+type Picker struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func New(seed uint64) *Picker {
+	return &Picker{rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// Default is the weight assumed for records that don't specify one (weight
+// 0): the mean of the specified weights, so a partly weighted set neither
+// starves nor favors the unweighted records. With no weights at all every
+// record counts as 1, i.e. plain equal weighting.
+func Default(weights []uint32) uint32 {
+	var sum, n uint64
+	for _, w := range weights {
+		if w > 0 {
+			sum += uint64(w)
+			n++
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return uint32(max(1, (sum+n/2)/n))
+}
+
+// Order returns a permutation of 0..len(weights)-1 drawn without
+// replacement: each position picks among the remaining records with
+// probability proportional to weight. Zero weights get Default(weights).
+func (p *Picker) Order(weights []uint32) []int {
+	def := Default(weights)
+	keys := make([]float64, len(weights))
+	idx := make([]int, len(weights))
+	p.mu.Lock()
+	for i, w := range weights {
+		if w == 0 {
+			w = def
+		}
+		// Efraimidis-Spirakis: sorting by u^(1/w) samples by weight.
+		keys[i] = math.Pow(p.rng.Float64(), 1/float64(w))
+		idx[i] = i
+	}
+	p.mu.Unlock()
+	sort.SliceStable(idx, func(a, b int) bool { return keys[idx[a]] > keys[idx[b]] })
+	return idx
+}
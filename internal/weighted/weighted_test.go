@@ -0,0 +1,84 @@
+package weighted
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		weights []uint32
+		want    uint32
+	}{
+		{nil, 1},
+		{[]uint32{0, 0}, 1},
+		{[]uint32{3, 0}, 3},
+		{[]uint32{1, 2, 0}, 2}, // mean 1.5 rounds up
+		{[]uint32{10, 20, 30, 0}, 20},
+	}
+	for _, tt := range tests {
+		if got := Default(tt.weights); got != tt.want {
+			t.Errorf("Default(%v) = %d, want %d", tt.weights, got, tt.want)
+		}
+	}
+}
+
+// firstShares returns how often each record comes first over n orderings.
+func firstShares(p *Picker, weights []uint32, n int) []float64 {
+	counts := make([]int, len(weights))
+	for i := 0; i < n; i++ {
+		counts[p.Order(weights)[0]]++
+	}
+	shares := make([]float64, len(weights))
+	for i, c := range counts {
+		shares[i] = float64(c) / float64(n)
+	}
+	return shares
+}
+
+func TestOrderDistribution(t *testing.T) {
+	const n = 100000
+	tests := []struct {
+		name    string
+		weights []uint32
+		want    []float64 // expected share of first places
+	}{
+		{"equal", []uint32{0, 0, 0, 0}, []float64{.25, .25, .25, .25}},
+		{"weighted", []uint32{1, 3}, []float64{.25, .75}},
+		{"three", []uint32{5, 3, 2}, []float64{.5, .3, .2}},
+		// The unweighted record counts as the mean, 2.
+		{"partly weighted", []uint32{1, 3, 0}, []float64{1. / 6, .5, 1. / 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := firstShares(New(1), tt.weights, n)
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 0.01 {
+					t.Errorf("record %d first %.3f of the time, want %.3f", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOrderPermutation(t *testing.T) {
+	p := New(1)
+	for i := 0; i < 1000; i++ {
+		got := p.Order([]uint32{7, 0, 1, 0, 3})
+		slices.Sort(got)
+		if !slices.Equal(got, []int{0, 1, 2, 3, 4}) {
+			t.Fatalf("Order returned %v, not a permutation", got)
+		}
+	}
+}
+
+func TestOrderSeeded(t *testing.T) {
+	weights := []uint32{1, 2, 3, 4}
+	a, b := New(42), New(42)
+	for i := 0; i < 100; i++ {
+		if x, y := a.Order(weights), b.Order(weights); !slices.Equal(x, y) {
+			t.Fatalf("same seed, order %d differs: %v and %v", i, x, y)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package zone
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// dedupe collapses identical rdata within the RRset, keeping the first
+// occurrence, and returns how many records it dropped.
+func (rs *RRSet) dedupe() int {
+	var n, d int
+	switch {
+	case rs.Weights != nil && rs.Type == TypeA:
+		rs.A, rs.Weights, d = dedupeWeighted(rs.A, rs.Weights)
+		n += d
+	case rs.Weights != nil && rs.Type == TypeAAAA:
+		rs.AAAA, rs.Weights, d = dedupeWeighted(rs.AAAA, rs.Weights)
+		n += d
+	default:
+		rs.A, d = uniq(rs.A, func(ip net.IP) string { return ip.String() })
+		n += d
+		rs.AAAA, d = uniq(rs.AAAA, func(ip net.IP) string { return ip.String() })
+		n += d
+	}
+	rs.NS, d = uniq(rs.NS, func(s string) string { return s })
+	n += d
+	rs.PTR, d = uniq(rs.PTR, func(s string) string { return s })
+	n += d
+	rs.TXT, d = uniq(rs.TXT, func(s string) string { return s })
+	n += d
+	rs.MX, d = uniq(rs.MX, func(m MX) string { return fmt.Sprint(m) })
+	n += d
+	rs.SRV, d = uniq(rs.SRV, func(s SRV) string { return fmt.Sprint(s) })
+	n += d
+	rs.CAA, d = uniq(rs.CAA, func(c CAA) string { return fmt.Sprint(c) })
+	n += d
+	rs.SVCB, d = uniq(rs.SVCB, func(s SVCB) string { return fmt.Sprint(s.Priority, s.Target, s.Params) })
+	n += d
+	rs.HINFO, d = uniq(rs.HINFO, func(h HINFO) string { return fmt.Sprint(h) })
+	n += d
+	rs.LOC, d = uniq(rs.LOC, func(l LOC) string { return fmt.Sprint(l.Wire) })
+	n += d
+	rs.NAPTR, d = uniq(rs.NAPTR, func(x NAPTR) string { return fmt.Sprint(x) })
+	n += d
+	rs.RR, d = uniq(rs.RR, func(rr dns.RR) string { return rr.String() })
+	return n + d
+}
+
+func uniq[S ~[]E, E any](s S, key func(E) string) (S, int) {
+	if len(s) < 2 {
+		return s, 0
+	}
+	seen := make(map[string]struct{}, len(s))
+	out := s[:0]
+	for _, e := range s {
+		k := key(e)
+		if _, dup := seen[k]; dup {
+			continue
+		}
+		seen[k] = struct{}{}
+		out = append(out, e)
+	}
+	return out, len(s) - len(out)
+}
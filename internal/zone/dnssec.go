@@ -0,0 +1,71 @@
+package zone
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Pre-signed zones: DNSSEC records are carried verbatim from the zone file
+// (presentation-format RDATA in "values") and served as-is to DO=1 clients.
+
+// parseVerbatim turns presentation-format RDATA into RRs owned by fqdn.
+func parseVerbatim(fqdn string, rt RRType, ttl uint32, rdata []string) ([]dns.RR, error) {
+	out := make([]dns.RR, 0, len(rdata))
+	for _, v := range rdata {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", fqdn, ttl, rt, v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s at %s: %w", rt, fqdn, err)
+		}
+		if rr == nil || dns.TypeToString[rr.Header().Rrtype] != string(rt) {
+			return nil, fmt.Errorf("invalid %s at %s: %q", rt, fqdn, v)
+		}
+		out = append(out, rr)
+	}
+	return out, nil
+}
+
+// Signed reports whether the zone carries a DNSKEY at its apex.
+func (z *ZoneIndex) Signed() bool {
+	_, ok := z.ByName[z.ZoneFQDN][TypeDNSKEY]
+	return ok
+}
+
+// CoveringNSEC returns the owner of the NSEC record that covers (or matches)
+// name in canonical order, or "" if the zone has no NSEC chain.
+func (z *ZoneIndex) CoveringNSEC(name string) string {
+	if len(z.nsecOwners) == 0 {
+		return ""
+	}
+	name = strings.ToLower(name)
+	i := sort.Search(len(z.nsecOwners), func(i int) bool { return canonicalLess(name, z.nsecOwners[i]) })
+	if i == 0 {
+		// before the first owner: the last NSEC wraps around to the apex
+		return z.nsecOwners[len(z.nsecOwners)-1]
+	}
+	return z.nsecOwners[i-1]
+}
+
+func (z *ZoneIndex) indexNSEC() {
+	z.nsecOwners = z.nsecOwners[:0]
+	for name, m := range z.ByName {
+		if _, ok := m[TypeNSEC]; ok {
+			z.nsecOwners = append(z.nsecOwners, name)
+		}
+	}
+	sort.Slice(z.nsecOwners, func(i, j int) bool { return canonicalLess(z.nsecOwners[i], z.nsecOwners[j]) })
+}
+
+// canonicalLess orders lowercase names per RFC 4034 section 6.1.
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
@@ -0,0 +1,177 @@
+package zone
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ToZoneFile reconstructs the JSON schema from the in-memory index, so the
+// result re-imports through LoadZonesDir to an equivalent zone. Record names
+// are written as absolute FQDNs. The apex NS set always goes in NS, where
+// loading expects it (and gives it the default TTL again). A secondary zone
+// keeps its type and primary, so it re-imports as a secondary; its records
+// are those of the last transfer.
+func (z *ZoneIndex) ToZoneFile() *ZoneFile {
+	zf := &ZoneFile{
+		Zone:       z.ZoneFQDN,
+		Serial:     z.Serial,
+		TTLDefault: z.TTLDef,
+		MinTTL:     z.MinTTL,
+		View:       z.View,
+		SOA:        z.SOA,
+		Primary:    z.Primary,
+
+		MinimalResponses:     z.MinimalResponses,
+		AdditionalProcessing: z.AdditionalProcessing,
+		GeneratePTR:          z.GeneratePTR,
+		AlsoNotify:           z.AlsoNotify,
+		TSIGKey:              z.TSIGKey,
+	}
+	if z.Primary != "" {
+		zf.Type = "secondary"
+	}
+	names := make([]string, 0, len(z.ByName))
+	for name := range z.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := z.ByName[name]
+		types := make([]string, 0, len(m))
+		for t := range m {
+			types = append(types, string(t))
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			rs := m[RRType(t)]
+			if name == z.ZoneFQDN && rs.Type == TypeNS {
+				zf.NS = append(zf.NS, rs.NS...)
+				continue
+			}
+			ttl := rs.TTL
+			rec := RawRecord{Name: name, Type: t, TTL: &ttl}
+			switch rs.Type {
+			case TypeCNAME:
+				rec.Value = rs.CNAME
+			case TypeDNAME:
+				rec.Value = rs.DNAME
+			case TypeALIAS:
+				rec.Value = rs.ALIAS
+			case TypeA:
+				rec.Values = addrValues(rs.A, rs.Weights)
+			case TypeAAAA:
+				rec.Values = addrValues(rs.AAAA, rs.Weights)
+			case TypeNS:
+				rec.Values = rs.NS
+			case TypePTR:
+				rec.Values = rs.PTR
+			case TypeTXT:
+				rec.Values = rs.TXT
+			case TypeMX:
+				rec.Values = rs.MX
+			case TypeSRV:
+				rec.Values = rs.SRV
+			case TypeCAA:
+				rec.Values = rs.CAA
+			case TypeSVCB, TypeHTTPS:
+				rec.Values = rs.SVCB
+			case TypeHINFO:
+				rec.Values = rs.HINFO
+			case TypeLOC:
+				rec.Values = rs.LOC
+			case TypeNAPTR:
+				rec.Values = rs.NAPTR
+			case TypeDNSKEY, TypeDS, TypeRRSIG, TypeNSEC:
+				vals := make([]string, 0, len(rs.RR))
+				for _, rr := range rs.RR {
+					vals = append(vals, strings.TrimPrefix(rr.String(), rr.Header().String()))
+				}
+				rec.Values = vals
+			}
+			zf.Records = append(zf.Records, rec)
+		}
+	}
+	return zf
+}
+
+// Reindex indexes z as if it had been read from a file. ToIndex expects
+// values shaped like decoded JSON, which a ZoneFile built in memory (by
+// ToZoneFile, say) doesn't have, so z takes a trip through JSON first.
+func (z *ZoneFile) Reindex() (*ZoneIndex, error) {
+	b, err := json.Marshal(z)
+	if err != nil {
+		return nil, err
+	}
+	var decoded ZoneFile
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return nil, err
+	}
+	return decoded.ToIndex()
+}
+
+// WriteZoneFile writes zf to path as JSON or YAML, by the path's extension,
+// replacing the file atomically so a watcher never sees half of it. Master
+// files (.zone) are not written.
+func WriteZoneFile(path string, zf *ZoneFile) error {
+	var b []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".dns":
+		b, err = json.MarshalIndent(zf, "", "  ")
+	case ".yaml", ".yml":
+		b, err = yaml.Marshal(zf)
+	default:
+		return errors.New("only .dns and YAML zone files can be written")
+	}
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode().Perm())
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// addrValues writes weighted addresses as {"ip", "weight"} objects and
+// unweighted ones as plain strings.
+func addrValues(ips []net.IP, wts []uint32) any {
+	if wts == nil {
+		return ipStrings(ips)
+	}
+	out := make([]any, len(ips))
+	for i, ip := range ips {
+		if wts[i] == 0 {
+			out[i] = ip.String()
+			continue
+		}
+		out[i] = WeightedAddr{IP: ip.String(), Weight: wts[i]}
+	}
+	return out
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+package zone
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+// indexJSON indexes the JSON zone file src.
+func indexJSON(t *testing.T, src string) *ZoneIndex {
+	t.Helper()
+	var zf ZoneFile
+	if err := json.Unmarshal([]byte(src), &zf); err != nil {
+		t.Fatal(err)
+	}
+	zi, err := zf.ToIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zi
+}
+
+func TestToZoneFileApexNS(t *testing.T) {
+	// The apex NS set ends up with the lower TTL of the extra record.
+	zi := indexJSON(t, `{
+  "zone": "example.com.", "serial": 7, "ttl_default": 300,
+  "soa": {"mname": "ns1.example.com.", "rname": "hostmaster.example.com."},
+  "ns": ["ns1.example.com."],
+  "records": [
+    {"name": "@", "type": "NS", "ttl": 60, "values": ["ns2.example.com."]},
+    {"name": "www", "type": "A", "values": ["192.0.2.1"]}
+  ]
+}`)
+	zf := zi.ToZoneFile()
+	if want := []string{"ns1.example.com.", "ns2.example.com."}; !slices.Equal(zf.NS, want) {
+		t.Errorf("NS = %v, want %v", zf.NS, want)
+	}
+	for _, rec := range zf.Records {
+		if rec.Type == string(TypeNS) {
+			t.Errorf("apex NS exported as a record too: %+v", rec)
+		}
+	}
+	back, err := zf.Reindex()
+	if err != nil {
+		t.Fatalf("exported zone doesn't re-import: %v", err)
+	}
+	if got := back.ByName["example.com."][TypeNS].NS; !slices.Equal(got, zf.NS) {
+		t.Errorf("re-imported NS = %v, want %v", got, zf.NS)
+	}
+	if back.Serial != 7 || back.ByName["www.example.com."][TypeA] == nil {
+		t.Errorf("re-imported zone lost data: serial %d, names %v", back.Serial, back.ByName)
+	}
+}
+
+func TestToZoneFileSecondary(t *testing.T) {
+	zi := indexJSON(t, `{"zone": "example.org", "type": "secondary", "primary": "192.0.2.53:53"}`)
+	zf := zi.ToZoneFile()
+	if zf.Type != "secondary" || zf.Primary != "192.0.2.53:53" {
+		t.Fatalf("exported type %q, primary %q", zf.Type, zf.Primary)
+	}
+	back, err := zf.Reindex()
+	if err != nil {
+		t.Fatalf("exported secondary doesn't re-import: %v", err)
+	}
+	if back.Primary != "192.0.2.53:53" {
+		t.Errorf("re-imported primary %q", back.Primary)
+	}
+}
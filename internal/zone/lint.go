@@ -0,0 +1,172 @@
+package zone
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Lint reports problems in a zone that indexes but likely doesn't do what
+// was meant: CNAME/MX/NS/SRV targets inside the zone that have nothing to
+// resolve to and apex NS hosts inside the zone without glue. The zone is
+// served as is; --strict-zones refuses it instead.
+func (zi *ZoneIndex) Lint() []string {
+	var out []string
+	names := make([]string, 0, len(zi.ByName))
+	for name := range zi.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		types := make([]string, 0, len(zi.ByName[name]))
+		for t := range zi.ByName[name] {
+			types = append(types, string(t))
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			rs := zi.ByName[name][RRType(t)]
+			var targets []string
+			needAddr := true
+			switch rs.Type {
+			case TypeCNAME:
+				targets, needAddr = []string{rs.CNAME}, false
+			case TypeMX:
+				for _, mx := range rs.MX {
+					targets = append(targets, mx.Host)
+				}
+			case TypeNS:
+				if name == zi.ZoneFQDN {
+					out = append(out, zi.missingGlue(rs.NS)...)
+					continue
+				}
+				targets = rs.NS
+			case TypeSRV:
+				for _, srv := range rs.SRV {
+					targets = append(targets, srv.Target)
+				}
+			}
+			for _, target := range targets {
+				if !zi.danglingTarget(target, needAddr) {
+					continue
+				}
+				what := "no records"
+				if needAddr {
+					what = "no A/AAAA records"
+				}
+				out = append(out, fmt.Sprintf("%s %s target %s has %s", name, rs.Type, target, what))
+			}
+		}
+	}
+	return out
+}
+
+// missingGlue reports apex NS hosts in the zone's own data without A or
+// AAAA records; resolvers need those addresses in referrals from the
+// parent, which a CNAME or wildcard can't supply.
+func (zi *ZoneIndex) missingGlue(hosts []string) []string {
+	var out []string
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if !dns.IsSubDomain(zi.ZoneFQDN, host) || zi.delegated(host) {
+			continue
+		}
+		if sets := zi.ByName[host]; sets[TypeA] == nil && sets[TypeAAAA] == nil {
+			out = append(out, fmt.Sprintf("%s NS %s has no glue (A/AAAA records)", zi.ZoneFQDN, host))
+		}
+	}
+	return out
+}
+
+// delegated reports whether name is at or below a delegation (NS below
+// the apex) in zi.
+func (zi *ZoneIndex) delegated(name string) bool {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if name[off:] == zi.ZoneFQDN {
+			return false
+		}
+		if zi.ByName[name[off:]][TypeNS] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// danglingTarget reports whether target lies in zi's own data (not at or
+// below a delegation) yet has no records, or no address records when
+// needAddr is set. Names a wildcard covers are taken as resolvable.
+func (zi *ZoneIndex) danglingTarget(target string, needAddr bool) bool {
+	target = strings.ToLower(target)
+	if target == "." || !dns.IsSubDomain(zi.ZoneFQDN, target) || zi.delegated(target) {
+		return false
+	}
+	// Walk up from the target: a wildcard may synthesize it.
+	for off, end := 0, false; !end; off, end = dns.NextLabel(target, off) {
+		name := target[off:]
+		if name == zi.ZoneFQDN {
+			break
+		}
+		if off > 0 && zi.ByName["*."+name] != nil {
+			return false
+		}
+	}
+	if zi.ByName["*."+zi.ZoneFQDN] != nil && target != zi.ZoneFQDN {
+		return false
+	}
+	sets := zi.ByName[target]
+	if !needAddr {
+		return len(sets) == 0
+	}
+	return sets[TypeA] == nil && sets[TypeAAAA] == nil && sets[TypeALIAS] == nil && sets[TypeCNAME] == nil
+}
+
+// checkCNAMEChains fails on chains of the zone's own CNAMEs that loop or
+// run longer than MaxCNAMEChain: lookup would answer those with SERVFAIL.
+func (zi *ZoneIndex) checkCNAMEChains() error {
+	var names []string
+	for name, m := range zi.ByName {
+		if m[TypeCNAME] != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if loop := zi.cnameLoop(name); loop != nil {
+			return fmt.Errorf("CNAME loop: %s", strings.Join(loop, " -> "))
+		}
+	}
+	for _, name := range names {
+		cur := name
+		for hops := 0; zi.ByName[cur][TypeCNAME] != nil; hops++ {
+			if hops == MaxCNAMEChain {
+				return fmt.Errorf("CNAME chain from %s is longer than %d", name, MaxCNAMEChain)
+			}
+			cur = strings.ToLower(zi.ByName[cur][TypeCNAME].CNAME)
+		}
+	}
+	return nil
+}
+
+// cnameLoop returns the names of the CNAME cycle through name, starting and
+// ending with name, when name is the first of them in sort order (so each
+// loop is reported once), else nil. Only the zone's own CNAMEs are followed.
+func (zi *ZoneIndex) cnameLoop(name string) []string {
+	path := []string{name}
+	seen := map[string]bool{name: true}
+	for cur := name; ; {
+		rs := zi.ByName[cur][TypeCNAME]
+		if rs == nil {
+			return nil
+		}
+		cur = strings.ToLower(rs.CNAME)
+		if cur == name {
+			return append(path, name)
+		}
+		if seen[cur] || cur < name {
+			return nil
+		}
+		seen[cur] = true
+		path = append(path, cur)
+	}
+}
@@ -7,9 +7,13 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
 )
 
 type Store struct {
@@ -19,21 +23,22 @@ type Store struct {
 
 func NewStore() *Store { return &Store{zones: make(map[string]*ZoneIndex)} }
 
+// GetZoneForName returns the zone closest enclosing qname, and its FQDN.
+// Zones are keyed by name, so this looks up qname and each of its parents,
+// longest first: O(labels) whatever the number of zones.
 func (s *Store) GetZoneForName(qname string) (*ZoneIndex, string) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	name := strings.ToLower(qname)
-	best := ""
-	var z *ZoneIndex
-	for zone := range s.zones {
-		if strings.HasSuffix(name, zone) {
-			if len(zone) > len(best) {
-				best = zone
-				z = s.zones[zone]
-			}
+	name := strings.ToLower(dns.Fqdn(qname))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z := s.zones[name[off:]]; z != nil {
+			return z, name[off:]
 		}
 	}
-	return z, best
+	if z := s.zones["."]; z != nil {
+		return z, "."
+	}
+	return nil, ""
 }
 
 func (s *Store) SwapZone(newz *ZoneIndex) {
@@ -42,6 +47,19 @@ func (s *Store) SwapZone(newz *ZoneIndex) {
 	s.zones[newz.ZoneFQDN] = newz
 }
 
+// CompareAndSwapZone swaps newz in only if its zone is still old (nil for
+// not loaded), and reports whether it did; a zone rebuilt from a snapshot
+// then can't overwrite a change made since.
+func (s *Store) CompareAndSwapZone(old, newz *ZoneIndex) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.zones[newz.ZoneFQDN] != old {
+		return false
+	}
+	s.zones[newz.ZoneFQDN] = newz
+	return true
+}
+
 func (s *Store) RemoveZone(zone string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -58,6 +76,12 @@ func (s *Store) Snapshot() map[string]*ZoneIndex {
 	return copy
 }
 
+// LoadZonesDir loads every zone file under dir (.dns JSON, .yaml/.yml or
+// .zone master format), keyed by ZoneIndex.Key so the same zone may appear once per view.
+// Files declaring the same zone (and view) are merged, in path order.
+// Files are read and zones indexed in parallel; on failure the error is the
+// one for the first failing file in path order, as a sequential load would
+// report it.
 func LoadZonesDir(dir string) (map[string]*ZoneIndex, error) {
 	entries := make([]string, 0, 16)
 	walkErr := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
@@ -67,7 +91,7 @@ func LoadZonesDir(dir string) (map[string]*ZoneIndex, error) {
 		if d.IsDir() {
 			return nil
 		}
-		if strings.HasSuffix(strings.ToLower(d.Name()), ".dns") {
+		if IsZoneFile(d.Name()) {
 			entries = append(entries, path)
 		}
 		return nil
@@ -76,17 +100,49 @@ func LoadZonesDir(dir string) (map[string]*ZoneIndex, error) {
 		return nil, walkErr
 	}
 	sort.Strings(entries)
-	out := make(map[string]*ZoneIndex)
-	for _, f := range entries {
-		zf, err := readZoneFile(f)
-		if err != nil {
-			return nil, fmt.Errorf("%s: %w", f, err)
+	zfs := make([]*ZoneFile, len(entries))
+	errs := make([]error, len(entries)) // by position in entries
+	forEach(len(entries), func(i int) {
+		var err error
+		if zfs[i], err = ReadZoneFile(entries[i]); err != nil {
+			errs[i] = fmt.Errorf("%s: %w", entries[i], err)
+		}
+	})
+	type group struct {
+		first int // position of the first file
+		zfs   []*ZoneFile
+		paths []string
+	}
+	var groups []*group
+	byKey := make(map[string]*group)
+	for i, zf := range zfs {
+		if zf == nil {
+			continue
+		}
+		g := byKey[zf.key()]
+		if g == nil {
+			g = &group{first: i}
+			byKey[zf.key()] = g
+			groups = append(groups, g)
 		}
-		zi, err := zf.ToIndex()
+		g.zfs = append(g.zfs, zf)
+		g.paths = append(g.paths, entries[i])
+	}
+	zis := make([]*ZoneIndex, len(groups))
+	forEach(len(groups), func(i int) {
+		var err error
+		if zis[i], err = indexFiles(groups[i].zfs, groups[i].paths); err != nil {
+			errs[groups[i].first] = err
+		}
+	})
+	for _, err := range errs {
 		if err != nil {
-			return nil, fmt.Errorf("%s: %w", f, err)
+			return nil, err
 		}
-		out[zi.ZoneFQDN] = zi
+	}
+	out := make(map[string]*ZoneIndex, len(zis))
+	for _, zi := range zis {
+		out[zi.Key()] = zi
 	}
 	if len(out) == 0 {
 		return nil, errors.New("no zones loaded")
@@ -94,14 +150,77 @@ func LoadZonesDir(dir string) (map[string]*ZoneIndex, error) {
 	return out, nil
 }
 
-func readZoneFile(path string) (*ZoneFile, error) {
+// forEach calls f for 0 through n-1 on up to GOMAXPROCS goroutines.
+func forEach(n int, f func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0) && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// IsZoneFile reports whether name has a zone file extension.
+func IsZoneFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".dns", ".zone", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// ReadZoneFile reads a zone file in the format its extension names.
+func ReadZoneFile(path string) (*ZoneFile, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".zone" {
+		return ReadMasterFile(path)
+	}
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 	var z ZoneFile
+	if ext == ".yaml" || ext == ".yml" {
+		if err := yaml.Unmarshal(b, &z); err != nil {
+			return nil, err
+		}
+		for i := range z.Records {
+			z.Records[i].Values = jsonShape(z.Records[i].Values)
+		}
+		return &z, nil
+	}
 	if err := json.Unmarshal(b, &z); err != nil {
 		return nil, err
 	}
 	return &z, nil
 }
+
+// jsonShape converts YAML-decoded values to what encoding/json produces for
+// the same document (numbers as float64), which is what ToIndex expects.
+func jsonShape(v any) any {
+	switch x := v.(type) {
+	case []any:
+		for i := range x {
+			x[i] = jsonShape(x[i])
+		}
+	case map[string]any:
+		for k := range x {
+			x[k] = jsonShape(x[k])
+		}
+	case int:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	}
+	return v
+}
@@ -0,0 +1,172 @@
+package zone
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writeZones writes n small zones, zone0.test. through zone<n-1>.test., to
+// dir as .dns files.
+func writeZones(t testing.TB, dir string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("zone%d.test.", i)
+		var recs []string
+		for j := 0; j < 50; j++ {
+			recs = append(recs, fmt.Sprintf(`{"name": "host%d", "type": "A", "values": ["192.0.2.%d"]}`, j, j+1))
+		}
+		src := fmt.Sprintf(`{"zone": %q, "serial": 1, "ttl_default": 300,
+  "soa": {"mname": "ns1.%[1]s", "rname": "hostmaster.%[1]s"},
+  "ns": ["ns1.%[1]s"],
+  "records": [%s]}`, name, strings.Join(recs, ",\n"))
+		if err := os.WriteFile(filepath.Join(dir, name+"dns"), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadZonesDirFirstError(t *testing.T) {
+	dir := t.TempDir()
+	writeZones(t, dir, 20)
+	// Both broken; the error must name the first in path order, however
+	// the workers happen to finish.
+	for _, name := range []string{"zone5.test.dns", "zone15.test.dns"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		_, err := LoadZonesDir(dir)
+		if err == nil || !strings.Contains(err.Error(), "zone15.test.dns") {
+			t.Fatalf("error %v, want one for zone15.test.dns (first by sorted path)", err)
+		}
+	}
+}
+
+func TestLoadZonesDir(t *testing.T) {
+	dir := t.TempDir()
+	writeZones(t, dir, 20)
+	zones, err := LoadZonesDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones) != 20 || zones["zone7.test."] == nil {
+		t.Fatalf("loaded %d zones, want zone0.test. through zone19.test.", len(zones))
+	}
+}
+
+// BenchmarkLoadZonesDir loads 1000 zones on one worker and on GOMAXPROCS.
+func BenchmarkLoadZonesDir(b *testing.B) {
+	dir := b.TempDir()
+	writeZones(b, dir, 1000)
+	procs := []int{1}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		procs = append(procs, n)
+	}
+	for _, procs := range procs {
+		b.Run(fmt.Sprintf("procs=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			for i := 0; i < b.N; i++ {
+				if _, err := LoadZonesDir(dir); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// linearZoneForName is GetZoneForName as it was before zones were looked up
+// by suffix: a scan of every zone for the longest match.
+func (s *Store) linearZoneForName(qname string) (*ZoneIndex, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name := strings.ToLower(dns.Fqdn(qname))
+	var best *ZoneIndex
+	bestName := ""
+	for zname, z := range s.zones {
+		if (name == zname || strings.HasSuffix(name, "."+zname) || zname == ".") && len(zname) > len(bestName) {
+			best, bestName = z, zname
+		}
+	}
+	return best, bestName
+}
+
+// storeOf returns a store of n zones, zone<i>.test., plus sub.zone0.test.
+func storeOf(n int) *Store {
+	s := NewStore()
+	for i := 0; i < n; i++ {
+		s.SwapZone(&ZoneIndex{ZoneFQDN: fmt.Sprintf("zone%d.test.", i)})
+	}
+	s.SwapZone(&ZoneIndex{ZoneFQDN: "sub.zone0.test."})
+	return s
+}
+
+func TestGetZoneForName(t *testing.T) {
+	s := storeOf(100)
+	tests := []struct{ qname, want string }{
+		{"zone1.test.", "zone1.test."},
+		{"WWW.Zone1.Test", "zone1.test."},
+		{"a.b.zone42.test.", "zone42.test."},
+		{"x.sub.zone0.test.", "sub.zone0.test."},
+		{"x.zone0.test.", "zone0.test."},
+		{"xzone1.test.", ""},
+		{"zone1000.test.", ""},
+		{"test.", ""},
+	}
+	for _, tt := range tests {
+		zi, name := s.GetZoneForName(tt.qname)
+		if name != tt.want || (zi == nil) != (tt.want == "") {
+			t.Errorf("GetZoneForName(%q) = %q, want %q", tt.qname, name, tt.want)
+		}
+		if _, old := s.linearZoneForName(tt.qname); old != name {
+			t.Errorf("GetZoneForName(%q) = %q, linear scan %q", tt.qname, name, old)
+		}
+	}
+	s.SwapZone(&ZoneIndex{ZoneFQDN: "."})
+	if _, name := s.GetZoneForName("example.org."); name != "." {
+		t.Errorf("with a root zone, example.org. is in %q, want .", name)
+	}
+}
+
+func BenchmarkGetZoneForName(b *testing.B) {
+	s := storeOf(10000)
+	names := []string{"www.zone9999.test.", "a.b.c.zone5000.test.", "x.sub.zone0.test.", "nowhere.example."}
+	for _, impl := range []struct {
+		name string
+		find func(string) (*ZoneIndex, string)
+	}{
+		{"linear", s.linearZoneForName},
+		{"suffix", s.GetZoneForName},
+	} {
+		b.Run(impl.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				impl.find(names[i%len(names)])
+			}
+		})
+	}
+}
+
+func TestCompareAndSwapZone(t *testing.T) {
+	s := NewStore()
+	v1 := &ZoneIndex{ZoneFQDN: "example.com.", Serial: 1}
+	v2 := &ZoneIndex{ZoneFQDN: "example.com.", Serial: 2}
+	if s.CompareAndSwapZone(v1, v2) {
+		t.Fatal("swapped a zone that isn't loaded")
+	}
+	if !s.CompareAndSwapZone(nil, v1) {
+		t.Fatal("didn't load a new zone")
+	}
+	// v2 was built from a snapshot before v1 was swapped in.
+	if s.CompareAndSwapZone(nil, v2) || s.Snapshot()["example.com."] != v1 {
+		t.Fatal("stale swap replaced the current zone")
+	}
+	if !s.CompareAndSwapZone(v1, v2) || s.Snapshot()["example.com."] != v2 {
+		t.Fatal("didn't swap in place of the current zone")
+	}
+}
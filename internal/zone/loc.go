@@ -0,0 +1,137 @@
+package zone
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LOC is one LOC record (RFC 1876): a position in decimal degrees (north
+// and east positive) and an altitude in meters above the WGS 84 spheroid,
+// with the size of the located entity and the precision of the figures in
+// meters. Wire holds the encoded form, ready to pack.
+type LOC struct {
+	Latitude  float64 `json:"latitude" yaml:"latitude"`
+	Longitude float64 `json:"longitude" yaml:"longitude"`
+	Altitude  float64 `json:"altitude" yaml:"altitude"`
+	Size      float64 `json:"size" yaml:"size"`
+	HorizPre  float64 `json:"horiz_pre" yaml:"horiz_pre"`
+	VertPre   float64 `json:"vert_pre" yaml:"vert_pre"`
+	Wire      dns.LOC `json:"-" yaml:"-"`
+}
+
+// LOC defaults and limits. Sizes and precisions are sent as one digit
+// times a power of ten centimeters, so 9e9cm is the largest.
+const (
+	locDefaultSize  = 1
+	locDefaultHoriz = 10000
+	locDefaultVert  = 10
+	locMinAltitude  = -100000
+	locMaxAltitude  = 42849672.95
+	locMaxPrecision = 90000000
+	locEquator      = 1 << 31  // latitude/longitude 0 on the wire
+	locAltBase      = 10000000 // altitude 0 on the wire (cm above -100km)
+)
+
+var locFields = map[string]bool{"latitude": true, "longitude": true, "altitude": true, "size": true, "horiz_pre": true, "vert_pre": true}
+
+// toLOCSlice parses LOC objects. Latitude and longitude are required; the
+// rest default as in RFC 1876 (altitude 0, size 1m, horizontal precision
+// 10km, vertical 10m). Out-of-range and unknown fields are errors.
+func toLOCSlice(v any) ([]LOC, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("values must be array for LOC")
+	}
+	out := make([]LOC, 0, len(arr))
+	for _, e := range arr {
+		m, ok := e.(map[string]any)
+		if !ok {
+			return nil, errors.New("LOC value must be object")
+		}
+		var unknown []string
+		for k := range m {
+			if !locFields[k] {
+				unknown = append(unknown, k)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return nil, fmt.Errorf("unknown LOC field %s", strings.Join(unknown, ", "))
+		}
+		l := LOC{Size: locDefaultSize, HorizPre: locDefaultHoriz, VertPre: locDefaultVert}
+		fields := []struct {
+			key      string
+			dst      *float64
+			required bool
+			min, max float64
+		}{
+			{"latitude", &l.Latitude, true, -90, 90},
+			{"longitude", &l.Longitude, true, -180, 180},
+			{"altitude", &l.Altitude, false, locMinAltitude, locMaxAltitude},
+			{"size", &l.Size, false, 0, locMaxPrecision},
+			{"horiz_pre", &l.HorizPre, false, 0, locMaxPrecision},
+			{"vert_pre", &l.VertPre, false, 0, locMaxPrecision},
+		}
+		for _, f := range fields {
+			raw, ok := m[f.key]
+			if !ok {
+				if f.required {
+					return nil, errors.New("LOC requires latitude and longitude")
+				}
+				continue
+			}
+			n, ok := raw.(float64)
+			if !ok {
+				return nil, fmt.Errorf("LOC %s must be a number", f.key)
+			}
+			if n < f.min || n > f.max {
+				return nil, fmt.Errorf("LOC %s %g out of range [%g, %g]", f.key, n, f.min, f.max)
+			}
+			*f.dst = n
+		}
+		l.Wire = dns.LOC{
+			Latitude:  uint32(locEquator + math.Round(l.Latitude*3600000)),
+			Longitude: uint32(locEquator + math.Round(l.Longitude*3600000)),
+			Altitude:  uint32(locAltBase + math.Round(l.Altitude*100)),
+			Size:      locPrecision(l.Size),
+			HorizPre:  locPrecision(l.HorizPre),
+			VertPre:   locPrecision(l.VertPre),
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// locPrecision encodes meters as LOC's mantissa/exponent byte, rounding down
+// to one significant digit of centimeters.
+func locPrecision(meters float64) uint8 {
+	cm := uint64(math.Round(meters * 100))
+	var exp uint8
+	for cm > 9 {
+		cm /= 10
+		exp++
+	}
+	return uint8(cm)<<4 | exp
+}
+
+// locMeters decodes a LOC size or precision byte.
+func locMeters(b uint8) float64 {
+	return float64(b>>4) * math.Pow10(int(b&0x0f)) / 100
+}
+
+// locObject is the zone file form of x, for RecordFromRR.
+func locObject(x *dns.LOC) map[string]any {
+	return map[string]any{
+		"latitude":  (float64(x.Latitude) - locEquator) / 3600000,
+		"longitude": (float64(x.Longitude) - locEquator) / 3600000,
+		"altitude":  (float64(x.Altitude) - locAltBase) / 100,
+		"size":      locMeters(x.Size),
+		"horiz_pre": locMeters(x.HorizPre),
+		"vert_pre":  locMeters(x.VertPre),
+	}
+}
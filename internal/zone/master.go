@@ -0,0 +1,152 @@
+package zone
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ReadMasterFile parses a zone file in RFC 1035 master format ($ORIGIN,
+// $TTL and $INCLUDE supported) into the JSON schema, so both formats go
+// through the same validation and indexing in ToIndex. The origin defaults
+// to the file name without its .zone extension; the zone apex is the owner
+// of the SOA record. Apex NS records are served with the SOA's TTL, which
+// becomes the zone's ttl_default.
+func ReadMasterFile(path string) (*ZoneFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	base := filepath.Base(path)
+	origin := dns.Fqdn(strings.TrimSuffix(base, filepath.Ext(base)))
+	zp := dns.NewZoneParser(f, origin, path)
+	zp.SetIncludeAllowed(true)
+
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return zoneFileFromRRs(rrs)
+}
+
+// zoneFileFromRRs converts a zone's records, with exactly one SOA, into the
+// JSON schema.
+func zoneFileFromRRs(all []dns.RR) (*ZoneFile, error) {
+	var rrs []dns.RR
+	var soa *dns.SOA
+	for _, rr := range all {
+		if s, isSOA := rr.(*dns.SOA); isSOA {
+			if soa != nil {
+				return nil, errors.New("more than one SOA record")
+			}
+			soa = s
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	if soa == nil {
+		return nil, errors.New("SOA record required")
+	}
+	apex := strings.ToLower(soa.Hdr.Name)
+	zf := &ZoneFile{
+		Zone:       soa.Hdr.Name,
+		Serial:     soa.Serial,
+		TTLDefault: soa.Hdr.Ttl,
+		SOA: SOA{
+			MName:       soa.Ns,
+			RName:       soa.Mbox,
+			Refresh:     soa.Refresh,
+			Retry:       soa.Retry,
+			Expire:      soa.Expire,
+			NegativeTTL: soa.Minttl,
+		},
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if ns, ok := rr.(*dns.NS); ok && strings.ToLower(h.Name) == apex {
+			zf.NS = append(zf.NS, ns.Ns)
+			continue
+		}
+		rec, err := RecordFromRR(rr)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", h.Name, dns.TypeToString[h.Rrtype], err)
+		}
+		zf.Records = append(zf.Records, rec)
+	}
+	return zf, nil
+}
+
+// RecordFromRR converts rr into a one-value record shaped like decoded JSON
+// (numbers as float64, objects as map[string]any).
+func RecordFromRR(rr dns.RR) (RawRecord, error) {
+	h := rr.Header()
+	ttl := h.Ttl
+	rec := RawRecord{Name: h.Name, Type: dns.TypeToString[h.Rrtype], TTL: &ttl}
+	var v any
+	switch x := rr.(type) {
+	case *dns.A:
+		v = x.A.String()
+	case *dns.AAAA:
+		v = x.AAAA.String()
+	case *dns.CNAME:
+		rec.Value = x.Target
+		return rec, nil
+	case *dns.DNAME:
+		rec.Value = x.Target
+		return rec, nil
+	case *dns.NS:
+		v = x.Ns
+	case *dns.PTR:
+		v = x.Ptr
+	case *dns.TXT:
+		// One value is one character-string; split strings are rejoined
+		// as long as they still fit.
+		s := strings.Join(x.Txt, "")
+		if len(x.Txt) > 1 && len(s) > 255 {
+			return rec, errors.New("TXT strings longer than 255 bytes combined are not supported")
+		}
+		v = s
+	case *dns.MX:
+		v = map[string]any{"preference": float64(x.Preference), "host": x.Mx}
+	case *dns.SRV:
+		v = map[string]any{"priority": float64(x.Priority), "weight": float64(x.Weight), "port": float64(x.Port), "target": x.Target}
+	case *dns.CAA:
+		v = map[string]any{"flag": float64(x.Flag), "tag": x.Tag, "value": x.Value}
+	case *dns.HINFO:
+		v = map[string]any{"cpu": x.Cpu, "os": x.Os}
+	case *dns.LOC:
+		v = locObject(x)
+	case *dns.NAPTR:
+		v = map[string]any{"order": float64(x.Order), "preference": float64(x.Preference), "flags": x.Flags, "service": x.Service, "regexp": x.Regexp, "replacement": x.Replacement}
+	case *dns.SVCB:
+		v = svcbObject(x.Priority, x.Target, x.Value)
+	case *dns.HTTPS:
+		v = svcbObject(x.Priority, x.Target, x.Value)
+	case *dns.DNSKEY, *dns.DS, *dns.RRSIG, *dns.NSEC:
+		v = strings.TrimPrefix(rr.String(), h.String())
+	default:
+		return rec, errors.New("unsupported type")
+	}
+	rec.Values = []any{v}
+	return rec, nil
+}
+
+func svcbObject(prio uint16, target string, kvs []dns.SVCBKeyValue) map[string]any {
+	obj := map[string]any{"priority": float64(prio), "target": target}
+	if len(kvs) > 0 {
+		params := make(map[string]any, len(kvs))
+		for _, kv := range kvs {
+			params[kv.Key().String()] = kv.String()
+		}
+		obj["params"] = params
+	}
+	return obj
+}
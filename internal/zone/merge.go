@@ -0,0 +1,104 @@
+package zone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LoadZoneFiles reads paths, which must all declare the same zone, and
+// indexes them as one (see MergeZoneFiles). Errors name the file at fault,
+// or all of paths when the merged zone doesn't index.
+func LoadZoneFiles(paths []string) (*ZoneIndex, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no zone files")
+	}
+	zfs := make([]*ZoneFile, 0, len(paths))
+	for _, p := range paths {
+		zf, err := ReadZoneFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		zfs = append(zfs, zf)
+	}
+	return indexFiles(zfs, paths)
+}
+
+// indexFiles merges and indexes zfs, read from paths.
+func indexFiles(zfs []*ZoneFile, paths []string) (*ZoneIndex, error) {
+	zf, conflicts, err := MergeZoneFiles(zfs, paths)
+	if err != nil {
+		return nil, err
+	}
+	zi, err := zf.ToIndex()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.Join(paths, ", "), err)
+	}
+	zi.File = paths[0]
+	zi.Files = paths
+	zi.Conflicts = conflicts
+	return zi, nil
+}
+
+// MergeZoneFiles combines the files of a zone split across several (one per
+// team, say), named by names for messages. Each must be a valid zone file
+// on its own. Records and apex NS hosts are the union of all files, with
+// records lacking a ttl taking their own file's ttl_default. The serial is
+// the highest of the files', so bumping any one file's serial past the
+// others reloads the zone; everything else (SOA, ttl_default and the other
+// settings) comes from the last file. Files whose serial differs from the
+// highest are listed in conflicts. A single file is returned as is.
+func MergeZoneFiles(zfs []*ZoneFile, names []string) (merged *ZoneFile, conflicts []string, err error) {
+	if len(zfs) == 1 {
+		return zfs[0], nil, nil
+	}
+	for i, zf := range zfs {
+		if err := zf.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", names[i], err)
+		}
+		if zf.Type == "secondary" {
+			return nil, nil, fmt.Errorf("%s: secondary zone %s can't be split across files", names[i], zf.Zone)
+		}
+		if zf.key() != zfs[0].key() {
+			return nil, nil, fmt.Errorf("%s: zone %s, not %s", names[i], zf.key(), zfs[0].key())
+		}
+	}
+	out := *zfs[len(zfs)-1]
+	out.NS, out.Records = nil, nil
+	top := 0 // the file with the highest serial
+	for i, zf := range zfs {
+		if zf.Serial > zfs[top].Serial {
+			top = i
+		}
+	}
+	out.Serial = zfs[top].Serial
+	seenNS := make(map[string]bool)
+	for i, zf := range zfs {
+		if zf.Serial != out.Serial {
+			conflicts = append(conflicts, fmt.Sprintf("%s has serial %d, serving %d from %s", names[i], zf.Serial, out.Serial, names[top]))
+		}
+		for _, ns := range zf.NS {
+			if key := strings.ToLower(MustFQDN(ns)); !seenNS[key] {
+				seenNS[key] = true
+				out.NS = append(out.NS, ns)
+			}
+		}
+		for _, r := range zf.Records {
+			if r.TTL == nil {
+				ttl := zf.TTLDefault
+				r.TTL = &ttl
+			}
+			out.Records = append(out.Records, r)
+		}
+	}
+	return &out, conflicts, nil
+}
+
+// key is the Key of the zone z declares.
+func (z *ZoneFile) key() string {
+	k := strings.ToLower(MustFQDN(z.Zone))
+	if v := strings.ToLower(z.View); v != "" {
+		k += "@" + v
+	}
+	return k
+}
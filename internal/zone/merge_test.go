@@ -0,0 +1,45 @@
+package zone
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadZonesDirSplitSerial(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"example.com.dns": `{"zone": "example.com.", "serial": 7, "ttl_default": 300,
+  "soa": {"mname": "ns1.example.com.", "rname": "hostmaster.example.com."},
+  "ns": ["ns1.example.com."],
+  "records": [{"name": "www", "type": "A", "values": ["192.0.2.1"]}]}`,
+		"example.com.team.dns": `{"zone": "example.com.", "serial": 5, "ttl_default": 600,
+  "soa": {"mname": "ns1.example.com.", "rname": "hostmaster.example.com."},
+  "ns": ["ns1.example.com."],
+  "records": [{"name": "api", "type": "A", "values": ["192.0.2.2"]}]}`,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zones, err := LoadZonesDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zi := zones["example.com."]
+	if zi == nil || len(zi.Files) != 2 {
+		t.Fatalf("zones %v, want example.com. from both files", zones)
+	}
+	// The serial is the highest; the other settings come from the last file.
+	if zi.Serial != 7 || zi.TTLDef != 600 {
+		t.Errorf("serial %d, ttl_default %d; want 7 and 600", zi.Serial, zi.TTLDef)
+	}
+	if zi.ByName["www.example.com."] == nil || zi.ByName["api.example.com."] == nil {
+		t.Errorf("names %v, want www and api", zi.ByName)
+	}
+	if len(zi.Conflicts) != 1 || !strings.HasPrefix(zi.Conflicts[0], filepath.Join(dir, "example.com.team.dns")+" has serial 5, serving 7 from ") {
+		t.Errorf("conflicts %q, want the team file's serial", zi.Conflicts)
+	}
+}
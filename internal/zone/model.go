@@ -1,38 +1,66 @@
 package zone
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
 )
 
 // Normalized to lowercase internally; external wire preserves qname case.
 
 type ZoneFile struct {
-	Zone       string      `json:"zone"`
-	Serial     uint32      `json:"serial"`
-	TTLDefault uint32      `json:"ttl_default"`
-	SOA        SOA         `json:"soa"`
-	NS         []string    `json:"ns"`
-	Records    []RawRecord `json:"records"`
+	Zone       string      `json:"zone" yaml:"zone"`
+	Serial     uint32      `json:"serial" yaml:"serial"`
+	TTLDefault uint32      `json:"ttl_default" yaml:"ttl_default"`
+	MinTTL     uint32      `json:"min_ttl" yaml:"min_ttl"` // response-time TTL floor; 0 = none
+	SOA        SOA         `json:"soa" yaml:"soa"`
+	NS         []string    `json:"ns" yaml:"ns"`
+	Records    []RawRecord `json:"records" yaml:"records"`
+
+	// Split-horizon view serving this zone; "" = the default view.
+	View string `json:"view,omitempty" yaml:"view,omitempty"`
+
+	// Secondary zones ("type": "secondary") are transferred by AXFR from
+	// Primary (host:port) instead of listing their records here.
+	Type    string `json:"type,omitempty" yaml:"type,omitempty"`
+	Primary string `json:"primary,omitempty" yaml:"primary,omitempty"`
+
+	// Secondaries (ip:port) sent a NOTIFY when a reload bumps the serial.
+	AlsoNotify []string `json:"also_notify,omitempty" yaml:"also_notify,omitempty"`
+
+	// TSIG key (from --tsig-keys) that transfers of this zone are signed
+	// with: required of peers for a primary zone, used for pulls by a
+	// secondary one.
+	TSIGKey string `json:"tsig_key,omitempty" yaml:"tsig_key,omitempty"`
+
+	// Per-zone overrides of the server-wide response shaping; nil = default.
+	MinimalResponses     *bool `json:"minimal_responses,omitempty" yaml:"minimal_responses,omitempty"`
+	AdditionalProcessing *bool `json:"additional_processing,omitempty" yaml:"additional_processing,omitempty"`
+	// GeneratePTR overrides --auto-ptr for this zone's A/AAAA records.
+	GeneratePTR *bool `json:"generate_ptr,omitempty" yaml:"generate_ptr,omitempty"`
 }
 
 type SOA struct {
-	MName       string `json:"mname"`
-	RName       string `json:"rname"`
-	Refresh     uint32 `json:"refresh"`
-	Retry       uint32 `json:"retry"`
-	Expire      uint32 `json:"expire"`
-	NegativeTTL uint32 `json:"negative_ttl"`
+	MName       string `json:"mname" yaml:"mname"`
+	RName       string `json:"rname" yaml:"rname"`
+	Refresh     uint32 `json:"refresh" yaml:"refresh"`
+	Retry       uint32 `json:"retry" yaml:"retry"`
+	Expire      uint32 `json:"expire" yaml:"expire"`
+	NegativeTTL uint32 `json:"negative_ttl" yaml:"negative_ttl"`
 }
 
 type RawRecord struct {
-	Name   string  `json:"name"`
-	Type   string  `json:"type"`
-	TTL    *uint32 `json:"ttl"`
-	Value  string  `json:"value"`  // for CNAME only
-	Values any     `json:"values"` // []string or []struct depending on type
+	Name   string  `json:"name" yaml:"name"`
+	Type   string  `json:"type" yaml:"type"`
+	TTL    *uint32 `json:"ttl" yaml:"ttl"`
+	Value  string  `json:"value" yaml:"value"`   // for CNAME, DNAME and ALIAS only
+	Values any     `json:"values" yaml:"values"` // []string or []struct depending on type
 }
 
 // Indexed zone in memory.
@@ -46,21 +74,55 @@ const (
 	TypeNS    RRType = "NS"
 	TypeTXT   RRType = "TXT"
 	TypeSRV   RRType = "SRV"
+	TypePTR   RRType = "PTR"
+	TypeCAA   RRType = "CAA"
+	TypeSVCB  RRType = "SVCB"
+	TypeHINFO RRType = "HINFO"
+	TypeLOC   RRType = "LOC"
+	TypeNAPTR RRType = "NAPTR"
+	TypeHTTPS RRType = "HTTPS"
+	TypeDNAME RRType = "DNAME"
+	// ALIAS is a pseudo-type: A/AAAA queries for its owner are answered
+	// with the target's addresses. It has no wire form of its own.
+	TypeALIAS RRType = "ALIAS"
+
+	// DNSSEC types, served verbatim from pre-signed zones.
+	TypeDNSKEY RRType = "DNSKEY"
+	TypeDS     RRType = "DS"
+	TypeRRSIG  RRType = "RRSIG"
+	TypeNSEC   RRType = "NSEC"
 )
 
 type RRSet struct {
 	Type RRType
 	TTL  uint32
-	// Canonical RDATA kept as strings or concrete structs for MX/SRV.
-	A     []net.IP
-	AAAA  []net.IP
-	CNAME string // FQDN
-	NS    []string
-	TXT   []string
-	MX    []MX
-	SRV   []SRV
+	// Canonical RDATA kept as strings or concrete structs for MX/SRV/CAA.
+	A    []net.IP
+	AAAA []net.IP
+	// Weights parallels A or AAAA for weighted sets; nil = unweighted.
+	Weights []uint32
+	CNAME   string // FQDN
+	DNAME   string // FQDN
+	ALIAS   string // FQDN
+	NS      []string
+	PTR     []string // FQDN targets
+	TXT     []string
+	MX      []MX
+	SRV     []SRV
+	CAA     []CAA
+	SVCB    []SVCB // SVCB and HTTPS
+	HINFO   []HINFO
+	LOC     []LOC
+	NAPTR   []NAPTR
+	// RR holds records kept verbatim (DNSSEC types).
+	RR []dns.RR
+
+	rotation atomic.Uint32
 }
 
+// NextRotation returns the round-robin offset for the next answer from rs.
+func (rs *RRSet) NextRotation() int { return int(rs.rotation.Add(1) - 1) }
+
 type MX struct {
 	Preference uint16 `json:"preference"`
 	Host       string `json:"host"`
@@ -73,13 +135,91 @@ type SRV struct {
 	Target   string `json:"target"`
 }
 
+type CAA struct {
+	Flag  uint8  `json:"flag"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+type HINFO struct {
+	CPU string `json:"cpu"`
+	OS  string `json:"os"`
+}
+
+type NAPTR struct {
+	Order       uint16 `json:"order"`
+	Preference  uint16 `json:"preference"`
+	Flags       string `json:"flags"`
+	Service     string `json:"service"`
+	Regexp      string `json:"regexp"`
+	Replacement string `json:"replacement"`
+}
+
 type ZoneIndex struct {
 	ZoneFQDN string
 	Serial   uint32
 	SOA      SOA
 	TTLDef   uint32
+	MinTTL   uint32
+	View     string
+	File     string // set by LoadZonesDir: the first of Files
+	Primary  string // secondary zones: where to transfer from
+	// Files the zone was read from; more than one when it is split across
+	// files (see MergeZoneFiles), whose serial Conflicts are kept for logging.
+	Files     []string
+	Conflicts []string
+	// AlsoNotify lists secondaries to NOTIFY of new serials.
+	AlsoNotify []string
+	TSIGKey    string // transfer key name; "" = any configured key
+
+	MinimalResponses     *bool
+	AdditionalProcessing *bool
+	GeneratePTR          *bool
 	// name(lowercase FQDN) -> type -> RRSet
 	ByName map[string]map[RRType]*RRSet
+
+	// Duplicates counts identical records dropped from RRsets at load.
+	Duplicates int
+	// Weighted is set when any A/AAAA RRset carries weights.
+	Weighted bool
+
+	// NSEC owners in canonical order, for denial of existence.
+	nsecOwners []string
+	// ents are the empty non-terminals: names with no records of their own
+	// but names below them (RFC 4592 section 2.2.2), such as w.example.com.
+	// for *.w.example.com.
+	ents map[string]struct{}
+}
+
+// Key identifies the zone among all views: the zone FQDN, suffixed with
+// "@view" outside the default view.
+func (z *ZoneIndex) Key() string {
+	if z.View == "" {
+		return z.ZoneFQDN
+	}
+	return z.ZoneFQDN + "@" + z.View
+}
+
+// EmptyNonTerminal reports whether name (lowercase FQDN) exists in the zone
+// without records of its own, only as an ancestor of names that have some.
+func (z *ZoneIndex) EmptyNonTerminal(name string) bool {
+	_, ok := z.ents[name]
+	return ok
+}
+
+func (z *ZoneIndex) indexENTs() {
+	z.ents = make(map[string]struct{})
+	for name := range z.ByName {
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			anc := name[off:]
+			if !dns.IsSubDomain(z.ZoneFQDN, anc) || anc == z.ZoneFQDN {
+				break
+			}
+			if _, ok := z.ByName[anc]; !ok {
+				z.ents[anc] = struct{}{}
+			}
+		}
+	}
 }
 
 func (z *ZoneFile) Validate() error {
@@ -92,12 +232,27 @@ func (z *ZoneFile) Validate() error {
 	if !strings.HasSuffix(z.Zone, ".") {
 		z.Zone += "."
 	}
+	switch z.Type {
+	case "", "primary":
+	case "secondary":
+		if z.Primary == "" {
+			return errors.New("primary is required for secondary zones")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown zone type %q", z.Type)
+	}
 	if z.SOA.MName == "" || z.SOA.RName == "" {
 		return errors.New("soa.mname and soa.rname required")
 	}
 	if len(z.NS) == 0 {
 		return errors.New("at least one NS required")
 	}
+	for _, a := range z.AlsoNotify {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return fmt.Errorf("also_notify %q: want ip:port", a)
+		}
+	}
 	return nil
 }
 
@@ -111,6 +266,10 @@ func NormalizeFQDN(name string, zone string) string {
 	return strings.ToLower(name + "." + zone)
 }
 
+// MaxCNAMEChain is the longest CNAME chain followed within a zone; longer
+// chains don't load.
+const MaxCNAMEChain = 8
+
 func MustFQDN(name string) string {
 	if name == "" {
 		return name
@@ -121,8 +280,10 @@ func MustFQDN(name string) string {
 	return name + "."
 }
 
+// ensureTTL returns a record's TTL: def when the record has none (absent or
+// null), else its own, so an explicit 0 stays 0 and is never cached.
 func ensureTTL(ttl *uint32, def uint32) uint32 {
-	if ttl == nil || *ttl == 0 {
+	if ttl == nil {
 		return def
 	}
 	return *ttl
@@ -138,7 +299,20 @@ func (z *ZoneFile) ToIndex() (*ZoneIndex, error) {
 		Serial:   z.Serial,
 		SOA:      z.SOA,
 		TTLDef:   z.TTLDefault,
+		MinTTL:   z.MinTTL,
+		View:     strings.ToLower(z.View),
 		ByName:   make(map[string]map[RRType]*RRSet),
+
+		MinimalResponses:     z.MinimalResponses,
+		AdditionalProcessing: z.AdditionalProcessing,
+		GeneratePTR:          z.GeneratePTR,
+		AlsoNotify:           z.AlsoNotify,
+		TSIGKey:              z.TSIGKey,
+	}
+	if z.Type == "secondary" {
+		// Records arrive by zone transfer (see TransferClient).
+		idx.Primary = z.Primary
+		return idx, nil
 	}
 
 	// Add NS at apex as RRSet
@@ -163,8 +337,24 @@ func (z *ZoneFile) ToIndex() (*ZoneIndex, error) {
 				return nil, fmt.Errorf("CNAME must be unique at name %s", fqdn)
 			}
 			m[TypeCNAME] = &RRSet{Type: TypeCNAME, TTL: ttl, CNAME: NormalizeFQDN(r.Value, zoneFQDN)}
+		case TypeDNAME:
+			if r.Value == "" {
+				return nil, fmt.Errorf("DNAME requires value for %s", fqdn)
+			}
+			if m[TypeCNAME] != nil {
+				return nil, fmt.Errorf("CNAME must be unique at name %s", fqdn)
+			}
+			m[TypeDNAME] = &RRSet{Type: TypeDNAME, TTL: ttl, DNAME: NormalizeFQDN(r.Value, zoneFQDN)}
+		case TypeALIAS:
+			if r.Value == "" {
+				return nil, fmt.Errorf("ALIAS requires value for %s", fqdn)
+			}
+			if m[TypeCNAME] != nil {
+				return nil, fmt.Errorf("CNAME must be unique at name %s", fqdn)
+			}
+			m[TypeALIAS] = &RRSet{Type: TypeALIAS, TTL: ttl, ALIAS: NormalizeFQDN(r.Value, zoneFQDN)}
 		case TypeA:
-			ips, err := toStringSlice(r.Values)
+			ips, wts, err := toAddrSlice(r.Values)
 			if err != nil {
 				return nil, err
 			}
@@ -176,9 +366,11 @@ func (z *ZoneFile) ToIndex() (*ZoneIndex, error) {
 				}
 				list = append(list, ip.To4())
 			}
-			appendRRSet(m, TypeA, ttl).A = append(appendRRSet(m, TypeA, ttl).A, list...)
+			rs := appendRRSet(m, TypeA, ttl)
+			rs.Weights = mergeWeights(rs.Weights, len(rs.A), wts, len(list))
+			rs.A = append(rs.A, list...)
 		case TypeAAAA:
-			ips, err := toStringSlice(r.Values)
+			ips, wts, err := toAddrSlice(r.Values)
 			if err != nil {
 				return nil, err
 			}
@@ -190,9 +382,11 @@ func (z *ZoneFile) ToIndex() (*ZoneIndex, error) {
 				}
 				list = append(list, ip)
 			}
-			appendRRSet(m, TypeAAAA, ttl).AAAA = append(appendRRSet(m, TypeAAAA, ttl).AAAA, list...)
+			rs := appendRRSet(m, TypeAAAA, ttl)
+			rs.Weights = mergeWeights(rs.Weights, len(rs.AAAA), wts, len(list))
+			rs.AAAA = append(rs.AAAA, list...)
 		case TypeTXT:
-			vals, err := toStringSlice(r.Values)
+			vals, err := toTXTSlice(r.Values)
 			if err != nil {
 				return nil, err
 			}
@@ -203,6 +397,12 @@ func (z *ZoneFile) ToIndex() (*ZoneIndex, error) {
 				return nil, err
 			}
 			appendRRSet(m, TypeNS, ttl).NS = append(appendRRSet(m, TypeNS, ttl).NS, normalizeFQDNs(vals)...)
+		case TypePTR:
+			vals, err := toStringSlice(r.Values)
+			if err != nil {
+				return nil, err
+			}
+			appendRRSet(m, TypePTR, ttl).PTR = append(appendRRSet(m, TypePTR, ttl).PTR, normalizeFQDNs(vals)...)
 		case TypeMX:
 			mxs, err := toMXSlice(r.Values)
 			if err != nil {
@@ -221,10 +421,64 @@ func (z *ZoneFile) ToIndex() (*ZoneIndex, error) {
 				srvs[i].Target = strings.ToLower(MustFQDN(srvs[i].Target))
 			}
 			appendRRSet(m, TypeSRV, ttl).SRV = append(appendRRSet(m, TypeSRV, ttl).SRV, srvs...)
+		case TypeCAA:
+			caas, err := toCAASlice(r.Values)
+			if err != nil {
+				return nil, err
+			}
+			appendRRSet(m, TypeCAA, ttl).CAA = append(appendRRSet(m, TypeCAA, ttl).CAA, caas...)
+		case TypeSVCB, TypeHTTPS:
+			svcbs, err := toSVCBSlice(r.Values, rt)
+			if err != nil {
+				return nil, fmt.Errorf("%s at %s: %w", rt, fqdn, err)
+			}
+			appendRRSet(m, rt, ttl).SVCB = append(appendRRSet(m, rt, ttl).SVCB, svcbs...)
+		case TypeHINFO:
+			hinfos, err := toHINFOSlice(r.Values)
+			if err != nil {
+				return nil, fmt.Errorf("%s at %s: %w", rt, fqdn, err)
+			}
+			appendRRSet(m, TypeHINFO, ttl).HINFO = append(appendRRSet(m, TypeHINFO, ttl).HINFO, hinfos...)
+		case TypeLOC:
+			locs, err := toLOCSlice(r.Values)
+			if err != nil {
+				return nil, fmt.Errorf("%s at %s: %w", rt, fqdn, err)
+			}
+			appendRRSet(m, TypeLOC, ttl).LOC = append(appendRRSet(m, TypeLOC, ttl).LOC, locs...)
+		case TypeNAPTR:
+			naptrs, err := toNAPTRSlice(r.Values)
+			if err != nil {
+				return nil, fmt.Errorf("%s at %s: %w", rt, fqdn, err)
+			}
+			for i := range naptrs {
+				naptrs[i].Replacement = strings.ToLower(MustFQDN(naptrs[i].Replacement))
+			}
+			appendRRSet(m, TypeNAPTR, ttl).NAPTR = append(appendRRSet(m, TypeNAPTR, ttl).NAPTR, naptrs...)
+		case TypeDNSKEY, TypeDS, TypeRRSIG, TypeNSEC:
+			vals, err := toStringSlice(r.Values)
+			if err != nil {
+				return nil, err
+			}
+			rrs, err := parseVerbatim(fqdn, rt, ttl, vals)
+			if err != nil {
+				return nil, err
+			}
+			appendRRSet(m, rt, ttl).RR = append(appendRRSet(m, rt, ttl).RR, rrs...)
 		default:
 			return nil, fmt.Errorf("unsupported type: %s", r.Type)
 		}
 	}
+	for _, m := range idx.ByName {
+		for _, rs := range m {
+			idx.Duplicates += rs.dedupe()
+			idx.Weighted = idx.Weighted || rs.Weights != nil
+		}
+	}
+	if err := idx.checkCNAMEChains(); err != nil {
+		return nil, err
+	}
+	idx.indexNSEC()
+	idx.indexENTs()
 
 	return idx, nil
 }
@@ -257,14 +511,13 @@ func normalizeFQDNs(v []string) []string {
 func ttlOrDef(ttl *uint32, def uint32) uint32 { return ensureTTL(ttl, def) }
 
 func hasOtherTypes(m map[RRType]*RRSet) bool {
-	if len(m) == 0 {
-		return false
-	}
-	if len(m) == 1 {
-		_, ok := m[TypeCNAME]
-		return ok
+	for t := range m {
+		// RRSIG/NSEC legitimately live next to a CNAME (RFC 4035).
+		if t != TypeRRSIG && t != TypeNSEC {
+			return true
+		}
 	}
-	return true
+	return false
 }
 
 func toStringSlice(v any) ([]string, error) {
@@ -286,6 +539,54 @@ func toStringSlice(v any) ([]string, error) {
 	}
 }
 
+// toTXTSlice accepts plain strings and {"b64": "..."} objects. Decoded bytes
+// are stored in presentation form (\DDD escapes) so toRR packs them as-is.
+func toTXTSlice(v any) ([]string, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return toStringSlice(v)
+	}
+	out := make([]string, 0, len(arr))
+	for _, e := range arr {
+		switch x := e.(type) {
+		case string:
+			out = append(out, x)
+		case map[string]any:
+			s, ok := x["b64"].(string)
+			if !ok {
+				return nil, errors.New("TXT object requires b64")
+			}
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("TXT b64: %w", err)
+			}
+			if len(b) > 255 {
+				return nil, fmt.Errorf("TXT b64 value is %d bytes, max 255", len(b))
+			}
+			out = append(out, escapeTXT(b))
+		default:
+			return nil, errors.New("TXT value must be string or {\"b64\": ...}")
+		}
+	}
+	return out, nil
+}
+
+func escapeTXT(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '\\' || c == '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
 func toMXSlice(v any) ([]MX, error) {
 	arr, ok := v.([]any)
 	if !ok {
@@ -329,3 +630,105 @@ func toSRVSlice(v any) ([]SRV, error) {
 	}
 	return out, nil
 }
+
+func toCAASlice(v any) ([]CAA, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("values must be array for CAA")
+	}
+	out := make([]CAA, 0, len(arr))
+	for _, e := range arr {
+		c, ok := e.(map[string]any)
+		if !ok {
+			return nil, errors.New("CAA value must be object")
+		}
+		flag, ok1 := c["flag"].(float64)
+		tag, ok2 := c["tag"].(string)
+		value, ok3 := c["value"].(string)
+		if !ok1 || !ok2 || !ok3 || tag == "" {
+			return nil, errors.New("CAA requires flag, tag, value")
+		}
+		out = append(out, CAA{Flag: uint8(flag), Tag: tag, Value: value})
+	}
+	return out, nil
+}
+
+func toHINFOSlice(v any) ([]HINFO, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("values must be array for HINFO")
+	}
+	out := make([]HINFO, 0, len(arr))
+	for _, e := range arr {
+		h, ok := e.(map[string]any)
+		if !ok {
+			return nil, errors.New("HINFO value must be object")
+		}
+		for k := range h {
+			if k != "cpu" && k != "os" {
+				return nil, fmt.Errorf("unknown HINFO field %s", k)
+			}
+		}
+		cpu, ok1 := h["cpu"].(string)
+		osName, ok2 := h["os"].(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("HINFO requires cpu, os")
+		}
+		if len(cpu) > 255 || len(osName) > 255 {
+			return nil, errors.New("HINFO strings must be at most 255 bytes")
+		}
+		out = append(out, HINFO{CPU: cpu, OS: osName})
+	}
+	return out, nil
+}
+
+// toNAPTRSlice parses NAPTR objects (RFC 3403). flags, service and regexp
+// may be left out; a rule rewrites either by regexp or by replacement, so
+// one of them must be empty (replacement ".").
+func toNAPTRSlice(v any) ([]NAPTR, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("values must be array for NAPTR")
+	}
+	out := make([]NAPTR, 0, len(arr))
+	for _, e := range arr {
+		m, ok := e.(map[string]any)
+		if !ok {
+			return nil, errors.New("NAPTR value must be object")
+		}
+		order, ok1 := m["order"].(float64)
+		pref, ok2 := m["preference"].(float64)
+		repl, ok3 := m["replacement"].(string)
+		if !ok1 || !ok2 || !ok3 || repl == "" {
+			return nil, errors.New("NAPTR requires order, preference, replacement")
+		}
+		for _, f := range []struct {
+			key string
+			val float64
+		}{{"order", order}, {"preference", pref}} {
+			if f.val < 0 || f.val > 65535 || f.val != math.Trunc(f.val) {
+				return nil, fmt.Errorf("NAPTR %s must be an integer from 0 to 65535", f.key)
+			}
+		}
+		n := NAPTR{Order: uint16(order), Preference: uint16(pref), Replacement: repl}
+		for _, f := range []struct {
+			key string
+			dst *string
+		}{{"flags", &n.Flags}, {"service", &n.Service}, {"regexp", &n.Regexp}} {
+			raw, ok := m[f.key]
+			if !ok {
+				continue
+			}
+			s, ok := raw.(string)
+			if !ok || len(s) > 255 {
+				return nil, fmt.Errorf("NAPTR %s must be a string of at most 255 bytes", f.key)
+			}
+			*f.dst = s
+		}
+		if n.Regexp != "" && repl != "." {
+			return nil, errors.New("NAPTR takes a regexp or a replacement, not both")
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
@@ -0,0 +1,112 @@
+package zone
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// indexErr indexes the JSON zone example.com. with records (a JSON array of
+// record objects) and returns the error.
+func indexErr(t *testing.T, records string) error {
+	t.Helper()
+	var zf ZoneFile
+	src := `{"zone": "example.com.", "soa": {"mname": "ns1.example.com.", "rname": "hostmaster.example.com."},
+  "ns": ["ns1.example.com."], "records": ` + records + `}`
+	if err := json.Unmarshal([]byte(src), &zf); err != nil {
+		t.Fatal(err)
+	}
+	_, err := zf.ToIndex()
+	return err
+}
+
+func TestRecordTTLZeroVersusNull(t *testing.T) {
+	want := map[string]uint32{
+		"absent.example.com.": 300,
+		"null.example.com.":   300,
+		"zero.example.com.":   0,
+		"own.example.com.":    30,
+	}
+	check := func(t *testing.T, zi *ZoneIndex) {
+		t.Helper()
+		for name, ttl := range want {
+			rs := zi.ByName[name][TypeA]
+			if rs == nil {
+				t.Errorf("%s: no A", name)
+			} else if rs.TTL != ttl {
+				t.Errorf("%s: TTL %d, want %d", name, rs.TTL, ttl)
+			}
+		}
+	}
+
+	t.Run("json", func(t *testing.T) {
+		check(t, indexJSON(t, `{
+  "zone": "example.com.", "ttl_default": 300,
+  "soa": {"mname": "ns1.example.com.", "rname": "hostmaster.example.com."},
+  "ns": ["ns1.example.com."],
+  "records": [
+    {"name": "absent", "type": "A", "values": ["192.0.2.1"]},
+    {"name": "null", "type": "A", "ttl": null, "values": ["192.0.2.2"]},
+    {"name": "zero", "type": "A", "ttl": 0, "values": ["192.0.2.3"]},
+    {"name": "own", "type": "A", "ttl": 30, "values": ["192.0.2.4"]}
+  ]
+}`))
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "example.com.yaml")
+		src := `zone: example.com.
+ttl_default: 300
+soa: {mname: ns1.example.com., rname: hostmaster.example.com.}
+ns: [ns1.example.com.]
+records:
+  - {name: absent, type: A, values: [192.0.2.1]}
+  - {name: "null", type: A, ttl: null, values: [192.0.2.2]}
+  - {name: zero, type: A, ttl: 0, values: [192.0.2.3]}
+  - {name: own, type: A, ttl: 30, values: [192.0.2.4]}
+`
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		zf, err := ReadZoneFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zi, err := zf.ToIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, zi)
+	})
+}
+
+func TestNAPTRValues(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string // "" for valid
+	}{
+		{`{"order": 0, "preference": 65535, "replacement": "_sip._udp"}`, ""},
+		{`{"order": 65536, "preference": 10, "replacement": "_sip._udp"}`, "NAPTR at sip.example.com.: NAPTR order must be an integer from 0 to 65535"},
+		{`{"order": 10, "preference": -1, "replacement": "_sip._udp"}`, "NAPTR at sip.example.com.: NAPTR preference must be an integer from 0 to 65535"},
+		{`{"order": 1.5, "preference": 10, "replacement": "_sip._udp"}`, "NAPTR order must be"},
+		{`{"order": 10, "preference": 10}`, "NAPTR at sip.example.com.: NAPTR requires order, preference, replacement"},
+	}
+	for _, tt := range tests {
+		err := indexErr(t, `[{"name": "sip", "type": "NAPTR", "values": [`+tt.value+`]}]`)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.value, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want %q", tt.value, err, tt.err)
+		}
+	}
+}
+
+func TestHINFOErrorNamesRecord(t *testing.T) {
+	err := indexErr(t, `[{"name": "host", "type": "HINFO", "values": [{"cpu": "x86"}]}]`)
+	if want := "HINFO at host.example.com.: HINFO requires cpu, os"; err == nil || err.Error() != want {
+		t.Errorf("error %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,77 @@
+package zone
+
+import (
+	"net"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PTRCollision is a reverse name that got generated PTRs for several hosts.
+type PTRCollision struct {
+	Name    string
+	Targets []string
+}
+
+// IsReverse reports whether z is an in-addr.arpa or ip6.arpa zone.
+func (z *ZoneIndex) IsReverse() bool {
+	return dns.IsSubDomain("in-addr.arpa.", z.ZoneFQDN) || dns.IsSubDomain("ip6.arpa.", z.ZoneFQDN)
+}
+
+// GeneratesPTR reports whether PTRs are generated from z's addresses, with
+// def as the server-wide default (--auto-ptr).
+func (z *ZoneIndex) GeneratesPTR(def bool) bool {
+	if z.GeneratePTR != nil {
+		return *z.GeneratePTR
+	}
+	return def && !z.IsReverse()
+}
+
+// AddPTRs adds to rev a PTR for every A/AAAA record of the fwd zones that
+// generate them and whose address falls inside rev, in the same view.
+// Existing PTRs are kept. Addresses shared by several hosts get a PTR for
+// each, and are reported as collisions.
+func AddPTRs(rev *ZoneIndex, fwd []*ZoneIndex, def bool) []PTRCollision {
+	generated := map[string][]string{}
+	for _, f := range fwd {
+		if f == rev || f.View != rev.View || !f.GeneratesPTR(def) {
+			continue
+		}
+		names := make([]string, 0, len(f.ByName))
+		for name := range f.ByName {
+			if !strings.HasPrefix(name, "*.") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, rs := range []*RRSet{f.ByName[name][TypeA], f.ByName[name][TypeAAAA]} {
+				if rs == nil {
+					continue
+				}
+				for _, ip := range append(append([]net.IP(nil), rs.A...), rs.AAAA...) {
+					rname, err := dns.ReverseAddr(ip.String())
+					if err != nil || !dns.IsSubDomain(rev.ZoneFQDN, rname) {
+						continue
+					}
+					ptr := appendRRSet(ensureName(rev.ByName, rname), TypePTR, rs.TTL)
+					generated[rname] = append(generated[rname], name)
+					if !slices.Contains(ptr.PTR, name) {
+						ptr.PTR = append(ptr.PTR, name)
+					}
+				}
+			}
+		}
+	}
+	rev.indexENTs()
+	var out []PTRCollision
+	for rname, targets := range generated {
+		if len(targets) > 1 {
+			out = append(out, PTRCollision{Name: rname, Targets: targets})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
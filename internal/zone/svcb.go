@@ -0,0 +1,93 @@
+package zone
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SVCB is one SVCB or HTTPS record (RFC 9460). Params holds the SvcParams
+// as written in the zone file ("" for keys without a value, such as
+// no-default-alpn); Value is their parsed form, ready to pack.
+type SVCB struct {
+	Priority uint16             `json:"priority"`
+	Target   string             `json:"target"`
+	Params   map[string]string  `json:"params,omitempty"`
+	Value    []dns.SVCBKeyValue `json:"-"`
+}
+
+// toSVCBSlice parses {"priority", "target", "params"} objects. Params are
+// checked by miekg/dns's presentation-format parser.
+func toSVCBSlice(v any, rt RRType) ([]SVCB, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("values must be array for %s", rt)
+	}
+	out := make([]SVCB, 0, len(arr))
+	for _, e := range arr {
+		m, ok := e.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s value must be object", rt)
+		}
+		prio, ok1 := m["priority"].(float64)
+		target, ok2 := m["target"].(string)
+		if !ok1 || !ok2 || target == "" {
+			return nil, fmt.Errorf("%s requires priority and target", rt)
+		}
+		s := SVCB{Priority: uint16(prio), Target: strings.ToLower(MustFQDN(target))}
+		if raw, ok := m["params"]; ok {
+			pm, ok := raw.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s params must be object", rt)
+			}
+			s.Params = make(map[string]string, len(pm))
+			for k, pv := range pm {
+				str, ok := pv.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s param %s must be string", rt, k)
+				}
+				s.Params[strings.ToLower(k)] = str
+			}
+		}
+		if s.Priority == 0 && len(s.Params) > 0 {
+			return nil, errors.New("SVCB AliasMode (priority 0) takes no params")
+		}
+		val, err := parseSvcParams(rt, s)
+		if err != nil {
+			return nil, err
+		}
+		s.Value = val
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func parseSvcParams(rt RRType, s SVCB) ([]dns.SVCBKeyValue, error) {
+	keys := make([]string, 0, len(s.Params))
+	for k := range s.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ". 0 IN %s %d %s", rt, s.Priority, s.Target)
+	for _, k := range keys {
+		sb.WriteString(" " + k)
+		if v := s.Params[k]; v != "" {
+			sb.WriteString(`="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`)
+		}
+	}
+	rr, err := dns.NewRR(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s params: %w", rt, err)
+	}
+	switch x := rr.(type) {
+	case *dns.SVCB:
+		return x.Value, nil
+	case *dns.HTTPS:
+		return x.Value, nil
+	}
+	return nil, fmt.Errorf("invalid %s record", rt)
+}
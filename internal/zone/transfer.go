@@ -0,0 +1,199 @@
+package zone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"smart-dns/internal/tsig"
+
+	"github.com/miekg/dns"
+)
+
+// Refresh timing used until a first transfer provides the zone's SOA.
+const (
+	defaultRetry = time.Minute
+	minRefresh   = 5 * time.Second
+)
+
+// TransferClient keeps a secondary zone in sync with its primary: it polls
+// the primary's SOA every Refresh seconds (Retry after a failure), pulls the
+// zone by AXFR when the serial is newer and swaps it into Store. A zone the
+// primary hasn't confirmed for Expire seconds is removed from Store.
+type TransferClient struct {
+	Zone    string // FQDN
+	Primary string // host:port
+	View    string
+	Store   *Store
+	Logger  *slog.Logger
+	// Key, if set, signs the SOA polls and transfers (TSIG).
+	Key *tsig.Key
+	// OnUpdate, if set, is called after a new version was swapped in or
+	// the zone expired.
+	OnUpdate func(zone string)
+
+	kickOnce sync.Once
+	kick     chan struct{}
+}
+
+// Notify asks Run for an immediate refresh, as on a NOTIFY from the primary
+// (RFC 1996). The usual serial check applies, so it's a no-op when the
+// primary has nothing newer.
+func (c *TransferClient) Notify() {
+	select {
+	case c.kicks() <- struct{}{}:
+	default: // a refresh is already pending
+	}
+}
+
+func (c *TransferClient) kicks() chan struct{} {
+	c.kickOnce.Do(func() { c.kick = make(chan struct{}, 1) })
+	return c.kick
+}
+
+// Serial returns the serial of the version being served, if any.
+func (c *TransferClient) Serial() (uint32, bool) {
+	if zi := c.current(); zi != nil {
+		return zi.Serial, true
+	}
+	return 0, false
+}
+
+// Run keeps the zone fresh until ctx is done.
+func (c *TransferClient) Run(ctx context.Context) {
+	var lastOK time.Time
+	for {
+		wait := defaultRetry
+		cur := c.current()
+		zi, err := c.refresh(cur)
+		switch {
+		case err == nil:
+			lastOK = time.Now()
+			if zi != nil {
+				c.Store.SwapZone(zi)
+				c.Logger.Info("zone transferred", "zone", zi.ZoneFQDN, "view", c.View, "serial", zi.Serial, "primary", c.Primary)
+				cur = zi
+				c.updated()
+			}
+			if cur != nil {
+				wait = max(time.Duration(cur.SOA.Refresh)*time.Second, minRefresh)
+			}
+		default:
+			c.Logger.Warn("zone transfer failed", "zone", c.Zone, "view", c.View, "primary", c.Primary, "err", err)
+			if cur != nil {
+				wait = max(time.Duration(cur.SOA.Retry)*time.Second, minRefresh)
+				expire := time.Duration(cur.SOA.Expire) * time.Second
+				if !lastOK.IsZero() && time.Since(lastOK) > expire {
+					c.Logger.Warn("secondary zone expired", "zone", c.Zone, "view", c.View)
+					c.Store.RemoveZone(c.Zone)
+					lastOK = time.Time{}
+					c.updated()
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case <-c.kicks():
+		}
+	}
+}
+
+func (c *TransferClient) updated() {
+	if c.OnUpdate != nil {
+		c.OnUpdate(c.Zone)
+	}
+}
+
+// current returns the zone as served now, if any.
+func (c *TransferClient) current() *ZoneIndex {
+	zi, _ := c.Store.GetZoneForName(c.Zone)
+	if zi == nil || zi.ZoneFQDN != dns.CanonicalName(c.Zone) {
+		return nil
+	}
+	return zi
+}
+
+// refresh returns a newer version of the zone than cur, or nil when cur is
+// up to date.
+func (c *TransferClient) refresh(cur *ZoneIndex) (*ZoneIndex, error) {
+	if cur != nil {
+		serial, err := c.serial()
+		if err != nil {
+			return nil, err
+		}
+		if serial <= cur.Serial {
+			return nil, nil
+		}
+	}
+	zi, err := c.Transfer()
+	if err != nil {
+		return nil, err
+	}
+	if cur != nil && zi.Serial <= cur.Serial {
+		return nil, nil
+	}
+	return zi, nil
+}
+
+// serial asks the primary for the zone's current SOA serial.
+func (c *TransferClient) serial() (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(c.Zone), dns.TypeSOA)
+	cl := new(dns.Client)
+	if c.Key != nil {
+		c.Key.Sign(m)
+		cl.TsigSecret = c.Key.Secrets()
+	}
+	resp, _, err := cl.Exchange(m, c.Primary)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no SOA in answer (%s)", dns.RcodeToString[resp.Rcode])
+}
+
+// Transfer pulls the zone from the primary by AXFR and indexes it.
+func (c *TransferClient) Transfer() (*ZoneIndex, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(c.Zone))
+	t := new(dns.Transfer)
+	if c.Key != nil {
+		c.Key.Sign(m)
+		t.TsigSecret = c.Key.Secrets()
+	}
+	ch, err := t.In(m, c.Primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	// AXFR brackets the zone with its SOA
+	if len(rrs) < 2 || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		return nil, errors.New("incomplete transfer")
+	}
+	zf, err := zoneFileFromRRs(rrs[:len(rrs)-1])
+	if err != nil {
+		return nil, err
+	}
+	zf.View = c.View
+	zi, err := zf.ToIndex()
+	if err != nil {
+		return nil, err
+	}
+	zi.Primary = c.Primary
+	return zi, nil
+}
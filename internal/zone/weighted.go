@@ -0,0 +1,88 @@
+package zone
+
+import (
+	"errors"
+	"net"
+)
+
+// WeightedAddr is the object form of an A/AAAA value. Plain string values
+// and objects without a weight are unweighted (0) and get weighted.Default.
+type WeightedAddr struct {
+	IP     string `json:"ip" yaml:"ip"`
+	Weight uint32 `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+// toAddrSlice reads A/AAAA values given as strings or {"ip", "weight"}
+// objects. Weights are nil unless at least one object was given.
+func toAddrSlice(v any) ([]string, []uint32, error) {
+	arr, ok := v.([]any)
+	if !ok {
+		ips, err := toStringSlice(v)
+		return ips, nil, err
+	}
+	ips := make([]string, 0, len(arr))
+	wts := make([]uint32, 0, len(arr))
+	weighted := false
+	for _, e := range arr {
+		switch x := e.(type) {
+		case string:
+			ips = append(ips, x)
+			wts = append(wts, 0)
+		case map[string]any:
+			ip, ok := x["ip"].(string)
+			if !ok {
+				return nil, nil, errors.New("address object requires ip")
+			}
+			var w float64
+			if raw, ok := x["weight"]; ok {
+				if w, ok = raw.(float64); !ok || w < 1 || w > 1<<32-1 {
+					return nil, nil, errors.New("address weight must be a positive number")
+				}
+			}
+			ips = append(ips, ip)
+			wts = append(wts, uint32(w))
+			weighted = true
+		default:
+			return nil, nil, errors.New("address must be string or {\"ip\", \"weight\"}")
+		}
+	}
+	if !weighted {
+		wts = nil
+	}
+	return ips, wts, nil
+}
+
+// mergeWeights appends the weights of n new addresses to the have weights
+// of an RRset already holding haveN, padding whichever side is unweighted
+// with 0s. Both unweighted stays nil.
+func mergeWeights(have []uint32, haveN int, add []uint32, n int) []uint32 {
+	if have == nil && add == nil {
+		return nil
+	}
+	for len(have) < haveN {
+		have = append(have, 0)
+	}
+	for len(add) < n {
+		add = append(add, 0)
+	}
+	return append(have, add...)
+}
+
+// dedupeWeighted drops repeated addresses together with their weights.
+func dedupeWeighted(ips []net.IP, wts []uint32) ([]net.IP, []uint32, int) {
+	type addr struct {
+		ip net.IP
+		w  uint32
+	}
+	pairs := make([]addr, len(ips))
+	for i := range ips {
+		pairs[i] = addr{ips[i], wts[i]}
+	}
+	pairs, d := uniq(pairs, func(a addr) string { return a.ip.String() })
+	ips, wts = ips[:0], wts[:0]
+	for _, p := range pairs {
+		ips = append(ips, p.ip)
+		wts = append(wts, p.w)
+	}
+	return ips, wts, d
+}
@@ -53,12 +53,28 @@ func strToType(s string) uint16 {
 		return dns.TypeCNAME
 	case "MX":
 		return dns.TypeMX
+	case "SOA":
+		return dns.TypeSOA
 	case "NS":
 		return dns.TypeNS
 	case "TXT":
 		return dns.TypeTXT
 	case "SRV":
 		return dns.TypeSRV
+	case "PTR":
+		return dns.TypePTR
+	case "CAA":
+		return dns.TypeCAA
+	case "HINFO":
+		return dns.TypeHINFO
+	case "LOC":
+		return dns.TypeLOC
+	case "NAPTR":
+		return dns.TypeNAPTR
+	case "HTTPS":
+		return dns.TypeHTTPS
+	case "SVCB":
+		return dns.TypeSVCB
 	default:
 		return dns.TypeA
 	}